@@ -0,0 +1,233 @@
+package action
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/parser"
+	"github.com/sdghchj/sql-rules-engine/utils"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrStopped = errors.New("action stopped")
+var ErrInvalidParam = errors.New("invalid action param")
+var ErrTooManyHops = errors.New("too many republish hops")
+
+// MaxHops is the number of times a message may be republished, so that rules republishing to themselves do not loop forever
+const MaxHops = 16
+
+// Message is an output of a rule delivered to actions
+type Message struct {
+	Topic   string      //the topic the input of the rule was published to
+	Rule    string      //the id of the rule
+	Payload interface{} //the output
+	Hops    int         //the number of times the input of the rule was republished
+}
+
+// MessageTopic makes topic(n) available in the templates rendered on the message
+func (m *Message) MessageTopic() string {
+	return m.Topic
+}
+
+// Field looks up the members of the payload, so that ${key} in a template rendered on the message is a member of the payload
+func (m *Message) Field(key string) (interface{}, bool) {
+	return utils.GetField(m.Payload, key)
+}
+
+// Action delivers the outputs of rules, it is started before the first message and stopped after the last one
+type Action interface {
+	Start() error
+	Stop() error
+	Do(msg *Message) error
+}
+
+// Params are the params of an action, from the arguments of a DO clause or the params of a rule config
+type Params map[string]interface{}
+
+// Factory creates an action from its params
+type Factory func(params Params) (Action, error)
+
+func paramError(name string, kind string) error {
+	return fmt.Errorf("%v: %s must be %s", ErrInvalidParam, name, kind)
+}
+
+// String returns the string param name, or def when it is missing
+func (p Params) String(name string, def string) (string, error) {
+	val, ok := p[name]
+	if !ok || val == nil {
+		return def, nil
+	}
+	if s, ok := val.(string); ok {
+		return s, nil
+	}
+	return "", paramError(name, "a string")
+}
+
+// RequiredString returns the string param name, which must not be empty
+func (p Params) RequiredString(name string) (string, error) {
+	s, err := p.String(name, "")
+	if err == nil && s == "" {
+		err = paramError(name, "a non empty string")
+	}
+	return s, err
+}
+
+// Int returns the integral param name, or def when it is missing
+func (p Params) Int(name string, def int) (int, error) {
+	val, ok := p[name]
+	if !ok || val == nil {
+		return def, nil
+	}
+	f, err := utils.GetFloat64(val)
+	if err != nil || f != float64(int(f)) {
+		return 0, paramError(name, "an integer")
+	}
+	return int(f), nil
+}
+
+// Duration returns the duration param name, which is a string parsed by time.ParseDuration or a number of milliseconds,
+// or def when it is missing
+func (p Params) Duration(name string, def time.Duration) (time.Duration, error) {
+	val, ok := p[name]
+	if !ok || val == nil {
+		return def, nil
+	}
+	if s, ok := val.(string); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, paramError(name, "a duration")
+		}
+		return d, nil
+	}
+	f, err := utils.GetFloat64(val)
+	if err != nil || f < 0 {
+		return 0, paramError(name, "a duration")
+	}
+	return time.Duration(f * float64(time.Millisecond)), nil
+}
+
+// Template is a text which may have placeholders ${expr}, rendered on the messages delivered.
+// The expressions see the members of the payload, and topic(n) returns the level n (from 1) of the topic.
+type Template struct {
+	text     string
+	template *parser.Template
+}
+
+// ParseTemplate parses text, which is taken as it is when it has no placeholders
+func ParseTemplate(text string) (*Template, error) {
+	t := &Template{text: text}
+	if strings.Contains(text, "${") || strings.Contains(text, "$$") {
+		var err error
+		if t.template, err = parser.ParseTemplate(text, parser.DefaultGoParser, nil); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Render returns the text rendered on msg
+func (t *Template) Render(msg *Message) string {
+	if t.template == nil {
+		return t.text
+	}
+	return t.template.Render(msg)
+}
+
+// RetryPolicy retries a failed action Attempts times at most, waiting Backoff before the first retry,
+// which is doubled for every retry up to MaxBackoff when it is not zero.
+// Every wait is changed randomly by up to Jitter (from 0 to 1) of it, so that the retries of many messages spread out.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+}
+
+// wait returns the backoff changed randomly by the jitter
+func (p *RetryPolicy) wait(backoff time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return backoff
+	}
+	return time.Duration(float64(backoff) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+// RetryPolicyOf reads the params retries, backoff, max_backoff and jitter of an action,
+// the backoff is 100ms by default
+func RetryPolicyOf(params Params) (RetryPolicy, error) {
+	var policy RetryPolicy
+	var err error
+	if policy.Attempts, err = params.Int("retries", 0); err != nil {
+		return policy, err
+	} else if policy.Attempts < 0 {
+		return policy, paramError("retries", "not negative")
+	}
+	if policy.Backoff, err = params.Duration("backoff", 100*time.Millisecond); err != nil {
+		return policy, err
+	}
+	if policy.MaxBackoff, err = params.Duration("max_backoff", 0); err != nil {
+		return policy, err
+	}
+	if jitter, ok := params["jitter"]; ok && jitter != nil {
+		if policy.Jitter, err = utils.GetFloat64(jitter); err != nil || policy.Jitter < 0 || policy.Jitter > 1 {
+			return policy, paramError("jitter", "a number from 0 to 1")
+		}
+	}
+	return policy, nil
+}
+
+type retryAction struct {
+	Action
+	policy  RetryPolicy
+	lock    sync.Mutex
+	stopped chan struct{}
+}
+
+// WithRetry returns a which retries by policy, the waiting for a retry is given up when it is stopped
+func WithRetry(a Action, policy RetryPolicy) Action {
+	if policy.Attempts <= 0 {
+		return a
+	}
+	return &retryAction{Action: a, policy: policy}
+}
+
+func (a *retryAction) Start() error {
+	a.lock.Lock()
+	a.stopped = make(chan struct{})
+	a.lock.Unlock()
+	return a.Action.Start()
+}
+
+func (a *retryAction) Stop() error {
+	a.lock.Lock()
+	if a.stopped != nil {
+		close(a.stopped)
+		a.stopped = nil
+	}
+	a.lock.Unlock()
+	return a.Action.Stop()
+}
+
+func (a *retryAction) Do(msg *Message) error {
+	a.lock.Lock()
+	stopped := a.stopped
+	a.lock.Unlock()
+
+	err := a.Action.Do(msg)
+	backoff := a.policy.Backoff
+	for i := 0; i < a.policy.Attempts && err != nil && err != ErrTooManyHops; i++ {
+		timer := time.NewTimer(a.policy.wait(backoff))
+		select {
+		case <-stopped:
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; a.policy.MaxBackoff > 0 && backoff > a.policy.MaxBackoff {
+			backoff = a.policy.MaxBackoff
+		}
+		err = a.Action.Do(msg)
+	}
+	return err
+}
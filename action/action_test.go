@@ -0,0 +1,136 @@
+package action
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplate(t *testing.T) {
+	msg := &Message{Topic: "sensors/s1/temp", Rule: "sensors/+/temp", Payload: map[string]interface{}{"a": 1.0, "b": "x"}}
+	for text, expected := range map[string]string{
+		"alerts":                     "alerts",
+		"alerts/${topic(2)}":         "alerts/s1",
+		"${topic()}/${b}/${a:%03d}":  "sensors/s1/temp/x/001",
+		"alerts/${topic(4)}/${c}/$$": "alerts///$",
+	} {
+		tmpl, err := ParseTemplate(text)
+		if err != nil {
+			t.Error(text, err)
+		} else if s := tmpl.Render(msg); s != expected {
+			t.Error(text, s)
+		}
+	}
+	if _, err := ParseTemplate("alerts/${topic(2)"); err == nil {
+		t.Error("invalid template parsed")
+	}
+}
+
+func TestParams(t *testing.T) {
+	params := Params{"path": "a.log", "retries": 3.0, "backoff": "1s", "max_backoff": 500.0, "bad": true}
+	if s, err := params.RequiredString("path"); err != nil || s != "a.log" {
+		t.Error(s, err)
+	}
+	if _, err := params.RequiredString("url"); err == nil {
+		t.Error("missing param")
+	}
+	if _, err := params.String("bad", ""); err == nil {
+		t.Error("bool as string")
+	}
+	policy, err := RetryPolicyOf(params)
+	if err != nil || policy.Attempts != 3 || policy.Backoff != time.Second || policy.MaxBackoff != 500*time.Millisecond {
+		t.Error(policy, err)
+	}
+	if _, err = RetryPolicyOf(Params{"retries": 1.5}); err == nil {
+		t.Error("fractional retries")
+	}
+	if _, err = RetryPolicyOf(Params{"backoff": "soon"}); err == nil {
+		t.Error("invalid duration")
+	}
+}
+
+type failingAction struct {
+	writerAction
+	fails int
+	calls int
+}
+
+func (a *failingAction) Do(msg *Message) error {
+	a.calls++
+	if a.calls <= a.fails {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func TestWithRetry(t *testing.T) {
+	a := &failingAction{fails: 2}
+	retry := WithRetry(a, RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+	retry.Start()
+	if err := retry.Do(&Message{}); err != nil || a.calls != 3 {
+		t.Error(err, a.calls)
+	}
+
+	a = &failingAction{fails: 10}
+	retry = WithRetry(a, RetryPolicy{Attempts: 2, Backoff: time.Millisecond})
+	retry.Start()
+	if err := retry.Do(&Message{}); err == nil || a.calls != 3 {
+		t.Error(err, a.calls)
+	}
+
+	//stopping gives up waiting
+	a = &failingAction{fails: 10}
+	retry = WithRetry(a, RetryPolicy{Attempts: 2, Backoff: time.Hour})
+	retry.Start()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		retry.Stop()
+	}()
+	if err := retry.Do(&Message{}); err == nil || a.calls != 1 {
+		t.Error(err, a.calls)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "action")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "out.log")
+	a := NewFile(path)
+	if err = a.Do(&Message{Payload: 1}); err != ErrStopped {
+		t.Error(err)
+	}
+	if err = a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	a.Do(&Message{Payload: map[string]interface{}{"a": 1}})
+	a.Do(&Message{Payload: "b"})
+	a.Stop()
+	if bin, err := ioutil.ReadFile(path); err != nil || string(bin) != "{\"a\":1}\n\"b\"\n" {
+		t.Error(string(bin), err)
+	}
+}
+
+func TestChannel(t *testing.T) {
+	ch := make(chan *Message, 1)
+	a := NewChannel(ch)
+	a.Start()
+	if err := a.Do(&Message{Payload: 1}); err != nil || (<-ch).Payload != 1 {
+		t.Error(err)
+	}
+
+	a.Do(&Message{Payload: 2}) //fills ch
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.Stop()
+	}()
+	if err := a.Do(&Message{Payload: 3}); err != ErrStopped {
+		t.Error(err)
+	}
+}
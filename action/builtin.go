@@ -0,0 +1,188 @@
+package action
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+type republishAction struct {
+	topic   *Template
+	publish func(msg *Message) error
+}
+
+// NewRepublish publishes the payloads by publish to the topic rendered from topic,
+// e.g. 'alerts/${topic(2)}' for the second level of the topic of the input
+func NewRepublish(topic string, publish func(topic string, payload interface{}) error) (Action, error) {
+	return NewRepublishMessage(topic, func(msg *Message) error {
+		return publish(msg.Topic, msg.Payload)
+	})
+}
+
+// NewRepublishMessage is NewRepublish which passes publish the message republished, whose Hops is one more than
+// the one of the message delivered. The messages already republished MaxHops times fail with ErrTooManyHops.
+func NewRepublishMessage(topic string, publish func(msg *Message) error) (Action, error) {
+	t, err := ParseTemplate(topic)
+	if err != nil {
+		return nil, err
+	}
+	return &republishAction{topic: t, publish: publish}, nil
+}
+
+func (a *republishAction) Start() error {
+	return nil
+}
+
+func (a *republishAction) Stop() error {
+	return nil
+}
+
+func (a *republishAction) Do(msg *Message) error {
+	if msg.Hops >= MaxHops {
+		return ErrTooManyHops
+	}
+	return a.publish(&Message{Topic: a.topic.Render(msg), Rule: msg.Rule, Payload: msg.Payload, Hops: msg.Hops + 1})
+}
+
+type writerAction struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewWriter writes the payloads into w in json, one per line
+func NewWriter(w io.Writer) Action {
+	return &writerAction{w: w}
+}
+
+// NewStdout writes the payloads into the standard output in json, one per line
+func NewStdout() Action {
+	return NewWriter(os.Stdout)
+}
+
+func (a *writerAction) Start() error {
+	return nil
+}
+
+func (a *writerAction) Stop() error {
+	return nil
+}
+
+func (a *writerAction) Do(msg *Message) error {
+	bin, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.w.Write(append(bin, '\n'))
+	return err
+}
+
+type fileAction struct {
+	path string
+	lock sync.Mutex
+	file *os.File
+}
+
+// NewFile appends the payloads to the file of path in json, one per line.
+// The file is created when it does not exist, it is opened when started and closed when stopped.
+func NewFile(path string) Action {
+	return &fileAction{path: path}
+}
+
+func (a *fileAction) Start() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = file
+	return nil
+}
+
+func (a *fileAction) Stop() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+func (a *fileAction) Do(msg *Message) error {
+	bin, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return ErrStopped
+	}
+	_, err = a.file.Write(append(bin, '\n'))
+	return err
+}
+
+type channelAction struct {
+	ch      chan<- *Message
+	lock    sync.Mutex
+	stopped chan struct{}
+}
+
+// NewChannel sends the messages into ch, waiting for ch to receive them until it is stopped
+func NewChannel(ch chan<- *Message) Action {
+	return &channelAction{ch: ch}
+}
+
+func (a *channelAction) Start() error {
+	a.lock.Lock()
+	a.stopped = make(chan struct{})
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *channelAction) Stop() error {
+	a.lock.Lock()
+	if a.stopped != nil {
+		close(a.stopped)
+		a.stopped = nil
+	}
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *channelAction) Do(msg *Message) error {
+	a.lock.Lock()
+	stopped := a.stopped
+	a.lock.Unlock()
+	if stopped == nil {
+		return ErrStopped
+	}
+	select {
+	case a.ch <- msg:
+		return nil
+	case <-stopped:
+		return ErrStopped
+	}
+}
+
+// FileFactory creates a file action of the param path
+func FileFactory(params Params) (Action, error) {
+	path, err := params.RequiredString("path")
+	if err != nil {
+		return nil, err
+	}
+	return NewFile(path), nil
+}
+
+// StdoutFactory creates a stdout action
+func StdoutFactory(params Params) (Action, error) {
+	return NewStdout(), nil
+}
@@ -0,0 +1,204 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultWebhookTimeout is the timeout of a request of a webhook
+const DefaultWebhookTimeout = 10 * time.Second
+
+// WebhookConfig configures a webhook action
+type WebhookConfig struct {
+	Method  string                //POST by default
+	URL     string                //a template
+	Headers map[string]string     //templates of the values
+	Body    string                //a template, the payload in json by default
+	Timeout time.Duration         //DefaultWebhookTimeout by default
+	Success func(status int) bool //2xx by default
+}
+
+type webhookAction struct {
+	method  string
+	url     *Template
+	headers map[string]*Template
+	body    *Template
+	success func(status int) bool
+	client  *http.Client
+}
+
+// NewWebhook posts the payloads to url in json, a response other than 2xx is an error
+func NewWebhook(url string, timeout time.Duration) Action {
+	return &webhookAction{
+		method:  http.MethodPost,
+		url:     &Template{text: url},
+		success: isSuccess,
+		client:  &http.Client{Timeout: timeoutOrDefault(timeout)},
+	}
+}
+
+// NewWebhookWith creates a webhook action of config, whose templates are rendered on every message.
+// A response whose status is not a success by config.Success is an error.
+func NewWebhookWith(config WebhookConfig) (Action, error) {
+	a := &webhookAction{
+		method:  strings.ToUpper(config.Method),
+		headers: make(map[string]*Template, len(config.Headers)),
+		success: config.Success,
+		client:  &http.Client{Timeout: timeoutOrDefault(config.Timeout)},
+	}
+	if a.method == "" {
+		a.method = http.MethodPost
+	}
+	if a.success == nil {
+		a.success = isSuccess
+	}
+	var err error
+	if a.url, err = ParseTemplate(config.URL); err != nil {
+		return nil, err
+	}
+	for name, value := range config.Headers {
+		if a.headers[name], err = ParseTemplate(value); err != nil {
+			return nil, err
+		}
+	}
+	if config.Body != "" {
+		if a.body, err = ParseTemplate(config.Body); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func timeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultWebhookTimeout
+	}
+	return timeout
+}
+
+func isSuccess(status int) bool {
+	return status >= 200 && status <= 299
+}
+
+// ParseStatuses parses a list of statuses separated by commas into a success predicate of a webhook,
+// each of which is a status such as 404, a range such as 200-204, or a class such as 2xx
+func ParseStatuses(text string) (func(status int) bool, error) {
+	type statusRange struct {
+		from, to int
+	}
+	var ranges []statusRange
+	for _, item := range strings.Split(text, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		var r statusRange
+		var err error
+		if len(item) == 3 && strings.HasSuffix(item, "xx") && item[0] >= '1' && item[0] <= '5' {
+			r.from = int(item[0]-'0') * 100
+			r.to = r.from + 99
+		} else if n := strings.IndexByte(item, '-'); n > 0 {
+			if r.from, err = strconv.Atoi(item[:n]); err == nil {
+				r.to, err = strconv.Atoi(item[n+1:])
+			}
+		} else if r.from, err = strconv.Atoi(item); err == nil {
+			r.to = r.from
+		}
+		if err != nil || r.from < 100 || r.to > 599 || r.from > r.to {
+			return nil, fmt.Errorf("%v: invalid status %q", ErrInvalidParam, item)
+		}
+		ranges = append(ranges, r)
+	}
+	return func(status int) bool {
+		for _, r := range ranges {
+			if status >= r.from && status <= r.to {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func (a *webhookAction) Start() error {
+	return nil
+}
+
+func (a *webhookAction) Stop() error {
+	a.client.CloseIdleConnections()
+	return nil
+}
+
+func (a *webhookAction) Do(msg *Message) error {
+	var body []byte
+	if a.body != nil {
+		body = []byte(a.body.Render(msg))
+	} else {
+		var err error
+		if body, err = json.Marshal(msg.Payload); err != nil {
+			return err
+		}
+	}
+	url := a.url.Render(msg)
+	req, err := http.NewRequest(a.method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range a.headers {
+		req.Header.Set(name, value.Render(msg))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if !a.success(resp.StatusCode) {
+		return fmt.Errorf("webhook %s %s: %s", a.method, url, resp.Status)
+	}
+	return nil
+}
+
+// WebhookFactory creates a webhook action of the params method, url, headers, body, timeout and success,
+// which is a list of statuses parsed by ParseStatuses
+func WebhookFactory(params Params) (Action, error) {
+	var config WebhookConfig
+	var err error
+	if config.Method, err = params.String("method", http.MethodPost); err != nil {
+		return nil, err
+	}
+	if config.URL, err = params.RequiredString("url"); err != nil {
+		return nil, err
+	}
+	if headers, ok := params["headers"]; ok && headers != nil {
+		m, ok := headers.(map[string]interface{})
+		if !ok {
+			return nil, paramError("headers", "an object")
+		}
+		config.Headers = make(map[string]string, len(m))
+		for name, value := range m {
+			if config.Headers[name], ok = value.(string); !ok {
+				return nil, paramError("headers."+name, "a string")
+			}
+		}
+	}
+	if config.Body, err = params.String("body", ""); err != nil {
+		return nil, err
+	}
+	if config.Timeout, err = params.Duration("timeout", DefaultWebhookTimeout); err != nil {
+		return nil, err
+	}
+	if success, err := params.String("success", ""); err != nil {
+		return nil, err
+	} else if success != "" {
+		if config.Success, err = ParseStatuses(success); err != nil {
+			return nil, err
+		}
+	}
+	return NewWebhookWith(config)
+}
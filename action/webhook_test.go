@@ -0,0 +1,130 @@
+package action
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type request struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+// newServer records the requests, and responds with the statuses in order, the last one repeated
+func newServer(statuses ...int) (*httptest.Server, func() []*request) {
+	var lock sync.Mutex
+	var requests []*request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, &request{method: r.Method, path: r.URL.Path, header: r.Header, body: string(body)})
+		status := statuses[len(statuses)-1]
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	return server, func() []*request {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]*request(nil), requests...)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	server, requests := newServer(http.StatusOK)
+	defer server.Close()
+
+	msg := &Message{Topic: "sensors/s1/temp", Rule: "r", Payload: map[string]interface{}{"device": "s1", "temp": 60.5}}
+	a := NewWebhook(server.URL+"/hook", 0)
+	a.Start()
+	if err := a.Do(msg); err != nil {
+		t.Fatal(err)
+	}
+	a.Stop()
+
+	a, err := WebhookFactory(Params{
+		"method":  "put",
+		"url":     server.URL + "/devices/${device}/${topic(3)}",
+		"headers": map[string]interface{}{"X-Device": "${device}", "Authorization": "Bearer abc"},
+		"body":    `{"text": "${device} is ${temp:%.0f} degrees"}`,
+		"timeout": "1s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Do(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := requests()
+	if len(reqs) != 2 {
+		t.Fatal(len(reqs))
+	}
+	if r := reqs[0]; r.method != "POST" || r.path != "/hook" || r.body != `{"device":"s1","temp":60.5}` ||
+		r.header.Get("Content-Type") != "application/json" {
+		t.Error(r)
+	}
+	if r := reqs[1]; r.method != "PUT" || r.path != "/devices/s1/temp" || r.body != `{"text": "s1 is 60 degrees"}` ||
+		r.header.Get("X-Device") != "s1" || r.header.Get("Authorization") != "Bearer abc" {
+		t.Error(r)
+	}
+
+	if _, err = WebhookFactory(Params{"url": server.URL, "headers": "x"}); err == nil {
+		t.Error("invalid headers")
+	}
+	if _, err = WebhookFactory(Params{}); err == nil {
+		t.Error("missing url")
+	}
+}
+
+func TestWebhookStatuses(t *testing.T) {
+	server, requests := newServer(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusNotFound)
+	defer server.Close()
+
+	//503 is retried with backoff, and 404 is a success
+	a, err := WebhookFactory(Params{"url": server.URL, "success": "2xx, 404"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = WithRetry(a, RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Jitter: 0.5})
+	a.Start()
+	if err = a.Do(&Message{Payload: 1}); err != nil || len(requests()) != 3 {
+		t.Error(err, len(requests()))
+	}
+
+	a = NewWebhook(server.URL, 0)
+	if err = a.Do(&Message{Payload: 1}); err == nil {
+		t.Error("404 is not a success by default")
+	}
+
+	for text, expected := range map[string][]int{
+		"2xx":              {200, 204, 299},
+		"200-202, 404,5XX": {200, 202, 404, 500, 503},
+	} {
+		success, err := ParseStatuses(text)
+		if err != nil {
+			t.Fatal(text, err)
+		}
+		for _, status := range expected {
+			if !success(status) {
+				t.Error(text, status)
+			}
+		}
+		if success(301) || success(403) {
+			t.Error(text)
+		}
+	}
+	for _, text := range []string{"", "6xx", "200-100", "abc", "99"} {
+		if _, err := ParseStatuses(text); err == nil {
+			t.Error(text)
+		}
+	}
+}
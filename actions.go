@@ -0,0 +1,338 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/action"
+	"github.com/sdghchj/sql-rules-engine/deadletter"
+	"github.com/sdghchj/sql-rules-engine/rule"
+	"github.com/sdghchj/sql-rules-engine/topic"
+	"strings"
+	"time"
+)
+
+var ErrUnknownAction = errors.New("unknown action")
+var ErrInvalidLetter = errors.New("invalid dead letter")
+
+// actionType creates the actions of a name, the positional arguments of them in DO clauses are named by argNames
+type actionType struct {
+	factory  action.Factory
+	argNames []string
+}
+
+// ruleAction is an action started for a version of a rule
+type ruleAction struct {
+	name   string
+	action action.Action
+}
+
+// ActionError is the error of an action of a rule on an output of it
+type ActionError struct {
+	Rule   string
+	Action string
+	Err    error
+}
+
+func (e *ActionError) Error() string {
+	return e.Rule + ": " + e.Action + ": " + e.Err.Error()
+}
+
+// ActionErrors is every error of the actions run for a message
+type ActionErrors []*ActionError
+
+func (e ActionErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// registerBuiltinActions registers republish(topic), file(path), webhook(url, timeout) and stdout()
+func (e *jsonEngine) registerBuiltinActions() {
+	e.RegisterAction("republish", func(params action.Params) (action.Action, error) {
+		t, err := params.RequiredString("topic")
+		if err != nil {
+			return nil, err
+		}
+		return action.NewRepublishMessage(t, func(msg *action.Message) error {
+			return e.publish(msg.Topic, msg.Payload, msg.Hops)
+		})
+	}, "topic")
+	e.RegisterAction("file", action.FileFactory, "path")
+	e.RegisterAction("webhook", action.WebhookFactory, "url", "timeout")
+	e.RegisterAction("stdout", action.StdoutFactory)
+}
+
+// RegisterAction registers the actions of name for the rules parsed afterwards, replacing the one of the same name.
+// The positional arguments of them in DO clauses are the params of argNames in order.
+// Every action also takes the params retries, backoff, max_backoff and jitter of action.RetryPolicyOf.
+func (e *jsonEngine) RegisterAction(name string, factory action.Factory, argNames ...string) Engine {
+	e.typesLock.Lock()
+	defer e.typesLock.Unlock()
+	if e.actionTypes == nil {
+		e.actionTypes = make(map[string]*actionType)
+	}
+	e.actionTypes[strings.ToLower(name)] = &actionType{factory: factory, argNames: argNames}
+	return e
+}
+
+func (e *jsonEngine) actionType(name string) (*actionType, bool) {
+	e.typesLock.RLock()
+	defer e.typesLock.RUnlock()
+	t, ok := e.actionTypes[strings.ToLower(name)]
+	return t, ok
+}
+
+// newAction creates the action of name with params, wrapped by its retry policy
+func (e *jsonEngine) newAction(name string, params action.Params) (action.Action, error) {
+	t, ok := e.actionType(name)
+	if !ok {
+		return nil, fmt.Errorf("%v %q", ErrUnknownAction, name)
+	}
+	policy, err := action.RetryPolicyOf(params)
+	if err != nil {
+		return nil, err
+	}
+	a, err := t.factory(params)
+	if err != nil {
+		return nil, err
+	}
+	return action.WithRetry(a, policy), nil
+}
+
+// newCallAction creates the action of a call of a DO clause
+func (e *jsonEngine) newCallAction(call rule.ActionCall) (action.Action, error) {
+	t, ok := e.actionType(call.Name)
+	if !ok {
+		return nil, fmt.Errorf("%v %q", ErrUnknownAction, call.Name)
+	}
+	if len(call.Args) > len(t.argNames) {
+		return nil, fmt.Errorf("%v: %s takes %d arguments", action.ErrInvalidParam, call.Name, len(t.argNames))
+	}
+	params := action.Params{}
+	for name, val := range call.Params {
+		params[name] = val
+	}
+	for i, val := range call.Args {
+		params[t.argNames[i]] = val
+	}
+	return e.newAction(call.Name, params)
+}
+
+// newRuleActions creates the actions of a rule config followed by the ones of the DO clause of r
+func (e *jsonEngine) newRuleActions(configs []ActionConfig, r rule.Rule) ([]*ruleAction, error) {
+	var calls []rule.ActionCall
+	if r != nil {
+		calls = r.Actions()
+	}
+	actions := make([]*ruleAction, 0, len(configs)+len(calls))
+	for _, config := range configs {
+		a, err := e.newAction(config.Type, config.Params)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, &ruleAction{name: config.Type, action: a})
+	}
+	for _, call := range calls {
+		a, err := e.newCallAction(call)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, &ruleAction{name: call.Name, action: a})
+	}
+	return actions, nil
+}
+
+// startActions starts actions, the ones already started are stopped when one fails
+func startActions(actions []*ruleAction) error {
+	for i, a := range actions {
+		if err := a.action.Start(); err != nil {
+			stopActions(actions[:i])
+			return fmt.Errorf("%s: %v", a.name, err)
+		}
+	}
+	return nil
+}
+
+func stopActions(actions []*ruleAction) {
+	for _, a := range actions {
+		a.action.Stop()
+	}
+}
+
+// deadLetterSink wraps the dead-letter sink of an engine, which may be nil, to be stored in an atomic.Value
+type deadLetterSink struct {
+	sink deadletter.Sink
+}
+
+// SetDeadLetter sets the sink of the messages failing at a stage of a rule: the json failing to decode,
+// the panics of expressions recovered into nil and of async event handlers, and the outputs the actions
+// failed to deliver after their retries
+func (e *jsonEngine) SetDeadLetter(sink deadletter.Sink) Engine {
+	e.deadLetter.Store(deadLetterSink{sink})
+	return e
+}
+
+func (e *jsonEngine) deadLetterSink() deadletter.Sink {
+	if s, ok := e.deadLetter.Load().(deadLetterSink); ok {
+		return s.sink
+	}
+	return nil
+}
+
+// ruleErrorHandler puts the errors of the rule id into the dead-letter sink of the time they happen
+func (e *jsonEngine) ruleErrorHandler(id string) rule.ErrorHandler {
+	return func(stage deadletter.Stage, payload interface{}, err error) {
+		e.putDeadLetter(&deadletter.Letter{Rule: id, Stage: stage, Payload: payload, Error: err.Error()})
+	}
+}
+
+func (e *jsonEngine) putDeadLetter(letter *deadletter.Letter) {
+	if sink := e.deadLetterSink(); sink != nil {
+		letter.Time = time.Now()
+		sink.Put(letter)
+	}
+}
+
+// runActions runs the actions of a rule on every output of obj published to topicText after hops republishes
+func (e *jsonEngine) runActions(entry *ruleEntry, topicText string, hops int, obj interface{}) (errs ActionErrors) {
+	for _, output := range entry.info.Rule.HandleAll(obj) {
+		errs = append(errs, e.deliver(entry, topicText, hops, output)...)
+	}
+	return errs
+}
+
+// deliver runs the actions of a rule on an output
+func (e *jsonEngine) deliver(entry *ruleEntry, topicText string, hops int, output interface{}) (errs ActionErrors) {
+	msg := &action.Message{Topic: topicText, Rule: entry.info.ID, Payload: output, Hops: hops}
+	m := e.ruleMetrics(entry.info.ID)
+	for _, a := range entry.actions {
+		err := a.action.Do(msg)
+		m.ObserveAction(a.name, err)
+		if err != nil {
+			errs = append(errs, &ActionError{Rule: entry.info.ID, Action: a.name, Err: err})
+			e.putDeadLetter(&deadletter.Letter{Rule: entry.info.ID, Stage: deadletter.StageAction, Action: a.name,
+				Topic: topicText, Payload: output, Error: err.Error()})
+			if entry.info.OnError == ErrorStop {
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// Publish handles obj by every enabled rule whose id matches topicText, a level of which is matched by + and
+// any levels by *, and runs the actions of the rules on every output in order in the calling goroutine.
+// The error returned is ActionErrors of the actions failing.
+// The outputs republished more than action.MaxHops times are rejected with action.ErrTooManyHops into the dead letters.
+func (e *jsonEngine) Publish(topicText string, obj interface{}) error {
+	return e.publish(topicText, obj, 0)
+}
+
+// publish is Publish of obj republished hops times
+func (e *jsonEngine) publish(topicText string, obj interface{}, hops int) error {
+	var errs ActionErrors
+	e.rules.Range(func(key, value interface{}) bool {
+		entry, ok := value.(*ruleEntry)
+		if !ok || !entry.info.Enabled || len(entry.actions) == 0 {
+			return true
+		}
+		if id := entry.info.ID; topic.Match(&topicText, &id) {
+			if entry = e.acquireEntry(id); entry != nil {
+				if entry.info.Enabled {
+					errs = append(errs, e.runActions(entry, topicText, hops, obj)...)
+				}
+				entry.release()
+			}
+		}
+		return true
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Close stops the actions of all the rules, which must not be published to afterwards
+func (e *jsonEngine) Close() error {
+	e.rulesLock.Lock()
+	defer e.rulesLock.Unlock()
+	e.rules.Range(func(key, value interface{}) bool {
+		if entry, ok := value.(*ruleEntry); ok {
+			entry.retire()
+		}
+		return true
+	})
+	return nil
+}
+
+// Replay processes a dead letter again. The output of a letter of deadletter.StageAction is delivered by the action
+// failing again, the payload of a letter of deadletter.StageHandler is handled by the async event handlers of the rule
+// again, and the payload of the other stages is handled by the rule again, whose outputs are returned after
+// they are delivered by all its actions. A letter of deadletter.StageDecode without rule is handled by HandleJsonAsync.
+// The failures are put into the dead-letter sink again.
+func (e *jsonEngine) Replay(letter *deadletter.Letter) ([]interface{}, error) {
+	if letter.Rule == "" && letter.Stage == deadletter.StageDecode {
+		text, ok := letter.Payload.(string)
+		if !ok {
+			return nil, ErrInvalidLetter
+		}
+		return nil, e.HandleJsonAsync(text)
+	}
+	entry := e.acquireEntry(letter.Rule)
+	if entry == nil {
+		return nil, ErrNoRuleFound
+	}
+	defer entry.release()
+	if !entry.info.Enabled {
+		return nil, ErrRuleDisabled
+	}
+
+	obj := letter.Payload
+	switch letter.Stage {
+	case deadletter.StageAction:
+		for _, a := range entry.actions {
+			if !strings.EqualFold(a.name, letter.Action) {
+				continue
+			}
+			msg := &action.Message{Topic: letter.Topic, Rule: letter.Rule, Payload: letter.Payload}
+			err := a.action.Do(msg)
+			e.ruleMetrics(letter.Rule).ObserveAction(a.name, err)
+			if err != nil {
+				e.putDeadLetter(&deadletter.Letter{Rule: letter.Rule, Stage: deadletter.StageAction, Action: a.name,
+					Topic: letter.Topic, Payload: letter.Payload, Error: err.Error()})
+				return nil, &ActionError{Rule: letter.Rule, Action: a.name, Err: err}
+			}
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%v %q", ErrUnknownAction, letter.Action)
+	case deadletter.StageHandler:
+		entry.info.Rule.HandleAsync(obj)
+		return nil, nil
+	case deadletter.StageDecode:
+		text, ok := letter.Payload.(string)
+		if !ok {
+			return nil, ErrInvalidLetter
+		}
+		if err := json.Unmarshal([]byte(text), &obj); err != nil {
+			e.putDeadLetter(&deadletter.Letter{Rule: letter.Rule, Stage: deadletter.StageDecode, Topic: letter.Topic,
+				Payload: text, Error: err.Error()})
+			return nil, err
+		}
+	case deadletter.StageFilter, deadletter.StageMap:
+	default:
+		return nil, ErrInvalidLetter
+	}
+
+	outputs := entry.info.Rule.HandleAll(obj)
+	var errs ActionErrors
+	for _, output := range outputs {
+		errs = append(errs, e.deliver(entry, letter.Topic, 0, output)...)
+	}
+	if len(errs) > 0 {
+		return outputs, errs
+	}
+	return outputs, nil
+}
@@ -0,0 +1,294 @@
+// Command sqlrules runs, checks, explains and benchmarks sql rules on json inputs.
+//
+//	sqlrules run --sql rule.sql [--pretty] < input.ndjson
+//	sqlrules check rule.sql rules.json ...
+//	sqlrules explain --sql rule.sql [--trace < input.ndjson]
+//	sqlrules bench --sql rule.sql [--duration 1s] < samples.ndjson
+//
+// The exit code is 0 on success, 1 when a rule is invalid or an input fails, and 2 for invalid usage.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	engine "github.com/sdghchj/sql-rules-engine"
+	"github.com/sdghchj/sql-rules-engine/rule"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+var errUsage = errors.New("invalid usage")
+
+const usage = `usage: sqlrules <command> [flags] [files]
+
+commands:
+  run      handles the json values of the standard input by a rule, writing one output per line
+  check    parses and validates the rules of .sql files and .json rule configs
+  explain  prints the plan of a rule, or the trace of every input of the standard input with --trace
+  bench    measures the throughput of a rule on the json values of the standard input
+
+Run 'sqlrules <command> -h' for the flags of a command.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command of args, returning the exit code
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	commands := map[string]func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error{
+		"run":     runRule,
+		"check":   check,
+		"explain": explain,
+		"bench":   bench,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			fmt.Fprint(stdout, usage)
+			return exitOK
+		}
+		fmt.Fprintf(stderr, "sqlrules: unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+
+	err := command(args[1:], stdin, stdout, stderr)
+	if err == flag.ErrHelp {
+		return exitOK
+	} else if err == errUsage {
+		return exitUsage
+	} else if err != nil {
+		fmt.Fprintf(stderr, "sqlrules %s: %v\n", args[0], err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// ruleFlags are the flags of the commands taking a rule
+type ruleFlags struct {
+	sqlFile string
+	query   string
+	pretty  bool
+}
+
+func newFlagSet(name string, stderr io.Writer, rf *ruleFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	if rf != nil {
+		fs.StringVar(&rf.sqlFile, "sql", "", "the `file` of the sql of the rule")
+		fs.StringVar(&rf.query, "query", "", "the `sql` of the rule, instead of --sql")
+		fs.BoolVar(&rf.pretty, "pretty", false, "indent the json outputs")
+	}
+	return fs
+}
+
+// parseFlags parses args by fs, the errors of which are usage errors reported by fs
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return err
+	} else if err != nil {
+		return errUsage
+	}
+	return nil
+}
+
+// parseRule parses the rule of --sql or --query
+func (rf *ruleFlags) parseRule(fs *flag.FlagSet) (rule.Rule, error) {
+	sql := rf.query
+	if (rf.sqlFile == "") == (rf.query == "") {
+		fmt.Fprintf(fs.Output(), "%s: one of --sql and --query is required\n", fs.Name())
+		fs.Usage()
+		return nil, errUsage
+	} else if rf.sqlFile != "" {
+		bin, err := ioutil.ReadFile(rf.sqlFile)
+		if err != nil {
+			return nil, err
+		}
+		sql = string(bin)
+	}
+	return engine.NewJsonEngine(rf.pretty).ParseSql(sql)
+}
+
+func runRule(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	rf := &ruleFlags{}
+	fs := newFlagSet("run", stderr, rf)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	r, err := rf.parseRule(fs)
+	if err != nil {
+		return err
+	}
+	return r.ConvertJsonStream(stdin, stdout)
+}
+
+func check(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("check", stderr, nil)
+	quiet := fs.Bool("quiet", false, "print the invalid files only")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(stderr, "check: no files")
+		return errUsage
+	}
+
+	invalid := 0
+	for _, file := range fs.Args() {
+		errs, err := checkFile(file)
+		if err != nil {
+			return err
+		}
+		if len(errs) == 0 {
+			if !*quiet {
+				fmt.Fprintf(stdout, "%s: ok\n", file)
+			}
+			continue
+		}
+		invalid++
+		for _, e := range errs {
+			fmt.Fprintf(stdout, "%s: %s\n", file, e)
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d files invalid", invalid, fs.NArg())
+	}
+	return nil
+}
+
+// checkFile returns the errors of the rules of a .json config, or of the rule of a sql file
+func checkFile(file string) ([]string, error) {
+	bin, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	isSql := !strings.EqualFold(filepath.Ext(file), ".json")
+	if isSql {
+		if bin, err = json.Marshal(map[string]interface{}{"rules": []interface{}{map[string]string{"sql": string(bin)}}}); err != nil {
+			return nil, err
+		}
+	}
+
+	err = engine.NewJsonEngine(false).CheckConfig(strings.NewReader(string(bin)))
+	errs, ok := err.(engine.ConfigErrors)
+	if !ok {
+		if err != nil {
+			return []string{err.Error()}, nil
+		}
+		return nil, nil
+	}
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		if isSql {
+			msgs[i] = strings.TrimSpace(e.Err.Error())
+		} else {
+			msgs[i] = strings.TrimSpace(e.Error())
+		}
+	}
+	return msgs, nil
+}
+
+func explain(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	rf := &ruleFlags{}
+	fs := newFlagSet("explain", stderr, rf)
+	trace := fs.Bool("trace", false, "print the trace of every json value of the standard input instead")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	r, err := rf.parseRule(fs)
+	if err != nil {
+		return err
+	}
+	if !*trace {
+		fmt.Fprintln(stdout, r.Explain())
+		return nil
+	}
+
+	decoder := json.NewDecoder(stdin)
+	for {
+		var obj interface{}
+		if err = decoder.Decode(&obj); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		node := r.Trace(obj)
+		if rf.pretty {
+			fmt.Fprint(stdout, node)
+			continue
+		}
+		bin, err := json.Marshal(node)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(bin))
+	}
+}
+
+func bench(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	rf := &ruleFlags{}
+	fs := newFlagSet("bench", stderr, rf)
+	duration := fs.Duration("duration", time.Second, "how long to run the rule")
+	count := fs.Int("n", 0, "the number of inputs to handle, instead of --duration")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	r, err := rf.parseRule(fs)
+	if err != nil {
+		return err
+	}
+
+	var samples []string
+	decoder := json.NewDecoder(stdin)
+	for {
+		var raw json.RawMessage
+		if err = decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		samples = append(samples, string(raw))
+	}
+	if len(samples) == 0 {
+		return errors.New("no samples in the standard input")
+	}
+
+	var n, matched, failed int
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for ; *count > 0 && n < *count || *count <= 0 && (n%len(samples) != 0 || time.Now().Before(deadline)); n++ {
+		out, err := r.ConvertJson(samples[n%len(samples)])
+		if err != nil {
+			failed++
+		} else if out != "null" {
+			matched++
+		}
+	}
+	elapsed := time.Since(start)
+
+	fmt.Fprintf(stdout, "inputs:     %d (%d samples)\n", n, len(samples))
+	fmt.Fprintf(stdout, "matched:    %d\n", matched)
+	fmt.Fprintf(stdout, "failed:     %d\n", failed)
+	fmt.Fprintf(stdout, "elapsed:    %v\n", elapsed)
+	if n > 0 && elapsed > 0 {
+		fmt.Fprintf(stdout, "throughput: %.0f inputs/s\n", float64(n)/elapsed.Seconds())
+		fmt.Fprintf(stdout, "latency:    %v/input\n", elapsed/time.Duration(n))
+	}
+	return nil
+}
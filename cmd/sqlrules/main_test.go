@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runArgs(stdin string, args ...string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := run(args, strings.NewReader(stdin), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRun(t *testing.T) {
+	code, out, _ := runArgs(`{"id":1,"name":"a"} {"id":2,"name":"b"}`, "run", "--query", `select id, name from "t" where id > 1`)
+	if code != exitOK || out != `{"id":2,"name":"b"}`+"\n" {
+		t.Error(code, out)
+	}
+
+	if code, _, _ = runArgs(`{"id":1} {`, "run", "--query", `select id from "t"`); code != exitFailed {
+		t.Error(code)
+	}
+	if code, _, _ = runArgs("", "run"); code != exitUsage {
+		t.Error(code)
+	}
+	if code, _, _ = runArgs("", "unknown"); code != exitUsage {
+		t.Error(code)
+	}
+	if code, _, _ = runArgs("", "run", "--unknown"); code != exitUsage {
+		t.Error(code)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlrules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"ok.sql":     `select id from "t" where id > 1`,
+		"bad.sql":    `select a,, from "t"`,
+		"ok.json":    `{"rules":[{"id":"t","sql":"select id from \"t\""}]}`,
+		"bad.json":   `{"rules":[{"id":"t","sql":"select id from \"t\""},{"id":"t","sql":"select id from \"t\""}]}`,
+		"empty.json": `{`,
+	}
+	for name, text := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, out, _ := runArgs("", "check", filepath.Join(dir, "ok.sql"), filepath.Join(dir, "ok.json"))
+	if code != exitOK || strings.Count(out, ": ok\n") != 2 {
+		t.Error(code, out)
+	}
+	for _, name := range []string{"bad.sql", "bad.json", "empty.json"} {
+		code, out, _ = runArgs("", "check", "-quiet", filepath.Join(dir, "ok.sql"), filepath.Join(dir, name))
+		if code != exitFailed || !strings.HasPrefix(out, filepath.Join(dir, name)+": ") || strings.Contains(out, "ok.sql") {
+			t.Error(name, code, out)
+		}
+	}
+	if code, _, _ = runArgs("", "check", filepath.Join(dir, "missing.sql")); code != exitFailed {
+		t.Error(code)
+	}
+	if code, _, _ = runArgs("", "check"); code != exitUsage {
+		t.Error(code)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	code, out, _ := runArgs("", "explain", "--query", `select id from "t" where id > 1`)
+	if code != exitOK || !strings.HasPrefix(out, `RULE "t"`) || !strings.Contains(out, "WHERE id > 1") {
+		t.Error(code, out)
+	}
+
+	code, out, _ = runArgs(`{"id":2} {"id":0}`, "explain", "--trace", "--query", `select id from "t" where id > 1`)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if code != exitOK || len(lines) != 2 || !strings.HasPrefix(lines[0], `{"expr":"RULE \"t\""`) {
+		t.Error(code, out)
+	}
+
+	code, out, _ = runArgs(`{"id":2}`, "explain", "--trace", "--pretty", "--query", `select id from "t" where id > 1`)
+	if code != exitOK || !strings.HasPrefix(out, `RULE "t" = {"id":2}`) {
+		t.Error(code, out)
+	}
+}
+
+func TestBench(t *testing.T) {
+	code, out, _ := runArgs(`{"id":1} {"id":2} {"id":"x"}`, "bench", "-n", "9", "--query", `select cast(id as int) as id from "t" where id != 1`)
+	if code != exitOK || !strings.Contains(out, "inputs:     9 (3 samples)\n") ||
+		!strings.Contains(out, "matched:    6\n") || !strings.Contains(out, "failed:     0\n") {
+		t.Error(code, out)
+	}
+
+	if code, _, _ = runArgs("", "bench", "--query", `select id from "t"`); code != exitFailed {
+		t.Error(code)
+	}
+}
@@ -0,0 +1,376 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/mapper"
+	"github.com/sdghchj/sql-rules-engine/rule"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrorPolicy is what a rule does when one of its actions fails
+type ErrorPolicy string
+
+const (
+	ErrorContinue ErrorPolicy = "continue" // the rest of the actions run, the default
+	ErrorStop     ErrorPolicy = "stop"     // the rest of the actions are skipped
+)
+
+// Config is a declarative document of rules in json, such as
+//
+//	{"rules": [{"id": "alerts", "sql": "select * from \"alerts\" where level > 3", "actions": [{"type": "stdout"}]}]}
+type Config struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+// RuleConfig is a rule of a Config, whose sql may also be an array of lines in the document.
+// Enabled is true when it is missing, and a nil Pretty is the default of the engine.
+type RuleConfig struct {
+	ID          string            `json:"id"`
+	Sql         string            `json:"sql"`
+	Enabled     bool              `json:"enabled"`
+	Pretty      *bool             `json:"pretty"`
+	Description string            `json:"description"`
+	Tags        []string          `json:"tags"`
+	Nulls       mapper.NullPolicy `json:"-"` //"omit" or "emit" in the document
+	OnError     ErrorPolicy       `json:"on_error"`
+	TimeBudget  time.Duration     `json:"-"` //a duration such as "50ms" in the document
+	Actions     []ActionConfig    `json:"actions"`
+}
+
+// ActionConfig is an action of a rule, which runs on every output of it in the order of the actions
+type ActionConfig struct {
+	Type   string                 `json:"type"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// ConfigError is an error at a location of a document, which is a path such as rules[1].actions[0].type,
+// or a line and a column for a syntax error
+type ConfigError struct {
+	Location string
+	Err      error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Location + ": " + e.Err.Error()
+}
+
+// ConfigErrors is every error of a document
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// configDecoder decodes the members of json objects, and collects the errors with their locations
+type configDecoder struct {
+	errs ConfigErrors
+}
+
+func (d *configDecoder) errorf(location string, format string, args ...interface{}) {
+	d.errs = append(d.errs, &ConfigError{Location: location, Err: fmt.Errorf(format, args...)})
+}
+
+// object decodes an object into its members, and reports the members which are not known
+func (d *configDecoder) object(location string, data json.RawMessage, known ...string) map[string]json.RawMessage {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil || members == nil {
+		d.errorf(location, "must be an object")
+		return nil
+	}
+	var unknown []string
+	for key := range members {
+		found := false
+		for _, k := range known {
+			if key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		d.errorf(joinLocation(location, key), "unknown field")
+	}
+	return members
+}
+
+// member decodes the member key of members into v when it exists, and reports whether it exists and is valid
+func (d *configDecoder) member(location string, members map[string]json.RawMessage, key string, v interface{}, kind string) bool {
+	data, ok := members[key]
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil || bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		d.errorf(joinLocation(location, key), "must be %s", kind)
+		return false
+	}
+	return true
+}
+
+func joinLocation(location string, key string) string {
+	if location == "" {
+		return key
+	}
+	return location + "." + key
+}
+
+// lineColumn returns the location of offset in data
+func lineColumn(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	} else if offset < 0 {
+		offset = 0
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	column := offset - int64(bytes.LastIndexByte(data[:offset], '\n'))
+	return fmt.Sprintf("line %d, column %d", line, column)
+}
+
+// ParseConfig reads a document of rules and checks its structure, the sql of the rules is not parsed.
+// The error returned is ConfigErrors holding every error found.
+func ParseConfig(reader io.Reader) (*Config, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var raw json.RawMessage
+	if err = json.Unmarshal(data, &raw); err != nil {
+		location := "document"
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			location = lineColumn(data, syntaxErr.Offset-1) //the offset is after the invalid character
+		}
+		return nil, ConfigErrors{{Location: location, Err: err}}
+	}
+
+	d := &configDecoder{}
+	config := &Config{}
+	members := d.object("document", raw, "rules")
+	var rules []json.RawMessage
+	if members != nil && !d.member("", members, "rules", &rules, "an array") {
+		if _, ok := members["rules"]; !ok {
+			d.errorf("rules", "missing")
+		}
+	}
+	for i, data := range rules {
+		config.Rules = append(config.Rules, d.rule(fmt.Sprintf("rules[%d]", i), data))
+	}
+
+	ids := map[string]int{}
+	for i, rc := range config.Rules {
+		if rc.ID == "" {
+			continue
+		}
+		if j, ok := ids[rc.ID]; ok {
+			d.errorf(fmt.Sprintf("rules[%d].id", i), "duplicate id %q of rules[%d]", rc.ID, j)
+		} else {
+			ids[rc.ID] = i
+		}
+	}
+	if len(d.errs) > 0 {
+		return nil, d.errs
+	}
+	return config, nil
+}
+
+func (d *configDecoder) rule(location string, data json.RawMessage) RuleConfig {
+	rc := RuleConfig{Enabled: true}
+	members := d.object(location, data, "id", "sql", "enabled", "pretty", "description", "tags", "nulls", "on_error", "time_budget", "actions")
+	if members == nil {
+		return rc
+	}
+
+	d.member(location, members, "id", &rc.ID, "a string")
+	if data, ok := members["sql"]; !ok {
+		d.errorf(joinLocation(location, "sql"), "missing")
+	} else {
+		var lines []string
+		if err := json.Unmarshal(data, &lines); err == nil {
+			rc.Sql = strings.Join(lines, "\n")
+		} else if err = json.Unmarshal(data, &rc.Sql); err != nil {
+			d.errorf(joinLocation(location, "sql"), "must be a string or an array of strings")
+		} else if strings.TrimSpace(rc.Sql) == "" {
+			d.errorf(joinLocation(location, "sql"), "empty")
+		}
+	}
+	d.member(location, members, "enabled", &rc.Enabled, "a boolean")
+	var pretty bool
+	if d.member(location, members, "pretty", &pretty, "a boolean") {
+		rc.Pretty = &pretty
+	}
+	d.member(location, members, "description", &rc.Description, "a string")
+	d.member(location, members, "tags", &rc.Tags, "an array of strings")
+
+	var nulls string
+	if d.member(location, members, "nulls", &nulls, "a string") {
+		switch nulls {
+		case "omit":
+			rc.Nulls = mapper.NullOmit
+		case "emit":
+			rc.Nulls = mapper.NullEmit
+		default:
+			d.errorf(joinLocation(location, "nulls"), "must be omit or emit, not %q", nulls)
+		}
+	}
+
+	rc.OnError = ErrorContinue
+	if d.member(location, members, "on_error", &rc.OnError, "a string") {
+		if rc.OnError != ErrorContinue && rc.OnError != ErrorStop {
+			d.errorf(joinLocation(location, "on_error"), "must be continue or stop, not %q", rc.OnError)
+		}
+	}
+
+	var budget string
+	if d.member(location, members, "time_budget", &budget, "a string") {
+		var err error
+		if rc.TimeBudget, err = time.ParseDuration(budget); err != nil || rc.TimeBudget <= 0 {
+			d.errorf(joinLocation(location, "time_budget"), "must be a positive duration, not %q", budget)
+		}
+	}
+
+	var actions []json.RawMessage
+	d.member(location, members, "actions", &actions, "an array")
+	for i, data := range actions {
+		rc.Actions = append(rc.Actions, d.action(fmt.Sprintf("%s.actions[%d]", location, i), data))
+	}
+	return rc
+}
+
+func (d *configDecoder) action(location string, data json.RawMessage) ActionConfig {
+	var ac ActionConfig
+	members := d.object(location, data, "type", "params")
+	if members == nil {
+		return ac
+	}
+	if _, ok := members["type"]; !ok {
+		d.errorf(joinLocation(location, "type"), "missing")
+	} else if d.member(location, members, "type", &ac.Type, "a string") && ac.Type == "" {
+		d.errorf(joinLocation(location, "type"), "empty")
+	}
+	d.member(location, members, "params", &ac.Params, "an object")
+	return ac
+}
+
+// LoadConfig reads a document of rules, and puts all of them when the whole document is valid, or none of them.
+// The error returned for an invalid document is ConfigErrors holding every error found with its location,
+// which also holds the errors of the actions failing to start, in which case the actions started are stopped
+// and no rule is put either.
+// A rule without id gets the table after FROM, and an id must be the table otherwise.
+func (e *jsonEngine) LoadConfig(reader io.Reader) error {
+	config, err := ParseConfig(reader)
+	if err != nil {
+		return err
+	}
+	rules, errs := e.parseConfig(config)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	//every rule is started before any is stored, so that a rule failing to start leaves the rules as they are
+	e.rulesLock.Lock()
+	defer e.rulesLock.Unlock()
+	entries := make([]*ruleEntry, 0, len(config.Rules))
+	for i, rc := range config.Rules {
+		rc := rc
+		entry, err := e.newEntry(rc.ID, rules[i], rc.Sql, func(info *RuleInfo) {
+			info.Enabled = rc.Enabled
+			info.Description = rc.Description
+			info.Tags = append([]string(nil), rc.Tags...)
+			info.OnError = rc.OnError
+			info.Actions = rc.Actions
+		})
+		if err != nil {
+			errs = append(errs, &ConfigError{Location: fmt.Sprintf("rules[%d].actions", i), Err: err})
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(errs) > 0 {
+		for _, entry := range entries {
+			stopActions(entry.actions)
+		}
+		return errs
+	}
+	for _, entry := range entries {
+		e.storeEntry(entry)
+	}
+	return nil
+}
+
+// CheckConfig reads a document of rules, and returns the errors LoadConfig would return for it,
+// without putting the rules or starting their actions
+func (e *jsonEngine) CheckConfig(reader io.Reader) error {
+	config, err := ParseConfig(reader)
+	if err != nil {
+		return err
+	}
+	if _, errs := e.parseConfig(config); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// parseConfig parses the rules of config, and creates their actions to check them.
+// The ids missing of config are set to the tables of the rules.
+func (e *jsonEngine) parseConfig(config *Config) ([]rule.Rule, ConfigErrors) {
+	var errs ConfigErrors
+	rules := make([]rule.Rule, len(config.Rules))
+	for i := range config.Rules {
+		rc := &config.Rules[i]
+		location := fmt.Sprintf("rules[%d]", i)
+		pretty := e.defaultPretty
+		if rc.Pretty != nil {
+			pretty = *rc.Pretty
+		}
+		r, err := e.parseRule(rc.Sql, pretty)
+		if err != nil {
+			errs = append(errs, &ConfigError{Location: location + ".sql", Err: err})
+			continue
+		}
+		if rc.ID == "" {
+			rc.ID = r.Name()
+		} else if rc.ID != r.Name() {
+			errs = append(errs, &ConfigError{Location: location + ".id", Err: fmt.Errorf("%v: %q is not the table %q", ErrRuleIdMismatch, rc.ID, r.Name())})
+			continue
+		}
+		r.SetNullPolicy(rc.Nulls)
+		r.SetTimeBudget(rc.TimeBudget)
+		for j, ac := range rc.Actions {
+			if _, err = e.newAction(ac.Type, ac.Params); err != nil {
+				errs = append(errs, &ConfigError{Location: fmt.Sprintf("%s.actions[%d]", location, j), Err: err})
+			}
+		}
+		for _, call := range r.Actions() {
+			if _, err = e.newCallAction(call); err != nil {
+				errs = append(errs, &ConfigError{Location: location + ".sql", Err: err})
+			}
+		}
+		rules[i] = r
+	}
+
+	//the ids filled in may be the ones of other rules
+	ids := map[string]int{}
+	for i, rc := range config.Rules {
+		if rules[i] == nil {
+			continue
+		}
+		if j, ok := ids[rc.ID]; ok {
+			errs = append(errs, &ConfigError{Location: fmt.Sprintf("rules[%d].id", i), Err: fmt.Errorf("duplicate id %q of rules[%d]", rc.ID, j)})
+		} else {
+			ids[rc.ID] = i
+		}
+	}
+	return rules, errs
+}
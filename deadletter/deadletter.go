@@ -0,0 +1,122 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stage is where a message failed
+type Stage string
+
+const (
+	StageDecode  Stage = "decode"  //the json of an input failed to decode
+	StageFilter  Stage = "filter"  //an expression of the where clause failed
+	StageMap     Stage = "map"     //an expression of the select list, order by or unnest failed
+	StageHandler Stage = "handler" //an async event handler panicked
+	StageAction  Stage = "action"  //an action failed to deliver an output
+)
+
+// Letter is a message which failed at a stage of a rule
+type Letter struct {
+	Time    time.Time   `json:"time"`
+	Rule    string      `json:"rule"` //empty for the json failing to decode for all the rules
+	Stage   Stage       `json:"stage"`
+	Action  string      `json:"action,omitempty"` //the action failing at StageAction
+	Topic   string      `json:"topic,omitempty"`
+	Payload interface{} `json:"payload"` //the json text at StageDecode, the output at StageAction, the input otherwise
+	Error   string      `json:"error"`
+}
+
+// Sink keeps the letters of the messages failed
+type Sink interface {
+	Put(letter *Letter) error
+}
+
+// Memory keeps the latest letters in memory
+type Memory struct {
+	lock    sync.Mutex
+	max     int
+	letters []*Letter //a ring of max once full
+	head    int       //the oldest letter of the ring
+}
+
+// NewMemory keeps max letters at most, dropping the oldest ones, or all of them when max is not positive
+func NewMemory(max int) *Memory {
+	return &Memory{max: max}
+}
+
+func (m *Memory) Put(letter *Letter) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.max <= 0 || len(m.letters) < m.max {
+		m.letters = append(m.letters, letter)
+		return nil
+	}
+	m.letters[m.head] = letter
+	m.head = (m.head + 1) % len(m.letters)
+	return nil
+}
+
+// Letters returns the letters kept from the oldest
+func (m *Memory) Letters() []*Letter {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	letters := make([]*Letter, 0, len(m.letters))
+	letters = append(letters, m.letters[m.head:]...)
+	return append(letters, m.letters[:m.head]...)
+}
+
+// File appends the letters to a file in json, one per line
+type File struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// NewFile opens the file of path to append the letters, which is created when it does not exist
+func NewFile(path string) (*File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &File{file: file}, nil
+}
+
+func (f *File) Put(letter *Letter) error {
+	bin, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, err = f.file.Write(append(bin, '\n'))
+	return err
+}
+
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
+
+// ReadFile reads the letters written by a File from the oldest
+func ReadFile(path string) ([]*Letter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var letters []*Letter
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		letter := &Letter{}
+		if err = decoder.Decode(letter); err != nil {
+			return letters, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
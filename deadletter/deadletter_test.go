@@ -0,0 +1,64 @@
+package deadletter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory(2)
+	for _, rule := range []string{"a", "b", "c"} {
+		m.Put(&Letter{Rule: rule, Stage: StageAction})
+	}
+	letters := m.Letters()
+	if len(letters) != 2 || letters[0].Rule != "b" || letters[1].Rule != "c" {
+		t.Error(letters)
+	}
+
+	m = NewMemory(3)
+	for _, rule := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		m.Put(&Letter{Rule: rule})
+	}
+	letters = m.Letters()
+	if len(letters) != 3 || letters[0].Rule != "e" || letters[1].Rule != "f" || letters[2].Rule != "g" {
+		t.Error(letters)
+	}
+
+	m = NewMemory(0)
+	for i := 0; i < 100; i++ {
+		m.Put(&Letter{})
+	}
+	if len(m.Letters()) != 100 {
+		t.Error(len(m.Letters()))
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "letters.log")
+
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Put(&Letter{Rule: "a", Stage: StageDecode, Payload: `{"a":`, Error: "unexpected EOF"})
+	f.Put(&Letter{Rule: "b", Stage: StageMap, Payload: map[string]interface{}{"v": 1}, Error: "cast"})
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := ReadFile(path)
+	if err != nil || len(letters) != 2 {
+		t.Fatal(letters, err)
+	}
+	if letters[0].Stage != StageDecode || letters[0].Payload != `{"a":` || letters[1].Rule != "b" ||
+		letters[1].Payload.(map[string]interface{})["v"] != 1.0 {
+		t.Error(letters[0], letters[1])
+	}
+}
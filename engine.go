@@ -1,13 +1,24 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"github.com/sdghchj/sql-rules-engine/action"
+	"github.com/sdghchj/sql-rules-engine/deadletter"
+	"github.com/sdghchj/sql-rules-engine/executor"
 	"github.com/sdghchj/sql-rules-engine/function"
 	"github.com/sdghchj/sql-rules-engine/handler"
+	"github.com/sdghchj/sql-rules-engine/metrics"
 	"github.com/sdghchj/sql-rules-engine/rule"
+	"github.com/sdghchj/sql-rules-engine/state"
+	"github.com/sdghchj/sql-rules-engine/store"
+	"io"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Engine interface {
@@ -16,26 +27,65 @@ type Engine interface {
 	ParseSql(sql string) (rule.Rule, error)
 	RegisterRuleFunction(name string, fun func(rule.Rule) func(values []interface{}) interface{}) Engine
 	PutRule(name string, rule rule.Rule) Engine
+	SetRule(name string, rule rule.Rule) error
+	SetStateStore(store state.Store) Engine
 	//Handle(map[string]interface{}) map[string]interface{}
 	HandleAsync(obj interface{})
 	HandleJsonAsync(jsonText string) error
 	ConvertJson(name string, jsonText string) (string, error)
+	HandleAll(name string, obj interface{}) ([]interface{}, error)
+	ConvertJsonContext(ctx context.Context, name string, jsonText string) (string, error)
+	HandleAllContext(ctx context.Context, name string, obj interface{}) ([]interface{}, error)
+	ConvertJsonStream(name string, reader io.Reader, writer io.Writer) error
+	ListRules() []RuleInfo
+	GetRule(id string) (RuleInfo, error)
+	EnableRule(id string) error
+	DisableRule(id string) error
+	DescribeRule(id string, description string, tags ...string) error
+	UpdateRule(id string, sql string) (rule.Rule, error)
+	LoadRules(s store.RuleStore) (map[string]error, error)
+	WatchRules(w store.Watcher, interval time.Duration, onError func(key string, err error)) (stop func())
+	LoadConfig(reader io.Reader) error
+	CheckConfig(reader io.Reader) error
+	RegisterAction(name string, factory action.Factory, argNames ...string) Engine
+	Publish(topic string, obj interface{}) error
+	Close() error
+	SetDeadLetter(sink deadletter.Sink) Engine
+	Replay(letter *deadletter.Letter) ([]interface{}, error)
+	SetExecutor(exec executor.Executor) Engine
+	Shutdown(ctx context.Context) error
+	Metrics() []metrics.Snapshot
+	MetricsHandler() http.Handler
 }
 
 type jsonEngine struct {
 	defaultPretty bool
-	rules         sync.Map //map[string]rule.Rule
-	//	rulesLock     sync.Mutex
-	funcs map[string]func(rule.Rule) func(values []interface{}) interface{}
+	rules         sync.Map     //map[string]*ruleEntry
+	rulesLock     sync.Mutex   //serializes the updates of rules
+	funcsLock     sync.RWMutex //guards funcs, stateStore and executor, which rules are parsed with from any goroutine
+	funcs         map[string]func(rule.Rule) func(values []interface{}) interface{}
+	stateStore    state.Store
+	storeLock     sync.Mutex
+	storeKeys     map[string]string //rule ids by the keys of the rules loaded from stores
+	storeSqls     map[string]string //the last sql of every key loaded from stores, including the ones failing
+	typesLock     sync.RWMutex      //guards actionTypes, which the actions of rules are created by from any goroutine
+	actionTypes   map[string]*actionType
+	deadLetter    atomic.Value //deadLetterSink, read by the error handlers of the rules while they handle messages
+	executor      executor.Executor
+	metrics       sync.Map //map[string]*metrics.Rule by rule id
 }
 
 var ErrNoRuleFound = errors.New("no rule found")
 
 func NewJsonEngine(defaultPretty bool) Engine {
-	return &jsonEngine{defaultPretty: defaultPretty}
+	e := &jsonEngine{defaultPretty: defaultPretty, stateStore: state.NewMemoryStore(state.DefaultTTL)}
+	e.registerBuiltinActions()
+	return e
 }
 
 func (e *jsonEngine) RegisterRuleFunction(name string, fun func(rule.Rule) func(values []interface{}) interface{}) Engine {
+	e.funcsLock.Lock()
+	defer e.funcsLock.Unlock()
 	if e.funcs == nil {
 		e.funcs = make(map[string]func(rule.Rule) func(values []interface{}) interface{})
 	}
@@ -43,61 +93,129 @@ func (e *jsonEngine) RegisterRuleFunction(name string, fun func(rule.Rule) func(
 	return e
 }
 
+// SetStateStore sets the store of stateful functions for the rules parsed afterwards,
+// an in-memory store with state.DefaultTTL is used by default
+func (e *jsonEngine) SetStateStore(store state.Store) Engine {
+	e.funcsLock.Lock()
+	defer e.funcsLock.Unlock()
+	e.stateStore = store
+	return e
+}
+
 func (e *jsonEngine) ParseRuleEvent(name string, match string, handlers ...handler.EventHandler) (rule.Rule, error) {
 	jsonRule := rule.NewJsonRule(e.defaultPretty)
 	err := jsonRule.AddEventHandler(match, handlers...)
 	if err != nil {
 		return nil, err
 	}
-	e.PutRule(name, jsonRule)
+	if err = e.SetRule(name, jsonRule); err != nil {
+		return nil, err
+	}
 	return jsonRule, nil
 }
 
+// SetExecutor runs the async event handlers of the rules parsed afterwards by exec,
+// instead of a goroutine per handler per object
+func (e *jsonEngine) SetExecutor(exec executor.Executor) Engine {
+	e.funcsLock.Lock()
+	defer e.funcsLock.Unlock()
+	e.executor = exec
+	return e
+}
+
+func (e *jsonEngine) getExecutor() executor.Executor {
+	e.funcsLock.RLock()
+	defer e.funcsLock.RUnlock()
+	return e.executor
+}
+
+// Shutdown waits for the async event handlers queued in the executor to finish until ctx is done,
+// and stops the actions of all the rules
+func (e *jsonEngine) Shutdown(ctx context.Context) error {
+	var err error
+	if exec := e.getExecutor(); exec != nil {
+		err = exec.Shutdown(ctx)
+	}
+	e.Close()
+	return err
+}
+
 func (e *jsonEngine) ParseRuleAsyncEvent(name string, match string, asyncHandlers ...handler.AsyncEventHandler) (rule.Rule, error) {
 	jsonRule := rule.NewJsonRule(e.defaultPretty)
+	if exec := e.getExecutor(); exec != nil {
+		jsonRule.SetExecutor(exec)
+	}
 	err := jsonRule.AddEventAsyncHandler(match, asyncHandlers...)
 	if err != nil {
 		return nil, err
 	}
-	e.PutRule(name, jsonRule)
+	if err = e.SetRule(name, jsonRule); err != nil {
+		return nil, err
+	}
 	return jsonRule, nil
 }
 
+// ParseSql parses a rule from sql and puts it with the table after FROM as its id,
+// a rule already put with the id is replaced by it as a new version
 func (e *jsonEngine) ParseSql(sql string) (rule.Rule, error) {
-	jsonRule := rule.NewJsonRule(e.defaultPretty)
+	r, err := e.parseSql(sql)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.putRule(r.Name(), r, sql); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	var ruleFunctions function.Functions
-	if len(e.funcs) > 0 {
-		ruleFunctions = function.NewFunctions()
-		for name, fun := range e.funcs {
-			ruleFunctions.RegisterFunc(name, fun(jsonRule))
-		}
+func (e *jsonEngine) parseSql(sql string) (rule.Rule, error) {
+	return e.parseRule(sql, e.defaultPretty)
+}
+
+func (e *jsonEngine) parseRule(sql string, pretty bool) (rule.Rule, error) {
+	jsonRule := rule.NewJsonRule(pretty)
+
+	e.funcsLock.RLock()
+	ruleFunctions := function.RegisterStatefulFuncs(function.NewFunctions(), e.stateStore, jsonRule.Name)
+	for name, fun := range e.funcs {
+		ruleFunctions.RegisterFunc(name, fun(jsonRule))
 	}
+	e.funcsLock.RUnlock()
 
 	err := jsonRule.AddConvertHandlerBySql(sql, ruleFunctions)
 	if err != nil {
 		return nil, err
 	}
-	e.PutRule(jsonRule.Name(), jsonRule)
 	return jsonRule, nil
 }
 
-func (e *jsonEngine) getRule(name string) (r rule.Rule) {
-	if i, ok := e.rules.Load(name); ok {
-		if r, ok = i.(rule.Rule); ok {
-			return r
-		}
+// getRule returns the enabled rule put with name, or an error
+func (e *jsonEngine) getRule(name string) (rule.Rule, error) {
+	entry := e.getEntry(name)
+	if entry == nil {
+		return nil, ErrNoRuleFound
+	} else if !entry.info.Enabled {
+		return nil, ErrRuleDisabled
 	}
-	return nil
+	return entry.info.Rule, nil
 }
 
+// PutRule puts rule as a new version of the rule name, or removes the rule name when rule is nil.
+// The rule is not put when its actions fail to be created or started, use SetRule to get the error.
 func (e *jsonEngine) PutRule(name string, rule rule.Rule) Engine {
+	_ = e.SetRule(name, rule)
+	return e
+}
+
+// SetRule is PutRule which returns the error of the actions of rule failing to be created or started,
+// in which case the old version of the rule name is kept. A rule can be put with one name only,
+// ErrRuleInUse is returned for another name.
+func (e *jsonEngine) SetRule(name string, rule rule.Rule) error {
 	if rule == nil {
-		e.rules.Delete(name)
-		return e
+		e.removeRule(name)
+		return nil
 	}
-	e.rules.Store(name, rule)
-	return e
+	return e.putRule(name, rule, "")
 }
 
 /*func (e *jsonEngine) Handle(src map[string]interface{}) map[string]interface{}{
@@ -106,8 +224,8 @@ func (e *jsonEngine) PutRule(name string, rule rule.Rule) Engine {
 
 func (e *jsonEngine) HandleAsync(obj interface{}) {
 	e.rules.Range(func(key, value interface{}) bool {
-		if r, ok := value.(rule.Rule); ok {
-			r.HandleAsync(obj)
+		if entry, ok := value.(*ruleEntry); ok && entry.info.Enabled {
+			entry.info.Rule.HandleAsync(obj)
 		}
 		return true
 	})
@@ -120,6 +238,7 @@ func (e *jsonEngine) HandleJsonAsync(jsonText string) error {
 	src := map[string]interface{}{}
 	err := decoder.Decode(&src)
 	if err != nil {
+		e.putDeadLetter(&deadletter.Letter{Stage: deadletter.StageDecode, Payload: jsonText, Error: err.Error()})
 		return err
 	}
 	e.HandleAsync(src)
@@ -127,8 +246,43 @@ func (e *jsonEngine) HandleJsonAsync(jsonText string) error {
 }
 
 func (e *jsonEngine) ConvertJson(name string, jsonText string) (string, error) {
-	if rule := e.getRule(name); rule != nil {
-		return rule.ConvertJson(jsonText)
+	rule, err := e.getRule(name)
+	if err != nil {
+		return "", err
+	}
+	return rule.ConvertJson(jsonText)
+}
+
+func (e *jsonEngine) HandleAll(name string, obj interface{}) ([]interface{}, error) {
+	rule, err := e.getRule(name)
+	if err != nil {
+		return nil, err
+	}
+	return rule.HandleAll(obj), nil
+}
+
+// ConvertJsonContext is ConvertJson which returns the error of ctx once ctx is done or the time budget of the rule runs out
+func (e *jsonEngine) ConvertJsonContext(ctx context.Context, name string, jsonText string) (string, error) {
+	rule, err := e.getRule(name)
+	if err != nil {
+		return "", err
+	}
+	return rule.ConvertJsonContext(ctx, jsonText)
+}
+
+// HandleAllContext is HandleAll which returns the error of ctx once ctx is done or the time budget of the rule runs out
+func (e *jsonEngine) HandleAllContext(ctx context.Context, name string, obj interface{}) ([]interface{}, error) {
+	rule, err := e.getRule(name)
+	if err != nil {
+		return nil, err
+	}
+	return rule.HandleAllContext(ctx, obj)
+}
+
+func (e *jsonEngine) ConvertJsonStream(name string, reader io.Reader, writer io.Writer) error {
+	rule, err := e.getRule(name)
+	if err != nil {
+		return err
 	}
-	return "", ErrNoRuleFound
+	return rule.ConvertJsonStream(reader, writer)
 }
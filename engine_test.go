@@ -1,10 +1,26 @@
 package engine
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/sdghchj/sql-rules-engine/action"
+	"github.com/sdghchj/sql-rules-engine/deadletter"
+	"github.com/sdghchj/sql-rules-engine/executor"
 	"github.com/sdghchj/sql-rules-engine/filter"
 	"github.com/sdghchj/sql-rules-engine/mapper"
 	"github.com/sdghchj/sql-rules-engine/rule"
+	"github.com/sdghchj/sql-rules-engine/state"
+	"github.com/sdghchj/sql-rules-engine/store"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -314,3 +330,1548 @@ func TestJsonRule(t *testing.T) {
 	}
 	fmt.Println(string(jsonText))
 }
+
+func TestJsonEngineCast(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql(`select cast(a as int) as a,
+								CAST(b AS string) AS b,
+								try_cast(c as int) as c,
+								coalesce(try_cast(c as int), 0) as d,
+								cast(cast(a as string) as float) as e,
+								typeof(c) as f
+							from "cast"
+							where cast(b as int) = 2`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	jsonText, err := eng.ConvertJson("cast", `{"a":1.5,"b":2,"c":"x"}`)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"a":1,"b":"2","d":0,"e":1.5,"f":"string"}` {
+		t.Error(jsonText)
+	}
+
+	if _, err = eng.ParseSql(`select cast(a as 1) as a from "cast2"`); err == nil {
+		t.Error("cast without type")
+	}
+}
+
+func TestJsonEngineRegex(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql(`select regex_extract(msg, 'temp=(\d+)', 1) as temp, regex_replace(msg, '\s+', "_") as msg from "regex" where regex(msg, '^dev')`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	jsonText, err := eng.ConvertJson("regex", `{"msg":"dev 1 temp=25"}`)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"temp":"25","msg":"dev_1_temp=25"}` {
+		t.Error(jsonText)
+	}
+
+	_, err = eng.ParseSql(`select a from "bad" where regex(a, '(')`)
+	if err == nil {
+		t.Error("want error for invalid literal pattern")
+	}
+}
+
+func TestJsonEngineStatefulFunctions(t *testing.T) {
+	eng := NewJsonEngine(false).SetStateStore(state.NewMemoryStore(time.Minute))
+
+	_, err := eng.ParseSql(`select id,
+								lag(v, id) as lag,
+								delta(v, id) as delta,
+								rate(v, ts, id) as rate,
+								changed(v, id) as changed,
+								first_seen(id) as first
+							from "stateful"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	inputs := []string{
+		`{"id":"a","v":1,"ts":10}`,
+		`{"id":"b","v":5,"ts":10}`,
+		`{"id":"a","v":4,"ts":12}`,
+		`{"id":"a","v":4,"ts":13}`,
+	}
+	wants := []string{
+		`{"id":"a","changed":false,"first":true}`,
+		`{"id":"b","changed":false,"first":true}`,
+		`{"id":"a","lag":1,"delta":3,"rate":1.5,"changed":true,"first":false}`,
+		`{"id":"a","lag":4,"delta":0,"rate":0,"changed":false,"first":false}`,
+	}
+	for i, input := range inputs {
+		jsonText, err := eng.ConvertJson("stateful", input)
+		if err != nil {
+			t.Error(err)
+		}
+		if jsonText != wants[i] {
+			t.Error(jsonText)
+		}
+	}
+
+	//identical calls keep their own states
+	_, err = eng.ParseSql(`select delta(v) as d, changed(v) as c from "sites" where changed(v)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs = []string{`{"v":1}`, `{"v":2}`, `{"v":2}`, `{"v":5}`}
+	wants = []string{`null`, `{"c":false}`, `null`, `{"d":3,"c":true}`}
+	for i, input := range inputs {
+		if jsonText, err := eng.ConvertJson("sites", input); err != nil || jsonText != wants[i] {
+			t.Error(i, jsonText, err)
+		}
+	}
+}
+
+func TestJsonEngineConcurrentParse(t *testing.T) {
+	eng := NewJsonEngine(false)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := eng.ParseSql(fmt.Sprintf(`select delta(v) as d from "concurrent/%d"`, i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			eng.SetStateStore(state.NewMemoryStore(time.Minute))
+			eng.RegisterRuleFunction("name", func(r rule.Rule) func([]interface{}) interface{} {
+				return func([]interface{}) interface{} {
+					return r.Name()
+				}
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+func TestJsonEngineConcurrentConvert(t *testing.T) {
+	eng := NewJsonEngine(false)
+	if _, err := eng.ParseSql(`select b, a, c.d as c from "convert"`); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			jsonText, err := eng.ConvertJson("convert", fmt.Sprintf(`{"a":%d,"b":2,"c":{"d":3}}`, i))
+			if err != nil {
+				t.Error(err)
+			} else if want := fmt.Sprintf(`{"b":2,"a":%d,"c":3}`, i); jsonText != want {
+				t.Error(jsonText)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+}
+
+func TestJsonEngineOrderByLimit(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql(`select name, v * 10 as score from "rows"
+							where v > 1
+							order by score desc nulls last, name
+							limit 3 offset 1`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	text := `[{"name":"a","v":3},{"name":"b","v":5},{"name":"c","v":1},{"name":"d","v":3},{"name":"e","v":2},{"name":"f"}]`
+	jsonText, err := eng.ConvertJson("rows", text)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `[{"name":"a","score":30},{"name":"d","score":30},{"name":"e","score":20}]` {
+		t.Error(jsonText)
+	}
+
+	_, err = eng.ParseSql(`select * from "limit" order by v nulls first limit 2`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	jsonText, err = eng.ConvertJson("limit", text)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `[{"name":"f"},{"name":"c","v":1}]` {
+		t.Error(jsonText)
+	}
+
+	_, err = eng.ParseSql(`select * from "bad" order by v limit`)
+	if err == nil {
+		t.Error("want error")
+	}
+
+	//the orders refer to the output rows, so a key not selected or the source of an alias is rejected
+	if _, err = eng.ParseSql(`select name from "bad" order by v`); err == nil || !strings.Contains(err.Error(), rule.ErrOrderNotSelected.Error()) {
+		t.Error(err)
+	}
+	if _, err = eng.ParseSql(`select name, v * 10 as score from "bad" order by abs(v) desc`); err == nil || !strings.Contains(err.Error(), `"v"`) {
+		t.Error(err)
+	}
+	if _, err = eng.ParseSql(`select name, v as score, * except (name) from "star" order by v, root['name']`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJsonEngineUnnest(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql(`select gateway, r.id as id, r.v as v
+							from "gateway", unnest(payload.readings) as r
+							where r.v > 1`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	text := `{"gateway":"g1","payload":{"readings":[{"id":"a","v":1},{"id":"b","v":2},{"id":"c","v":3}]}}`
+	var obj interface{}
+	_ = json.Unmarshal([]byte(text), &obj)
+	results, err := eng.HandleAll("gateway", obj)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(results) != 2 {
+		t.Error(results)
+	}
+
+	var buf bytes.Buffer
+	err = eng.ConvertJsonStream("gateway", strings.NewReader(text+"\n"+`{"gateway":"g2","payload":{}}`+text), &buf)
+	if err != nil {
+		t.Error(err)
+	}
+	want := `{"gateway":"g1","id":"b","v":2}
+{"gateway":"g1","id":"c","v":3}
+{"gateway":"g1","id":"b","v":2}
+{"gateway":"g1","id":"c","v":3}
+`
+	if buf.String() != want {
+		t.Error(buf.String())
+	}
+
+	_, err = eng.ParseSql(`select r from "bad", unnest(a) where r > 1`)
+	if err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestJsonEngineArrayTargets(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql(`select id as out.items[0].id,
+								readings[*].v as out.values[*].v,
+								readings[*].id as out.values[*].id,
+								'x' as out.tags[],
+								'y' as out.tags[]
+							from "array"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	jsonText, err := eng.ConvertJson("array", `{"id":"g","readings":[{"id":"a","v":1},{"id":"b","v":2}]}`)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"out":{"items":[{"id":"g"}],"values":[{"v":1,"id":"a"},{"v":2,"id":"b"}],"tags":["x","y"]}}` {
+		t.Error(jsonText)
+	}
+}
+
+func TestJsonEngineStarExceptReplace(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql(`select 'v2' as version,
+								user.id as user,
+								* except (password, auth.token) replace (upper(name) as name, cast(age as string) as age),
+								1 as auth.level
+							from "star"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	text := `{"name":"bob","age":30,"password":"x","auth":{"token":"t","scheme":"basic"},"user":{"id":1}}`
+	jsonText, err := eng.ConvertJson("star", text)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"version":"v2","user":1,"age":"30","name":"BOB","auth":{"level":1,"scheme":"basic"}}` {
+		t.Error(jsonText)
+	}
+
+	//projections are merged into the object of *, whatever their order
+	_, err = eng.ParseSql(`select auth as user, * from "merge"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	jsonText, err = eng.ConvertJson("merge", text)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"user":{"id":1,"scheme":"basic","token":"t"},"age":30,"auth":{"scheme":"basic","token":"t"},"name":"bob","password":"x"}` {
+		t.Error(jsonText)
+	}
+
+	//the objects of fields are copied before the other fields are written into them
+	_, err = eng.ParseSql(`select auth as a, 1 as a.level, * from "copy"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	auth := map[string]interface{}{"scheme": "basic"}
+	ret, err := eng.HandleAll("copy", map[string]interface{}{"auth": auth})
+	if err != nil || len(auth) != 1 || len(ret) != 1 || ret[0].(map[string]interface{})["a"].(map[string]interface{})["level"] == nil {
+		t.Error(auth, ret)
+	}
+
+	_, err = eng.ParseSql(`select * except (a) replace (b) from "bad"`)
+	if err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestJsonEngineNullHandling(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql(`select id, a.b as x default 0, a.c as y default 'none', a.d as z default null,
+								a.e as w default -1.5, a.f default true, a.g as v
+							from "nulls"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	text := `{"id":1,"a":{}}`
+	jsonText, err := eng.ConvertJson("nulls", text)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"id":1,"x":0,"y":"none","z":null,"w":-1.5,"a":{"f":true}}` {
+		t.Error(jsonText)
+	}
+
+	r, err := eng.ParseSql(`select id, a.g as v, a.b as x default 0 from "emit"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	r.SetNullPolicy(mapper.NullEmit)
+	jsonText, err = eng.ConvertJson("emit", `{"id":1,"a":{"b":2}}`)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"id":1,"v":null,"x":2}` {
+		t.Error(jsonText)
+	}
+
+	_, err = eng.ParseSql(`select a.b as x default from "bad"`)
+	if err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestJsonEngineTemplate(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql("select `Device ${device.id} at ${round(temp,1)}°C, $${cost} ${price:%.2f} ${n:%03d}${missing}` as msg," +
+		"template('${id}/${tags[1]}', device) as path, " +
+		"upper(`id-${device.id}`) as code " +
+		"from \"tpl\" where `${device.id}` = \"d1\"")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	text := `{"device":{"id":"d1","tags":["a","b"]},"temp":21.46,"price":3,"n":7}`
+	jsonText, err := eng.ConvertJson("tpl", text)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"msg":"Device d1 at 21.5°C, ${cost} 3.00 007","path":"d1/b","code":"ID-D1"}` {
+		t.Error(jsonText)
+	}
+
+	_, err = eng.ParseSql("select `${a` as x from \"bad\"")
+	if err == nil {
+		t.Error("want error")
+	}
+	_, err = eng.ParseSql("select `${a +}` as x from \"bad\"")
+	if err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestJsonEngineFlatten(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql(`select flatten(*, '_'), ts as meta.ts from "flat"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	text := `{"a":{"b":1,"c":[2,3]},"ts":9}`
+	jsonText, err := eng.ConvertJson("flat", text)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"a_b":1,"a_c[0]":2,"a_c[1]":3,"ts":9,"meta":{"ts":9}}` {
+		t.Error(jsonText)
+	}
+
+	_, err = eng.ParseSql(`select unflatten(*) as out from "unflat"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	jsonText, err = eng.ConvertJson("unflat", `{"a.b":1,"a.c[1]":3,"a.c[0]":2}`)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"out":{"a":{"b":1,"c":[2,3]}}}` {
+		t.Error(jsonText)
+	}
+
+	_, err = eng.ParseSql(`select flatten(*, '_', 2, 'other') from "bad"`)
+	if err == nil {
+		t.Error("want error")
+	}
+}
+
+type testReading struct {
+	Sensor string  `json:"sensor"`
+	Value  float64 `json:"value"`
+}
+
+type testMessage struct {
+	Device   string         `json:"device"`
+	Readings []testReading  `json:"readings"`
+	Meta     map[string]int `json:"meta,omitempty"`
+}
+
+func TestJsonEngineStructInput(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	r, err := eng.ParseSql(`select device as id, readings[1].value as last, max(readings.value) as peak, * except (meta)
+							from "structs" where device = 'd1' and meta.level > 1`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	msg := &testMessage{Device: "d1", Readings: []testReading{{"t", 1.5}, {"h", 2.5}}, Meta: map[string]int{"level": 2}}
+	bin, err := json.Marshal(r.Handle(msg))
+	if err != nil {
+		t.Error(err)
+	}
+	if string(bin) != `{"device":"d1","id":"d1","last":2.5,"peak":2.5,"readings":[{"sensor":"t","value":1.5},{"sensor":"h","value":2.5}]}` {
+		t.Error(string(bin))
+	}
+
+	msg.Meta = nil
+	if ret := r.Handle(msg); ret != nil {
+		t.Error(ret)
+	}
+}
+
+func TestJsonEngineQuotedKeys(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql("select `content-type` as headers.`content-type`, root['@timestamp'] as ts, " +
+		"meta.`1st` as meta[\"1st\"], upper(meta['x-y']) as \"x y\", héllo as `é`, " +
+		"* except (`content-type`, meta.`x-y`) " +
+		"from \"quoted\" where root.`content-type` = 'json' and meta.`1st` > 0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	text := `{"content-type":"json","@timestamp":5,"meta":{"1st":1,"x-y":"v"},"héllo":"w"}`
+	jsonText, err := eng.ConvertJson("quoted", text)
+	if err != nil {
+		t.Error(err)
+	}
+	if jsonText != `{"headers":{"content-type":"json"},"ts":5,"meta":{"1st":1},"x y":"V","é":"w","@timestamp":5,"héllo":"w"}` {
+		t.Error(jsonText)
+	}
+
+	//a backtick text is a key in the where clause and in the arguments of functions as well
+	_, err = eng.ParseSql("select upper(`content-type`) as t, upper(meta[`x-y`]) as m, ifnull(`@timestamp`, 0) as ts " +
+		"from \"quoted2\" where `content-type` = 'json'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonText, err = eng.ConvertJson("quoted2", text); err != nil || jsonText != `{"t":"JSON","m":"V","ts":5}` {
+		t.Error(jsonText, err)
+	}
+	if jsonText, err = eng.ConvertJson("quoted2", `{"content-type":"xml"}`); err != nil || jsonText != "null" {
+		t.Error(jsonText, err)
+	}
+}
+
+func TestJsonEngineRuleLifecycle(t *testing.T) {
+	eng := NewJsonEngine(false)
+
+	_, err := eng.ParseSql(`select a from "life"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = eng.ParseSql(`select b from "another"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = eng.DescribeRule("life", "keeps a", "ops", "test"); err != nil {
+		t.Error(err)
+	}
+
+	infos := eng.ListRules()
+	if len(infos) != 2 || infos[0].ID != "another" || infos[1].ID != "life" {
+		t.Error(infos)
+		return
+	}
+	info := infos[1]
+	if info.Version != 1 || info.Sql != `select a from "life"` || !info.Enabled || info.Description != "keeps a" || len(info.Tags) != 2 {
+		t.Error(info)
+	}
+
+	if err = eng.DisableRule("life"); err != nil {
+		t.Error(err)
+	}
+	if _, err = eng.ConvertJson("life", `{"a":1}`); err != ErrRuleDisabled {
+		t.Error(err)
+	}
+	if err = eng.EnableRule("life"); err != nil {
+		t.Error(err)
+	}
+
+	r, _ := eng.GetRule("life")
+	old := r.Rule
+	if _, err = eng.UpdateRule("life", `select a + 1 as a from "life"`); err != nil {
+		t.Error(err)
+	}
+	if _, err = eng.UpdateRule("life", `select a from "other"`); err != ErrRuleIdMismatch {
+		t.Error(err)
+	}
+	if _, err = eng.UpdateRule("life", `select a from`); err == nil {
+		t.Error("want error")
+	}
+	if _, err = eng.UpdateRule("missing", `select a from "missing"`); err != ErrNoRuleFound {
+		t.Error(err)
+	}
+
+	info, err = eng.GetRule("life")
+	if err != nil || info.Version != 2 || info.Description != "keeps a" || info.Created.After(info.Updated) {
+		t.Error(info, err)
+	}
+	jsonText, err := eng.ConvertJson("life", `{"a":1}`)
+	if err != nil || jsonText != `{"a":2}` {
+		t.Error(jsonText, err)
+	}
+	//the old version still works for the messages which started with it
+	if jsonText, err = old.ConvertJson(`{"a":1}`); err != nil || jsonText != `{"a":1}` {
+		t.Error(jsonText, err)
+	}
+
+	eng.PutRule("life", nil)
+	if _, err = eng.GetRule("life"); err != ErrNoRuleFound {
+		t.Error(err)
+	}
+}
+
+func TestJsonEngineRuleStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := store.NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a", `select a from "ta"`)
+	s.Put("bad", `select a from`)
+	s.Put("dup", `select c from "ta"`)
+
+	eng := NewJsonEngine(false)
+	errs, err := eng.LoadRules(s)
+	if err != nil || len(errs) != 2 || errs["bad"] == nil || errs["dup"] == nil || !strings.Contains(errs["dup"].Error(), ErrRuleKeyConflict.Error()) {
+		t.Error(errs, err)
+	}
+	if jsonText, err := eng.ConvertJson("ta", `{"a":1,"b":2}`); err != nil || jsonText != `{"a":1}` {
+		t.Error(jsonText, err)
+	}
+
+	//a rule added after LoadRules and before WatchRules is not missed
+	s.Put("c", `select c from "tc"`)
+	reported := make(chan string, 10)
+	stop := eng.WatchRules(s, 10*time.Millisecond, func(key string, err error) {
+		reported <- key
+	})
+	defer stop()
+
+	//the rule of a key is not removed with another key of the same id,
+	//an invalid edit is reported, and the last good version keeps running
+	s.Delete("dup")
+	s.Put("a", `select b from`)
+	select {
+	case key := <-reported:
+		if key != "a" {
+			t.Error(key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no error reported")
+	}
+	if jsonText, err := eng.ConvertJson("ta", `{"a":1,"b":2}`); err != nil || jsonText != `{"a":1}` {
+		t.Error(jsonText, err)
+	}
+
+	s.Put("a", `select b from "ta"`)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if info, err := eng.GetRule("ta"); err == nil && info.Version == 2 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal(info, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if jsonText, err := eng.ConvertJson("ta", `{"a":1,"b":2}`); err != nil || jsonText != `{"b":2}` {
+		t.Error(jsonText, err)
+	}
+	if info, err := eng.GetRule("tc"); err != nil || info.Version != 1 {
+		t.Error(info, err)
+	}
+
+	s.Delete("a")
+	deadline = time.Now().Add(time.Second)
+	for {
+		if _, err := eng.GetRule("ta"); err == ErrNoRuleFound {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJsonEngineLoadConfig(t *testing.T) {
+	eng := NewJsonEngine(false)
+	err := eng.LoadConfig(strings.NewReader(`{"rules": [
+		{"id": "alerts", "sql": ["select a, b", "from \"alerts\""], "nulls": "emit", "pretty": false, "tags": ["ops"],
+		 "on_error": "stop", "actions": [{"type": "stdout"}, {"type": "webhook", "params": {"url": "http://localhost/alerts"}}]},
+		{"sql": "select a from \"metrics\"", "enabled": false}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := eng.GetRule("alerts")
+	if err != nil || info.OnError != ErrorStop || len(info.Actions) != 2 || info.Actions[1].Type != "webhook" ||
+		info.Actions[1].Params["url"] != "http://localhost/alerts" || len(info.Tags) != 1 || info.Sql != "select a, b\nfrom \"alerts\"" {
+		t.Error(info, err)
+	}
+	if jsonText, err := eng.ConvertJson("alerts", `{"a":1}`); err != nil || jsonText != `{"a":1,"b":null}` {
+		t.Error(jsonText, err)
+	}
+	if _, err = eng.ConvertJson("metrics", `{"a":1}`); err != ErrRuleDisabled {
+		t.Error(err)
+	}
+
+	//every error is reported with its location, and no rule is put
+	err = eng.LoadConfig(strings.NewReader(`{"rules": [
+		{"id": "x", "sql": "select a from \"y\""},
+		{"sql": 1, "enabled": "yes", "color": "red"},
+		{"sql": "select a from \"z\"", "on_error": "retry", "actions": [{"params": {}}]},
+		{"sql": "select a from"}
+	]}`))
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatal(err)
+	}
+	var locations []string
+	for _, e := range errs {
+		locations = append(locations, e.Location)
+	}
+	if strings.Join(locations, ",") != "rules[1].color,rules[1].sql,rules[1].enabled,rules[2].on_error,rules[2].actions[0].type" {
+		t.Error(errs)
+	}
+	err = eng.LoadConfig(strings.NewReader(`{"rules": [
+		{"id": "x", "sql": "select a from \"y\""},
+		{"sql": "select a from"}
+	]}`))
+	if errs, ok = err.(ConfigErrors); !ok || len(errs) != 2 || errs[0].Location != "rules[0].id" || errs[1].Location != "rules[1].sql" {
+		t.Error(err)
+	}
+	if _, err = eng.GetRule("y"); err != ErrNoRuleFound {
+		t.Error(err)
+	}
+
+	err = eng.LoadConfig(strings.NewReader("{\"rules\": [\n{\"sql\": }]}"))
+	if errs, ok = err.(ConfigErrors); !ok || errs[0].Location != "line 2, column 9" {
+		t.Error(err)
+	}
+
+	//the ids filled in are checked for duplicates as well
+	err = eng.LoadConfig(strings.NewReader(`{"rules": [
+		{"sql": "select a from \"y\""},
+		{"id": "y", "sql": "select b from \"y\""},
+		{"sql": "select c from \"y\""}
+	]}`))
+	if errs, ok = err.(ConfigErrors); !ok || len(errs) != 2 || errs[0].Location != "rules[1].id" || errs[1].Location != "rules[2].id" {
+		t.Error(err)
+	}
+	if _, err = eng.GetRule("y"); err != ErrNoRuleFound {
+		t.Error(err)
+	}
+}
+
+func TestJsonEngineLoadConfigAtomic(t *testing.T) {
+	eng := NewJsonEngine(false)
+	var started []*startAction
+	eng.RegisterAction("flaky", func(params action.Params) (action.Action, error) {
+		a := &startAction{}
+		if params["fail"] == true {
+			a.err = errors.New("unavailable")
+		}
+		started = append(started, a)
+		return a, nil
+	})
+	if err := eng.LoadConfig(strings.NewReader(`{"rules": [{"sql": "select a from \"a\""}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	//a rule failing to start its actions leaves every rule as it is, and the actions started are stopped
+	err := eng.LoadConfig(strings.NewReader(`{"rules": [
+		{"sql": "select b from \"a\"", "actions": [{"type": "flaky"}]},
+		{"sql": "select b from \"b\"", "actions": [{"type": "flaky", "params": {"fail": true}}]}
+	]}`))
+	if errs, ok := err.(ConfigErrors); !ok || len(errs) != 1 || errs[0].Location != "rules[1].actions" {
+		t.Error(err)
+	}
+	if info, err := eng.GetRule("a"); err != nil || info.Version != 1 || info.Sql != `select a from "a"` {
+		t.Error(info, err)
+	}
+	if _, err = eng.GetRule("b"); err != ErrNoRuleFound {
+		t.Error(err)
+	}
+	if jsonText, err := eng.ConvertJson("a", `{"a":1,"b":2}`); err != nil || jsonText != `{"a":1}` {
+		t.Error(jsonText, err)
+	}
+	if len(started) < 3 || !started[len(started)-2].stopped {
+		t.Error(started)
+	}
+}
+
+type startAction struct {
+	err     error
+	stopped bool
+}
+
+func (a *startAction) Start() error {
+	return a.err
+}
+
+func (a *startAction) Stop() error {
+	a.stopped = true
+	return nil
+}
+
+func (a *startAction) Do(msg *action.Message) error {
+	return nil
+}
+
+func TestJsonEngineSetRule(t *testing.T) {
+	eng := NewJsonEngine(false)
+	var startErr error
+	eng.RegisterAction("flaky", func(params action.Params) (action.Action, error) {
+		return &startAction{err: startErr}, nil
+	})
+	if err := eng.LoadConfig(strings.NewReader(`{"rules": [{"id": "set", "sql": "select a from \"set\"", "actions": [{"type": "flaky"}]}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	//the actions of the config fail to start for the new versions, which are not put
+	startErr = errors.New("unavailable")
+	r := rule.NewJsonRule(false)
+	if err := r.AddConvertHandlerBySql(`select b from "set"`, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.SetRule("set", r); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Error(err)
+	}
+	if _, err := eng.ParseRuleEvent("set", "a > 0", func(obj interface{}) interface{} { return obj }); err == nil {
+		t.Error("want error")
+	}
+	if _, err := eng.ParseRuleAsyncEvent("set", "a > 0", func(obj interface{}) {}); err == nil {
+		t.Error("want error")
+	}
+	if info, err := eng.GetRule("set"); err != nil || info.Version != 1 {
+		t.Error(info, err)
+	}
+
+	startErr = nil
+	if err := eng.SetRule("set", r); err != nil {
+		t.Error(err)
+	}
+
+	//a live rule is not reconfigured by putting it again, nor put with another name
+	var wg sync.WaitGroup
+	started, stop := make(chan struct{}), make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		close(started)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				eng.ConvertJson("set", `{"b":1}`)
+			}
+		}
+	}()
+	<-started
+	for i := 0; i < 10; i++ {
+		if err := eng.SetRule("set", r); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if info, err := eng.GetRule("set"); err != nil || info.Version != 12 {
+		t.Error(info.Version, err)
+	}
+	if err := eng.SetRule("set2", r); err != ErrRuleInUse {
+		t.Error(err)
+	}
+
+	if err := eng.SetRule("set", nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := eng.GetRule("set"); err != ErrNoRuleFound {
+		t.Error(err)
+	}
+}
+
+func TestJsonEngineUpdateRemoved(t *testing.T) {
+	eng := NewJsonEngine(false)
+	for i := 0; i < 200; i++ {
+		if _, err := eng.ParseSql(`select a from "updated"`); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			eng.UpdateRule("updated", `select a, b from "updated"`)
+		}()
+		go func() {
+			defer wg.Done()
+			eng.PutRule("updated", nil)
+		}()
+		wg.Wait()
+		//an update either fails after the removal or is removed by it
+		if info, err := eng.GetRule("updated"); err != ErrNoRuleFound {
+			t.Fatal(info.Sql, err)
+		}
+	}
+}
+
+// gateAction blocks every message until gate is closed, and fails the messages once it is stopped
+type gateAction struct {
+	lock    sync.Mutex
+	stopped bool
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (a *gateAction) Start() error {
+	return nil
+}
+
+func (a *gateAction) Stop() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.stopped = true
+	return nil
+}
+
+func (a *gateAction) isStopped() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.stopped
+}
+
+func (a *gateAction) Do(msg *action.Message) error {
+	a.entered <- struct{}{}
+	<-a.gate
+	if a.isStopped() {
+		return action.ErrStopped
+	}
+	return nil
+}
+
+func TestJsonEngineInflightUpdate(t *testing.T) {
+	eng := NewJsonEngine(false)
+	var gates []*gateAction
+	eng.RegisterAction("gate", func(params action.Params) (action.Action, error) {
+		a := &gateAction{entered: make(chan struct{}, 1), gate: make(chan struct{})}
+		gates = append(gates, a)
+		return a, nil
+	})
+	if _, err := eng.ParseSql(`select a from "inflight" do gate()`); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- eng.Publish("inflight", map[string]interface{}{"a": 1})
+	}()
+	<-gates[0].entered
+
+	//the message being delivered finishes on the old version, whose actions are stopped after it
+	if _, err := eng.UpdateRule("inflight", `select a, 1 as b from "inflight" do gate()`); err != nil {
+		t.Fatal(err)
+	}
+	if gates[0].isStopped() {
+		t.Error("stopped while delivering")
+	}
+	close(gates[0].gate)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if !gates[0].isStopped() {
+		t.Error("old version not stopped")
+	}
+	if gates[1].isStopped() {
+		t.Error("new version stopped")
+	}
+
+	//a rule removed without messages being delivered is stopped at once
+	eng.PutRule("inflight", nil)
+	if !gates[1].isStopped() {
+		t.Error("removed version not stopped")
+	}
+}
+
+func TestJsonEngineRepublishLoop(t *testing.T) {
+	eng := NewJsonEngine(false)
+	sink := deadletter.NewMemory(0)
+	eng.SetDeadLetter(sink)
+	err := eng.LoadConfig(strings.NewReader(`{"rules": [{"id": "a/+", "sql": "select * from \"a/+\" do republish('a/x')"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+
+	if err = eng.Publish("a/b", map[string]interface{}{"v": 1}); err == nil {
+		t.Fatal("republished forever")
+	}
+	letters := sink.Letters()
+	if len(letters) == 0 {
+		t.Fatal(letters)
+	}
+	first := letters[0]
+	if first.Rule != "a/+" || first.Stage != deadletter.StageAction || first.Action != "republish" ||
+		first.Topic != "a/x" || first.Error != action.ErrTooManyHops.Error() {
+		t.Error(first)
+	}
+}
+
+func TestJsonEngineCheckConfig(t *testing.T) {
+	eng := NewJsonEngine(false)
+	err := eng.CheckConfig(strings.NewReader(`{"rules": [{"id": "alerts", "sql": "select a from \"alerts\"", "actions": [{"type": "stdout"}]}]}`))
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = eng.GetRule("alerts"); err != ErrNoRuleFound {
+		t.Error(err)
+	}
+
+	err = eng.CheckConfig(strings.NewReader(`{"rules": [{"sql": "select a from \"y\"", "actions": [{"type": "unknown"}]}, {"sql": "select a from"}]}`))
+	if errs, ok := err.(ConfigErrors); !ok || len(errs) != 2 || errs[0].Location != "rules[0].actions[0]" || errs[1].Location != "rules[1].sql" {
+		t.Error(err)
+	}
+}
+
+func TestJsonEngineActions(t *testing.T) {
+	eng := NewJsonEngine(false)
+	ch := make(chan *action.Message, 10)
+	eng.RegisterAction("collect", func(params action.Params) (action.Action, error) {
+		return action.NewChannel(ch), nil
+	})
+	fails := 0
+	eng.RegisterAction("fail", func(params action.Params) (action.Action, error) {
+		return action.NewRepublish("", func(topic string, payload interface{}) error {
+			fails++
+			return errors.New("failed")
+		})
+	})
+
+	if _, err := eng.ParseSql(`select a from "t" do unknown()`); err == nil {
+		t.Error("unknown action")
+	}
+	if _, err := eng.ParseSql(`select a from "t" do file()`); err == nil {
+		t.Error("missing param")
+	}
+	if _, err := eng.ParseSql(`select a from "t" do collect(1)`); err == nil {
+		t.Error("too many arguments")
+	}
+
+	_, err := eng.ParseSql(`select a, b from "sensors/+/temp" where a > 1 do republish('alerts/${topic(2)}'), collect()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = eng.ParseSql(`select b as level from "alerts/+" do collect()`); err != nil {
+		t.Fatal(err)
+	}
+	if err = eng.Publish("sensors/s1/temp", map[string]interface{}{"a": 2, "b": 3}); err != nil {
+		t.Error(err)
+	}
+	if err = eng.Publish("sensors/s1/temp", map[string]interface{}{"a": 1, "b": 3}); err != nil {
+		t.Error(err)
+	}
+	if len(ch) != 2 {
+		t.Fatal(len(ch))
+	}
+	//republish runs before collect
+	msgs := map[string]*action.Message{}
+	for i := 0; i < 2; i++ {
+		msg := <-ch
+		msgs[msg.Rule] = msg
+	}
+	if msg := msgs["alerts/+"]; msg == nil || msg.Topic != "alerts/s1" || !reflect.DeepEqual(msg.Payload, map[string]interface{}{"level": 3}) {
+		t.Error(msg)
+	}
+	if msg := msgs["sensors/+/temp"]; msg == nil || msg.Topic != "sensors/s1/temp" {
+		t.Error(msg)
+	}
+
+	//the actions after a failing one are skipped by the error policy stop
+	err = eng.LoadConfig(strings.NewReader(`{"rules": [
+		{"sql": "select a from \"f\" do collect()", "on_error": "stop", "actions": [{"type": "fail", "params": {"retries": 2, "backoff": 1}}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = eng.Publish("f", map[string]interface{}{"a": 1})
+	if errs, ok := err.(ActionErrors); !ok || len(errs) != 1 || errs[0].Rule != "f" || errs[0].Action != "fail" || fails != 3 || len(ch) != 0 {
+		t.Error(err, fails, len(ch))
+	}
+
+	err = eng.LoadConfig(strings.NewReader(`{"rules": [{"sql": "select a from \"g\"", "actions": [{"type": "nope"}]}]}`))
+	if errs, ok := err.(ConfigErrors); !ok || len(errs) != 1 || errs[0].Location != "rules[0].actions[0]" {
+		t.Error(err)
+	}
+
+	//the actions of a removed rule are stopped
+	eng.PutRule("alerts/+", nil)
+	eng.Publish("sensors/s2/temp", map[string]interface{}{"a": 2})
+	if len(ch) != 1 {
+		t.Error(len(ch))
+	}
+	eng.Close()
+	if err = eng.Publish("sensors/s2/temp", map[string]interface{}{"a": 2}); err == nil {
+		t.Error("published after closed")
+	}
+}
+
+func TestJsonEngineWebhook(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		bodies = append(bodies, r.URL.Path+" "+string(body))
+		lock.Unlock()
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	sink := deadletter.NewMemory(0)
+	eng := NewJsonEngine(false).SetDeadLetter(sink)
+	defer eng.Close()
+	_, err := eng.ParseSql(`select device, temp from "sensors/+" where temp > 50
+		do webhook('` + server.URL + `/${device}', body = '{"alert": "${device}"}'),
+		   webhook('` + server.URL + `/fail', retries = 2, backoff = 1, jitter = 0.2)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = eng.Publish("sensors/a", map[string]interface{}{"device": "a", "temp": 60})
+	if errs, ok := err.(ActionErrors); !ok || len(errs) != 1 || errs[0].Action != "webhook" {
+		t.Error(err)
+	}
+	lock.Lock()
+	if strings.Join(bodies, ",") != `/a {"alert": "a"},/fail {"device":"a","temp":60},/fail {"device":"a","temp":60},/fail {"device":"a","temp":60}` {
+		t.Error(bodies)
+	}
+	lock.Unlock()
+
+	letters := sink.Letters()
+	if len(letters) != 1 || letters[0].Rule != "sensors/+" || letters[0].Stage != deadletter.StageAction ||
+		letters[0].Topic != "sensors/a" || !reflect.DeepEqual(letters[0].Payload, map[string]interface{}{"device": "a", "temp": 60}) {
+		t.Error(letters)
+	}
+}
+
+func TestJsonEngineExecutor(t *testing.T) {
+	exec := executor.New(executor.Config{Workers: 4, QueueSize: 16})
+	eng := NewJsonEngine(false).SetExecutor(exec)
+
+	var lock sync.Mutex
+	seen := map[string][]float64{}
+	r, err := eng.ParseRuleAsyncEvent("ordered", `n >= 0`, func(obj interface{}) {
+		m := obj.(map[string]interface{})
+		lock.Lock()
+		seen[m["device"].(string)] = append(seen[m["device"].(string)], m["n"].(float64))
+		lock.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.SetPartitionKey("device"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		eng.HandleJsonAsync(fmt.Sprintf(`{"device":"d%d","n":%d}`, i%3, i))
+	}
+	if err = eng.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for device, values := range seen {
+		total += len(values)
+		for i := 1; i < len(values); i++ {
+			if values[i] < values[i-1] {
+				t.Error(device, values)
+				break
+			}
+		}
+	}
+	if total != 50 || exec.Stats().Completed != 50 {
+		t.Error(total, exec.Stats())
+	}
+}
+
+func TestJsonEngineRegisterConcurrent(t *testing.T) {
+	eng := NewJsonEngine(false)
+	execs := []executor.Executor{executor.New(executor.Config{Workers: 1}), executor.New(executor.Config{Workers: 1})}
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i < 50; i++ {
+			eng.RegisterAction(fmt.Sprintf("null%d", i), func(params action.Params) (action.Action, error) {
+				return &startAction{}, nil
+			})
+			eng.SetExecutor(execs[i%2])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i < 50; i++ {
+			if _, err := eng.ParseSql(`select a from "typed" do stdout()`); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i < 50; i++ {
+			if _, err := eng.ParseRuleAsyncEvent("async", "a > 0", func(obj interface{}) {}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	close(start)
+	wg.Wait()
+	for _, exec := range execs {
+		exec.Shutdown(context.Background())
+	}
+}
+
+func TestJsonEngineExecutorDrops(t *testing.T) {
+	exec := executor.New(executor.Config{Workers: 1, QueueSize: 1, Policy: executor.DropNewest})
+	sink := deadletter.NewMemory(0)
+	eng := NewJsonEngine(false).SetExecutor(exec).SetDeadLetter(sink)
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	if _, err := eng.ParseRuleAsyncEvent("drops", `n >= 0`, func(obj interface{}) {
+		started <- struct{}{}
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	}
+	eng.HandleAsync(map[string]interface{}{"n": 0})
+	<-started
+	eng.HandleAsync(map[string]interface{}{"n": 1}) //queued
+	eng.HandleAsync(map[string]interface{}{"n": 2}) //dropped
+	close(release)
+	if err := eng.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	letters := sink.Letters()
+	if len(letters) != 1 || letters[0].Rule != "drops" || letters[0].Stage != deadletter.StageHandler ||
+		letters[0].Payload.(map[string]interface{})["n"] != 2 || !strings.Contains(letters[0].Error, executor.ErrDropped.Error()) {
+		t.Error(letters)
+	}
+	if m := eng.Metrics(); len(m) != 1 || m[0].Dropped != 1 {
+		t.Error(m)
+	}
+
+	//after the shutdown
+	eng.HandleAsync(map[string]interface{}{"n": 3})
+	if letters = sink.Letters(); len(letters) != 2 || !strings.Contains(letters[1].Error, executor.ErrShutdown.Error()) {
+		t.Error(letters)
+	}
+}
+
+func TestJsonEngineContext(t *testing.T) {
+	eng := NewJsonEngine(false).RegisterRuleFunction("slow", func(i rule.Rule) func([]interface{}) interface{} {
+		return func(values []interface{}) interface{} {
+			time.Sleep(20 * time.Millisecond)
+			return values[0]
+		}
+	})
+	r, err := eng.ParseSql(`select id, slow(v) as v from "slow" where v > 0 order by id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := eng.ConvertJsonContext(context.Background(), "slow", `{"id":1,"v":2}`)
+	if err != nil || out != `{"id":1,"v":2}` {
+		t.Error(out, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if out, err = eng.ConvertJsonContext(ctx, "slow", `{"id":1,"v":2}`); err != context.Canceled || out != "" {
+		t.Error(out, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	rows := []interface{}{}
+	for i := 0; i < 10; i++ {
+		rows = append(rows, map[string]interface{}{"id": float64(i), "v": 1.0})
+	}
+	start := time.Now()
+	if ret, err := r.HandleContext(ctx, rows); err != context.DeadlineExceeded || ret != nil {
+		t.Error(ret, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Error("not cancelled in", elapsed)
+	}
+
+	r.SetTimeBudget(30 * time.Millisecond)
+	if ret := r.Handle(rows); ret != nil {
+		t.Error(ret)
+	}
+	if out, err = r.ConvertJson(`{"id":1,"v":2}`); err != nil || out != `{"id":1,"v":2}` {
+		t.Error(out, err)
+	}
+	if out, err = r.ConvertJson(`[{"id":1,"v":2},{"id":2,"v":3}]`); err != context.DeadlineExceeded {
+		t.Error(out, err)
+	}
+
+	err = eng.LoadConfig(strings.NewReader(`{"rules":[{"sql":"select * from \"budget\"","time_budget":"-1s"}]}`))
+	if errs, ok := err.(ConfigErrors); !ok || len(errs) != 1 || errs[0].Location != "rules[0].time_budget" {
+		t.Error(err)
+	}
+}
+
+func TestJsonEngineSetDeadLetterConcurrent(t *testing.T) {
+	eng := NewJsonEngine(false)
+	if _, err := eng.ParseSql(`select id, cast(v as int) as n from "dlc"`); err != nil {
+		t.Fatal(err)
+	}
+	sinks := []*deadletter.Memory{deadletter.NewMemory(0), deadletter.NewMemory(0)}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			eng.ConvertJson("dlc", `{"id":1,"v":"abc"}`)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		eng.SetDeadLetter(sinks[i%2])
+	}
+	wg.Wait()
+
+	eng.SetDeadLetter(sinks[0])
+	before := len(sinks[0].Letters())
+	eng.ConvertJson("dlc", `{"id":1,"v":"abc"}`)
+	if len(sinks[0].Letters()) != before+1 {
+		t.Error(len(sinks[0].Letters()), before)
+	}
+	eng.SetDeadLetter(nil)
+	eng.ConvertJson("dlc", `{"id":1,"v":"abc"}`)
+	if len(sinks[0].Letters()) != before+1 {
+		t.Error(len(sinks[0].Letters()), before)
+	}
+}
+
+func TestJsonEngineDeadLetter(t *testing.T) {
+	sink := deadletter.NewMemory(0)
+	eng := NewJsonEngine(false)
+	down := true
+	eng.RegisterAction("flaky", func(params action.Params) (action.Action, error) {
+		return action.NewRepublish("", func(topic string, payload interface{}) error {
+			if down {
+				return errors.New("down")
+			}
+			return nil
+		})
+	})
+	if _, err := eng.ParseSql(`select id, cast(v as int) as n from "dl" where v != "skip" do flaky()`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eng.ParseSql(`select * from "dl2" where cast(v as int) > 1`); err != nil {
+		t.Fatal(err)
+	}
+	eng.SetDeadLetter(sink) //also for the rules put already
+
+	if out, err := eng.ConvertJson("dl", `{"id":1,"v":"abc"}`); err != nil || out != `{"id":1}` {
+		t.Error(out, err)
+	}
+	if _, err := eng.ConvertJson("dl", `{"id":`); err == nil {
+		t.Error("decoded")
+	}
+	if out, err := eng.ConvertJson("dl2", `{"v":"x"}`); err != nil || out != "null" {
+		t.Error(out, err)
+	}
+	if err := eng.HandleJsonAsync(`nope`); err == nil {
+		t.Error("decoded")
+	}
+	if err := eng.Publish("dl", map[string]interface{}{"id": 2, "v": 3}); err == nil {
+		t.Error("delivered")
+	}
+
+	letters := sink.Letters()
+	if len(letters) != 5 {
+		t.Fatal(len(letters))
+	}
+	expected := []struct {
+		rule    string
+		stage   deadletter.Stage
+		payload interface{}
+	}{
+		{"dl", deadletter.StageMap, map[string]interface{}{"id": 1.0, "v": "abc"}},
+		{"dl", deadletter.StageDecode, `{"id":`},
+		{"dl2", deadletter.StageFilter, map[string]interface{}{"v": "x"}},
+		{"", deadletter.StageDecode, `nope`},
+		{"dl", deadletter.StageAction, map[string]interface{}{"id": 2, "n": int64(3)}},
+	}
+	for i, e := range expected {
+		if l := letters[i]; l.Rule != e.rule || l.Stage != e.stage || !reflect.DeepEqual(l.Payload, e.payload) || l.Error == "" || l.Time.IsZero() {
+			t.Error(i, l)
+		}
+	}
+	if !strings.Contains(letters[0].Error, "cast") || letters[4].Action != "flaky" || letters[4].Topic != "dl" {
+		t.Error(letters[0].Error, letters[4])
+	}
+
+	//the action failing is run again on the output
+	down = false
+	if outputs, err := eng.Replay(letters[4]); err != nil || outputs != nil {
+		t.Error(outputs, err)
+	}
+	outputs, err := eng.Replay(&deadletter.Letter{Rule: "dl", Stage: deadletter.StageDecode, Payload: `{"id":3,"v":"4"}`})
+	if err != nil || !reflect.DeepEqual(outputs, []interface{}{map[string]interface{}{"id": 3.0, "n": int64(4)}}) {
+		t.Error(outputs, err)
+	}
+	if _, err = eng.Replay(&deadletter.Letter{Rule: "none", Stage: deadletter.StageMap}); err != ErrNoRuleFound {
+		t.Error(err)
+	}
+	if len(sink.Letters()) != 5 {
+		t.Error(sink.Letters()[5:])
+	}
+
+	//async handlers panicking are recovered, and run again by a replay
+	calls := make(chan interface{}, 2)
+	if _, err = eng.ParseRuleAsyncEvent("panics", `v > 0`, func(obj interface{}) {
+		calls <- obj
+		if len(calls) == 1 {
+			panic("boom")
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	eng.HandleAsync(map[string]interface{}{"v": 1})
+	for i := 0; i < 100 && len(sink.Letters()) == 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if letters = sink.Letters(); len(letters) != 6 || letters[5].Rule != "panics" || letters[5].Stage != deadletter.StageHandler ||
+		!strings.Contains(letters[5].Error, "boom") {
+		t.Fatal(letters[5:])
+	}
+	if outputs, err := eng.Replay(letters[5]); err != nil || outputs != nil {
+		t.Error(outputs, err)
+	}
+	for i := 0; i < 100 && len(calls) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(calls) != 2 || len(sink.Letters()) != 6 {
+		t.Error(len(calls), sink.Letters()[6:])
+	}
+}
+
+func TestJsonEngineMetrics(t *testing.T) {
+	eng := NewJsonEngine(false)
+	eng.RegisterAction("fail", func(params action.Params) (action.Action, error) {
+		return action.NewRepublish("", func(topic string, payload interface{}) error {
+			return errors.New("failed")
+		})
+	})
+	eng.RegisterAction("stdout", func(params action.Params) (action.Action, error) {
+		return action.NewWriter(ioutil.Discard), nil
+	})
+	if _, err := eng.ParseSql(`select id, cast(v as int) as n from "m" where id > 0 do stdout(), fail()`); err != nil {
+		t.Fatal(err)
+	}
+	eng.ConvertJson("m", `{"id":1,"v":2}`)
+	eng.ConvertJson("m", `{"id":0,"v":2}`)
+	eng.ConvertJson("m", `{"id":2,"v":"x"}`)
+	eng.ConvertJson("m", `{"id":`)
+	eng.HandleAll("m", []interface{}{})
+	eng.Publish("m", map[string]interface{}{"id": 3, "v": 1})
+
+	snapshots := eng.Metrics()
+	if len(snapshots) != 1 {
+		t.Fatal(snapshots)
+	}
+	s := snapshots[0]
+	if s.Rule != "m" || s.Received != 6 || s.Matched != 3 || s.Filtered != 2 || s.Emitted != 3 || s.Failed != 2 || s.Latency.Count != 5 {
+		t.Error(s)
+	}
+	if len(s.Actions) != 2 || s.Actions[0].Name != "fail" || s.Actions[0].Failures != 1 || s.Actions[1].Successes != 1 {
+		t.Error(s.Actions)
+	}
+
+	server := httptest.NewServer(eng.MetricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `sqlrules_rule_matched_total{rule="m"} 3`) {
+		t.Error(string(body))
+	}
+
+	eng.PutRule("m", nil)
+	if snapshots = eng.Metrics(); len(snapshots) != 0 {
+		t.Error(snapshots)
+	}
+}
+
+func TestJsonEngineTraceState(t *testing.T) {
+	eng := NewJsonEngine(false)
+	r, err := eng.ParseSql("select delta(v) as d, `${lag(v)}` as l, * replace (changed(v) as v) from \"trace\" where id > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonText, err := r.ConvertJson(`{"id":1,"v":1}`); err != nil || jsonText != `{"l":"","id":1,"v":false}` {
+		t.Error(jsonText, err)
+	}
+	node := r.Trace(map[string]interface{}{"id": 1, "v": 100})
+	if bin, _ := json.Marshal(node.Value); string(bin) != `{"d":99,"id":1,"l":"1","v":true}` {
+		t.Error(string(bin))
+	}
+	//the trace left the states unchanged
+	if jsonText, err := r.ConvertJson(`{"id":1,"v":2}`); err != nil || jsonText != `{"d":1,"l":"1","id":1,"v":true}` {
+		t.Error(jsonText, err)
+	}
+}
+
+func TestJsonEngineExplain(t *testing.T) {
+	eng := NewJsonEngine(false).RegisterRuleFunction("clientid", func(i rule.Rule) func([]interface{}) interface{} {
+		return func([]interface{}) interface{} {
+			return i.Name()
+		}
+	})
+	r, err := eng.ParseSql(`select id, upper(name) as n, cast(v as int) * 2 as v2, clientid() as c default 'none'
+		from "explain" where id > 0 && len(name) > 0 order by v2 desc limit 2 do republish('out', retries = 3)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := r.Explain()
+	for _, line := range []string{
+		`RULE "explain"`,
+		"    WHERE id > 0 && len(name) > 0",
+		"      functions: len (builtin)",
+		`      cast(v, "int") * 2 AS v2`,
+		`      clientid() AS c DEFAULT "none"`,
+		"      functions: upper (builtin), cast (builtin), clientid (rule)",
+		"  ORDER BY v2 DESC NULLS FIRST LIMIT 2",
+		"  DO republish('out', retries = 3)",
+	} {
+		if !strings.Contains(plan, line+"\n") && !strings.HasSuffix(plan, line) {
+			t.Error(line, "\n"+plan)
+		}
+	}
+
+	trace := r.Trace([]interface{}{
+		map[string]interface{}{"id": 1.0, "name": "ab", "v": 3.0},
+		map[string]interface{}{"id": 2.0, "name": "", "v": 5.0},
+		map[string]interface{}{"id": 3.0, "name": "c", "v": "x"},
+	})
+	//v2 of the third row is null, which comes first
+	output, _ := json.Marshal(trace.Value)
+	if string(output) != `[{"c":"explain","id":3,"n":"C"},{"c":"explain","id":1,"n":"AB","v2":6}]` || len(trace.Children) != 2 {
+		t.Fatal(trace)
+	}
+	rows := trace.Children[0]
+	if len(rows.Children) != 3 || rows.Children[1].Value != nil {
+		t.Fatal(rows)
+	}
+	//the where clause of the second row is false by its right side, which is evaluated first
+	where := rows.Children[1].Children[0].Children[0]
+	if where.Expr != "id > 0 && len(name) > 0" || where.Value != false || len(where.Children) != 1 ||
+		where.Children[0].Expr != "len(name) > 0" || where.Children[0].Value != false {
+		t.Error(where)
+	}
+	//the cast of the third row fails
+	fields := rows.Children[2].Children[1].Children
+	if v2 := fields[2]; v2.Value != nil || v2.Children[0].Error == "" {
+		t.Error(v2.Children[0])
+	}
+	if text := trace.String(); !strings.Contains(text, "\n        upper(name) AS n = \"AB\"\n") {
+		t.Error(text)
+	}
+}
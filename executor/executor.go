@@ -0,0 +1,247 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrShutdown = errors.New("executor shut down")
+var ErrDropped = errors.New("task dropped")
+
+// Policy decides what Submit does when the queue of a worker is full
+type Policy int
+
+const (
+	Block      Policy = iota // waits for the queue to have room, the default
+	DropOldest               // drops the oldest task of the queue
+	DropNewest               // drops the task submitted
+)
+
+// DefaultWorkers and DefaultQueueSize are used for the zero values of Config
+const (
+	DefaultWorkers   = 8
+	DefaultQueueSize = 1024
+)
+
+// Config configures an executor
+type Config struct {
+	Workers   int    //the number of goroutines running the tasks
+	QueueSize int    //the number of tasks waiting for every worker at most
+	Policy    Policy //when a queue is full
+	// OnPanic is called with the value recovered from a task panicking, the worker goes on with the next task
+	OnPanic func(v interface{})
+}
+
+// Stats are the counts of the tasks of an executor
+type Stats struct {
+	Queued    int    //waiting in the queues
+	Completed uint64 //run, including the ones panicking
+	Dropped   uint64 //dropped by DropOldest, DropNewest, or Shutdown when ctx is done
+}
+
+// Executor runs tasks by a fixed number of workers, each of which has a bounded queue
+type Executor interface {
+	// Submit queues task, the tasks of the same non empty key run in the order they are submitted,
+	// the others are spread over the workers
+	Submit(key string, task func()) error
+	// Shutdown stops accepting tasks and waits for the queued ones to finish until ctx is done,
+	// the tasks not started by then are dropped
+	Shutdown(ctx context.Context) error
+	Stats() Stats
+}
+
+// DropNotifier is an Executor which tells the tasks dropped after they are queued, by DropOldest or Shutdown
+type DropNotifier interface {
+	// SubmitNotify is Submit which calls onDrop with ErrDropped or ErrShutdown when task is dropped after it is queued,
+	// the tasks not queued fail with the error returned as by Submit
+	SubmitNotify(key string, task func(), onDrop func(err error)) error
+}
+
+// queued is a task in the queue of a worker
+type queued struct {
+	run    func()
+	onDrop func(err error)
+}
+
+// drop calls the onDrop of the tasks with err
+func drop(tasks []queued, err error) {
+	for _, t := range tasks {
+		if t.onDrop != nil {
+			t.onDrop(err)
+		}
+	}
+}
+
+type worker struct {
+	lock     sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	tasks    []queued //a ring of QueueSize
+	head     int
+	count    int
+	closed   bool
+}
+
+type executor struct {
+	completed uint64 //first for the alignment of atomic operations
+	dropped   uint64
+	config    Config
+	workers   []*worker
+	next      uint32 //the worker of the next task without key
+	wg        sync.WaitGroup
+}
+
+// New starts the workers of an executor
+func New(config Config) Executor {
+	if config.Workers <= 0 {
+		config.Workers = DefaultWorkers
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	e := &executor{config: config, workers: make([]*worker, config.Workers)}
+	for i := range e.workers {
+		w := &worker{tasks: make([]queued, config.QueueSize)}
+		w.notEmpty = sync.NewCond(&w.lock)
+		w.notFull = sync.NewCond(&w.lock)
+		e.workers[i] = w
+		e.wg.Add(1)
+		go e.run(w)
+	}
+	return e
+}
+
+func (e *executor) workerOf(key string) *worker {
+	var n uint32
+	if key == "" {
+		n = atomic.AddUint32(&e.next, 1)
+	} else {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		n = h.Sum32()
+	}
+	return e.workers[n%uint32(len(e.workers))]
+}
+
+func (e *executor) Submit(key string, task func()) error {
+	return e.SubmitNotify(key, task, nil)
+}
+
+func (e *executor) SubmitNotify(key string, task func(), onDrop func(err error)) error {
+	w := e.workerOf(key)
+	var evicted []queued
+	defer func() {
+		drop(evicted, ErrDropped) //out of the lock
+	}()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for !w.closed && w.count == len(w.tasks) {
+		switch e.config.Policy {
+		case DropNewest:
+			atomic.AddUint64(&e.dropped, 1)
+			return ErrDropped
+		case DropOldest:
+			evicted = append(evicted, w.tasks[w.head])
+			w.tasks[w.head] = queued{}
+			w.head = (w.head + 1) % len(w.tasks)
+			w.count--
+			atomic.AddUint64(&e.dropped, 1)
+		default:
+			w.notFull.Wait()
+		}
+	}
+	if w.closed {
+		return ErrShutdown
+	}
+	w.tasks[(w.head+w.count)%len(w.tasks)] = queued{run: task, onDrop: onDrop}
+	w.count++
+	w.notEmpty.Signal()
+	return nil
+}
+
+// take waits for the next task of w, it returns nil when w is closed and empty
+func (w *worker) take() func() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for w.count == 0 && !w.closed {
+		w.notEmpty.Wait()
+	}
+	if w.count == 0 {
+		return nil
+	}
+	task := w.tasks[w.head].run
+	w.tasks[w.head] = queued{}
+	w.head = (w.head + 1) % len(w.tasks)
+	w.count--
+	w.notFull.Signal()
+	return task
+}
+
+func (e *executor) run(w *worker) {
+	defer e.wg.Done()
+	for task := w.take(); task != nil; task = w.take() {
+		e.runTask(task)
+	}
+}
+
+func (e *executor) runTask(task func()) {
+	defer func() {
+		atomic.AddUint64(&e.completed, 1)
+		if v := recover(); v != nil && e.config.OnPanic != nil {
+			e.config.OnPanic(v)
+		}
+	}()
+	task()
+}
+
+func (e *executor) Shutdown(ctx context.Context) error {
+	for _, w := range e.workers {
+		w.lock.Lock()
+		w.closed = true
+		w.notEmpty.Broadcast()
+		w.notFull.Broadcast()
+		w.lock.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, w := range e.workers {
+			w.lock.Lock()
+			atomic.AddUint64(&e.dropped, uint64(w.count))
+			dropped := make([]queued, 0, w.count)
+			for i := 0; i < w.count; i++ {
+				dropped = append(dropped, w.tasks[(w.head+i)%len(w.tasks)])
+			}
+			for i := range w.tasks {
+				w.tasks[i] = queued{}
+			}
+			w.count = 0
+			w.lock.Unlock()
+			drop(dropped, ErrShutdown)
+		}
+		return ctx.Err()
+	}
+}
+
+func (e *executor) Stats() Stats {
+	var stats Stats
+	for _, w := range e.workers {
+		w.lock.Lock()
+		stats.Queued += w.count
+		w.lock.Unlock()
+	}
+	stats.Completed = atomic.LoadUint64(&e.completed)
+	stats.Dropped = atomic.LoadUint64(&e.dropped)
+	return stats
+}
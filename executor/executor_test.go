@@ -0,0 +1,200 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderByKey(t *testing.T) {
+	e := New(Config{Workers: 4, QueueSize: 8})
+	var lock sync.Mutex
+	seen := map[string][]int{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i % 5)
+		i := i
+		if err := e.Submit(key, func() {
+			lock.Lock()
+			seen[key] = append(seen[key], i)
+			lock.Unlock()
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range seen {
+		if len(values) != 20 {
+			t.Error(key, values)
+		}
+		for i := 1; i < len(values); i++ {
+			if values[i] < values[i-1] {
+				t.Error(key, values)
+				break
+			}
+		}
+	}
+	if stats := e.Stats(); stats.Completed != 100 || stats.Queued != 0 || stats.Dropped != 0 {
+		t.Error(stats)
+	}
+	if err := e.Submit("", func() {}); err != ErrShutdown {
+		t.Error(err)
+	}
+}
+
+// blocked returns an executor of a worker busy until release is closed
+func blocked(policy Policy, queueSize int) (Executor, chan struct{}) {
+	e := New(Config{Workers: 1, QueueSize: queueSize, Policy: policy})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	e.Submit("", func() {
+		close(started)
+		<-release
+	})
+	<-started
+	return e, release
+}
+
+func TestPolicies(t *testing.T) {
+	var lock sync.Mutex
+	var ran []int
+	task := func(i int) func() {
+		return func() {
+			lock.Lock()
+			ran = append(ran, i)
+			lock.Unlock()
+		}
+	}
+
+	e, release := blocked(DropNewest, 2)
+	for i := 0; i < 4; i++ {
+		err := e.Submit("", task(i))
+		if i < 2 && err != nil || i >= 2 && err != ErrDropped {
+			t.Error(i, err)
+		}
+	}
+	close(release)
+	e.Shutdown(context.Background())
+	if fmt.Sprint(ran) != "[0 1]" || e.Stats().Dropped != 2 {
+		t.Error(ran, e.Stats())
+	}
+
+	ran = nil
+	e, release = blocked(DropOldest, 2)
+	for i := 0; i < 4; i++ {
+		if err := e.Submit("", task(i)); err != nil {
+			t.Error(i, err)
+		}
+	}
+	close(release)
+	e.Shutdown(context.Background())
+	if fmt.Sprint(ran) != "[2 3]" || e.Stats().Dropped != 2 {
+		t.Error(ran, e.Stats())
+	}
+
+	ran = nil
+	e, release = blocked(Block, 1)
+	e.Submit("", task(0))
+	submitted := make(chan error)
+	go func() {
+		submitted <- e.Submit("", task(1))
+	}()
+	select {
+	case err := <-submitted:
+		t.Error("not blocked", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-submitted; err != nil {
+		t.Error(err)
+	}
+	e.Shutdown(context.Background())
+	if fmt.Sprint(ran) != "[0 1]" {
+		t.Error(ran)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	e, release := blocked(Block, 10)
+	for i := 0; i < 5; i++ {
+		e.Submit("", func() {})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	close(release)
+	if stats := e.Stats(); stats.Dropped != 5 || stats.Queued != 0 {
+		t.Error(stats)
+	}
+
+	//a waiting Submit returns when shut down
+	e, release = blocked(Block, 1)
+	e.Submit("", func() {})
+	submitted := make(chan error)
+	go func() {
+		submitted <- e.Submit("", func() {})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go e.Shutdown(context.Background())
+	if err := <-submitted; err != ErrShutdown {
+		t.Error(err)
+	}
+	close(release)
+}
+
+func TestSubmitNotify(t *testing.T) {
+	var lock sync.Mutex
+	var drops []string
+	onDrop := func(i int) func(err error) {
+		return func(err error) {
+			lock.Lock()
+			drops = append(drops, fmt.Sprint(i, ":", err))
+			lock.Unlock()
+		}
+	}
+
+	e, release := blocked(DropOldest, 2)
+	for i := 0; i < 4; i++ {
+		if err := e.(DropNotifier).SubmitNotify("", func() {}, onDrop(i)); err != nil {
+			t.Error(i, err)
+		}
+	}
+	if fmt.Sprint(drops) != "[0:task dropped 1:task dropped]" {
+		t.Error(drops)
+	}
+
+	drops = nil
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	close(release)
+	if fmt.Sprint(drops) != "[2:executor shut down 3:executor shut down]" {
+		t.Error(drops)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	panics := make(chan interface{}, 1)
+	e := New(Config{Workers: 1, OnPanic: func(v interface{}) {
+		panics <- v
+	}})
+	done := make(chan struct{})
+	e.Submit("", func() {
+		panic("boom")
+	})
+	e.Submit("", func() {
+		close(done)
+	})
+	<-done
+	if v := <-panics; v != "boom" {
+		t.Error(v)
+	}
+	e.Shutdown(context.Background())
+}
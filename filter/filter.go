@@ -1,7 +1,10 @@
 package filter
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/executor"
 	"github.com/sdghchj/sql-rules-engine/function"
 	"github.com/sdghchj/sql-rules-engine/handler"
 	"github.com/sdghchj/sql-rules-engine/parser"
@@ -10,10 +13,17 @@ import (
 
 type FieldFilter interface {
 	handler.Handler
+	handler.ContextHandler
 	Parse(match string, handlers ...handler.EventHandler) error
 	Match(obj interface{}) bool
+	MatchContext(ctx context.Context, obj interface{}) (bool, error)
 	MatchJson(json string) bool
 	ParseForAsyncHandlers(match string, asyncHandlers ...handler.AsyncEventHandler) error
+	SetExecutor(exec executor.Executor, key func(obj interface{}) string)
+	SetPanicHandler(onPanic func(obj interface{}, v interface{}))
+	SetDropHandler(onDrop func(obj interface{}, err error))
+	Explain() string
+	Trace(obj interface{}) *parser.TraceNode
 }
 
 type fieldFilter struct {
@@ -22,6 +32,10 @@ type fieldFilter struct {
 	resolver      parser.Resolver
 	handlers      []handler.EventHandler
 	asyncHandlers []handler.AsyncEventHandler
+	exec          executor.Executor
+	key           func(obj interface{}) string
+	onPanic       func(obj interface{}, v interface{})
+	onDrop        func(obj interface{}, err error)
 }
 
 func NewFieldFilter(funcs function.Functions) FieldFilter {
@@ -61,6 +75,65 @@ func (f *fieldFilter) Match(obj interface{}) bool {
 	return false
 }
 
+// MatchContext is Match which returns the error of ctx once ctx is done
+func (f *fieldFilter) MatchContext(ctx context.Context, obj interface{}) (bool, error) {
+	if f.resolver == nil {
+		return false, ctx.Err()
+	}
+	ret, err := f.resolver.EvaluateContext(ctx, obj)
+	if err != nil {
+		return false, err
+	}
+	b, ok := ret.(bool)
+	return ok && b, nil
+}
+
+// Explain describes the condition with the functions it calls, and the numbers of the handlers
+func (f *fieldFilter) Explain() string {
+	if f.resolver == nil {
+		return "WHERE false"
+	}
+	lines := []string{"WHERE " + f.resolver.String()}
+	if funcs := f.resolver.Functions(); len(funcs) > 0 {
+		lines = append(lines, "  functions: "+joinFunctions(funcs))
+	}
+	if len(f.handlers) > 0 {
+		lines = append(lines, fmt.Sprintf("  event handlers: %d", len(f.handlers)))
+	}
+	if len(f.asyncHandlers) > 0 {
+		lines = append(lines, fmt.Sprintf("  async handlers: %d", len(f.asyncHandlers)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func joinFunctions(funcs []parser.Function) string {
+	names := make([]string, len(funcs))
+	for i, f := range funcs {
+		names[i] = f.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// Trace handles obj, returning the output with the evaluation of the condition.
+// The async handlers are not run.
+func (f *fieldFilter) Trace(obj interface{}) *parser.TraceNode {
+	node := &parser.TraceNode{}
+	if f.resolver == nil {
+		node.Expr = "WHERE false"
+		return node
+	}
+	node.Expr = "WHERE " + f.resolver.String()
+	cond := f.resolver.Trace(obj)
+	node.Children = []*parser.TraceNode{cond}
+	if b, ok := cond.Value.(bool); ok && b {
+		for _, handler := range f.handlers {
+			obj = handler(obj)
+		}
+		node.Value = obj
+	}
+	return node
+}
+
 func (f *fieldFilter) MatchJson(jsonText string) bool {
 	decoder := json.NewDecoder(strings.NewReader(jsonText))
 	//decoder.UseNumber()
@@ -84,11 +157,86 @@ func (f *fieldFilter) Handle(obj interface{}) interface{} {
 	return nil
 }
 
+// HandleContext is Handle which returns the error of ctx once ctx is done, the event handlers are not cancelled
+func (f *fieldFilter) HandleContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	matched, err := f.MatchContext(ctx, obj)
+	if err != nil || !matched {
+		return nil, err
+	}
+	for _, handler := range f.handlers {
+		obj = handler(obj)
+	}
+	return obj, nil
+}
+
+// SetExecutor runs the async handlers by exec with the keys of the objects returned by key,
+// instead of a goroutine per handler per object
+func (f *fieldFilter) SetExecutor(exec executor.Executor, key func(obj interface{}) string) {
+	f.exec = exec
+	f.key = key
+}
+
+// SetPanicHandler calls onPanic with the object and the value recovered from an async handler panicking
+func (f *fieldFilter) SetPanicHandler(onPanic func(obj interface{}, v interface{})) {
+	f.onPanic = onPanic
+}
+
+// SetDropHandler calls onDrop with the object and the error of an async handler the executor did not run,
+// executor.ErrDropped or executor.ErrShutdown
+func (f *fieldFilter) SetDropHandler(onDrop func(obj interface{}, err error)) {
+	f.onDrop = onDrop
+}
+
+// submit submits handler on obj to the executor, reporting it to the drop handler when it is not run
+func (f *fieldFilter) submit(key string, handler handler.AsyncEventHandler, obj interface{}) {
+	task := func() {
+		f.runAsync(handler, obj, true)
+	}
+	onDrop := f.onDrop
+	var err error
+	if notifier, ok := f.exec.(executor.DropNotifier); ok && onDrop != nil {
+		err = notifier.SubmitNotify(key, task, func(err error) {
+			onDrop(obj, err)
+		})
+	} else {
+		err = f.exec.Submit(key, task)
+	}
+	if err != nil && onDrop != nil {
+		onDrop(obj, err)
+	}
+}
+
+// runAsync runs handler on obj, whose panic is passed to the panic handler. The panic is recovered when handler
+// runs in a goroutine of its own, and passed on to the OnPanic of the executor otherwise.
+func (f *fieldFilter) runAsync(handler handler.AsyncEventHandler, obj interface{}, repanic bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			if f.onPanic != nil {
+				f.onPanic(obj, v)
+			}
+			if repanic {
+				panic(v)
+			}
+		}
+	}()
+	handler(obj)
+}
+
 func (f *fieldFilter) HandleAsync(obj interface{}) {
 	if f.Match(obj) {
 		if f.asyncHandlers != nil && len(f.asyncHandlers) > 0 {
+			if f.exec == nil {
+				for _, handler := range f.asyncHandlers {
+					go f.runAsync(handler, obj, false)
+				}
+				return
+			}
+			key := ""
+			if f.key != nil {
+				key = f.key(obj)
+			}
 			for _, handler := range f.asyncHandlers {
-				go handler(obj)
+				f.submit(key, handler, obj)
 			}
 		}
 	}
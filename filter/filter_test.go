@@ -1,6 +1,7 @@
 package filter
 
 import (
+	"context"
 	"testing"
 )
 
@@ -85,3 +86,22 @@ func TestFilterForArray(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestFilterContext(t *testing.T) {
+	fieldFilter := NewFieldFilter(nil)
+	if err := fieldFilter.Parse("a < 2 && len(b) == 1"); err != nil {
+		t.Fatal(err)
+	}
+	obj := map[string]interface{}{"a": 1, "b": "x"}
+	if ok, err := fieldFilter.MatchContext(context.Background(), obj); !ok || err != nil {
+		t.Error(ok, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ok, err := fieldFilter.MatchContext(ctx, obj); ok || err != context.Canceled {
+		t.Error(ok, err)
+	}
+	if ret, err := fieldFilter.HandleContext(ctx, obj); ret != nil || err != context.Canceled {
+		t.Error(ret, err)
+	}
+}
@@ -0,0 +1,269 @@
+package flatten
+
+import (
+	"errors"
+	"github.com/sdghchj/sql-rules-engine/handler"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidSeparator = errors.New("invalid separator")
+var ErrInvalidMaxDepth = errors.New("invalid max depth")
+
+// IndexStyle is how the indexes of arrays are written into flat keys
+type IndexStyle int
+
+const (
+	IndexBracket IndexStyle = iota // a.b[0].c, the target path of utils.SetByPath with the separator .
+	IndexKey                       // a.b.0.c, an index is a key, so objects with integer keys are unflattened into arrays
+	IndexNone                      // arrays are values, not flattened
+)
+
+const maxIndex = 1<<16 - 1
+
+// DefaultSeparator makes the flat keys the key paths of utils.SetByPath and utils.GetByPath
+const DefaultSeparator = "."
+
+// Flattener turns nested objects into objects of one level, whose keys are the key paths of the leaves.
+// Empty objects and arrays are kept as leaves, other values are returned unchanged.
+type Flattener interface {
+	handler.Handler
+	SetSeparator(sep string) error
+	SetIndexStyle(style IndexStyle) Flattener
+	SetMaxDepth(depth int) error
+	Explain() string
+}
+
+// Unflattener turns the flat keys of an object into nested objects, as the reverse of a Flattener
+// with the same settings. Keys containing the separator can not be round-tripped.
+type Unflattener interface {
+	handler.Handler
+	SetSeparator(sep string) error
+	SetIndexStyle(style IndexStyle) Unflattener
+	SetMaxDepth(depth int) error
+	Explain() string
+}
+
+type options struct {
+	sep      string
+	style    IndexStyle
+	maxDepth int //0 means unlimited
+}
+
+func (o *options) setSeparator(sep string) error {
+	if sep == "" || strings.ContainsAny(sep, "[]") {
+		return ErrInvalidSeparator
+	}
+	o.sep = sep
+	return nil
+}
+
+func (o *options) setMaxDepth(depth int) error {
+	if depth < 0 {
+		return ErrInvalidMaxDepth
+	}
+	o.maxDepth = depth
+	return nil
+}
+
+// explain describes the options of the function name
+func (o *options) explain(name string) string {
+	styles := map[IndexStyle]string{IndexBracket: "bracket", IndexKey: "key", IndexNone: "none"}
+	text := name + "(*) separator " + strconv.Quote(o.sep) + " index " + styles[o.style]
+	if o.maxDepth > 0 {
+		text += " max depth " + strconv.Itoa(o.maxDepth)
+	}
+	return text
+}
+
+type flattener struct {
+	options
+}
+
+func NewFlattener() Flattener {
+	return &flattener{options{sep: DefaultSeparator}}
+}
+
+func (f *flattener) SetSeparator(sep string) error {
+	return f.setSeparator(sep)
+}
+
+func (f *flattener) SetIndexStyle(style IndexStyle) Flattener {
+	f.style = style
+	return f
+}
+
+// SetMaxDepth keeps the values deeper than depth levels of keys nested under their flat keys, 0 means unlimited
+func (f *flattener) SetMaxDepth(depth int) error {
+	return f.setMaxDepth(depth)
+}
+
+func (f *flattener) flatten(ret map[string]interface{}, prefix string, value interface{}, depth int) {
+	if f.maxDepth == 0 || depth < f.maxDepth {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if len(v) > 0 {
+				for key, val := range v {
+					if prefix != "" {
+						key = prefix + f.sep + key
+					}
+					f.flatten(ret, key, val, depth+1)
+				}
+				return
+			}
+		case []interface{}:
+			if len(v) > 0 && f.style != IndexNone && prefix != "" {
+				for i, val := range v {
+					if f.style == IndexBracket { //an index is not a level of keys
+						f.flatten(ret, prefix+"["+strconv.Itoa(i)+"]", val, depth)
+					} else {
+						f.flatten(ret, prefix+f.sep+strconv.Itoa(i), val, depth+1)
+					}
+				}
+				return
+			}
+		}
+	}
+	ret[prefix] = value
+}
+
+func (f *flattener) Handle(obj interface{}) interface{} {
+	mp, ok := obj.(map[string]interface{})
+	if !ok {
+		return obj
+	}
+	ret := make(map[string]interface{}, len(mp))
+	if len(mp) > 0 { //an empty object is a leaf below the root only
+		f.flatten(ret, "", mp, 0)
+	}
+	return ret
+}
+
+func (f *flattener) Explain() string {
+	return f.explain("FLATTEN")
+}
+
+func (f *flattener) HandleAsync(obj interface{}) {
+
+}
+
+type unflattener struct {
+	options
+}
+
+func NewUnflattener() Unflattener {
+	return &unflattener{options{sep: DefaultSeparator}}
+}
+
+func (u *unflattener) SetSeparator(sep string) error {
+	return u.setSeparator(sep)
+}
+
+func (u *unflattener) SetIndexStyle(style IndexStyle) Unflattener {
+	u.style = style
+	return u
+}
+
+// SetMaxDepth splits a flat key into depth levels at most, the rest of it is kept as the last key, 0 means unlimited
+func (u *unflattener) SetMaxDepth(depth int) error {
+	return u.setMaxDepth(depth)
+}
+
+type step struct {
+	key   string
+	index int //-1 for a key
+}
+
+var bracketRegexp = regexp.MustCompile(`^([^\[\]]+)((?:\[[0-9]+\])*)$`)
+var indexRegexp = regexp.MustCompile(`\[([0-9]+)\]`)
+
+// steps splits a flat key into keys and array indexes, or returns false when the key is not a flat key of the style
+func (u *unflattener) steps(key string) ([]step, bool) {
+	n := -1
+	if u.maxDepth > 0 {
+		n = u.maxDepth
+	}
+	var steps []step
+	for i, segment := range strings.SplitN(key, u.sep, n) {
+		if segment == "" {
+			return nil, false
+		}
+		switch u.style {
+		case IndexKey:
+			if index, err := strconv.Atoi(segment); err == nil && i > 0 && index >= 0 && index <= maxIndex {
+				steps = append(steps, step{index: index})
+				continue
+			}
+		case IndexBracket:
+			if match := bracketRegexp.FindStringSubmatch(segment); match != nil && match[2] != "" {
+				steps = append(steps, step{key: match[1], index: -1})
+				for _, m := range indexRegexp.FindAllStringSubmatch(match[2], -1) {
+					index, err := strconv.Atoi(m[1])
+					if err != nil || index > maxIndex {
+						return nil, false
+					}
+					steps = append(steps, step{index: index})
+				}
+				continue
+			}
+		}
+		steps = append(steps, step{key: segment, index: -1})
+	}
+	return steps, true
+}
+
+// set writes value into container at steps, creating the missing objects and arrays, and returns the container
+func set(container interface{}, steps []step, value interface{}) interface{} {
+	if len(steps) == 0 {
+		return value
+	}
+	s := steps[0]
+	if s.index < 0 {
+		mp, ok := container.(map[string]interface{})
+		if !ok {
+			mp = map[string]interface{}{}
+		}
+		mp[s.key] = set(mp[s.key], steps[1:], value)
+		return mp
+	}
+	arr, _ := container.([]interface{})
+	for len(arr) <= s.index {
+		arr = append(arr, nil)
+	}
+	arr[s.index] = set(arr[s.index], steps[1:], value)
+	return arr
+}
+
+// Handle sets the values in the order of their flat keys, so that a key overwrites the value of the key it is prefixed by.
+// The keys with empty levels, such as .a, are kept as they are.
+func (u *unflattener) Handle(obj interface{}) interface{} {
+	mp, ok := obj.(map[string]interface{})
+	if !ok {
+		return obj
+	}
+	keys := make([]string, 0, len(mp))
+	for key := range mp {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ret := make(map[string]interface{}, len(mp))
+	for _, key := range keys {
+		if steps, ok := u.steps(key); ok {
+			set(ret, steps, mp[key])
+		} else {
+			ret[key] = mp[key]
+		}
+	}
+	return ret
+}
+
+func (u *unflattener) Explain() string {
+	return u.explain("UNFLATTEN")
+}
+
+func (u *unflattener) HandleAsync(obj interface{}) {
+
+}
@@ -0,0 +1,85 @@
+package flatten
+
+import (
+	"encoding/json"
+	"github.com/sdghchj/sql-rules-engine/utils"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, text string) map[string]interface{} {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestFlattenRoundTrip(t *testing.T) {
+	obj := decode(t, `{"a":{"b":{"c":1},"d":[{"e":2},3],"f":{},"g":[]},"h":"x"}`)
+
+	flat := NewFlattener().Handle(obj).(map[string]interface{})
+	bin, _ := json.Marshal(flat)
+	if string(bin) != `{"a.b.c":1,"a.d[0].e":2,"a.d[1]":3,"a.f":{},"a.g":[],"h":"x"}` {
+		t.Error(string(bin))
+	}
+	for key, val := range flat {
+		if !reflect.DeepEqual(utils.GetByPath(obj, key), val) {
+			t.Error(key)
+		}
+	}
+
+	if back := NewUnflattener().Handle(flat); !reflect.DeepEqual(back, obj) {
+		t.Error(back)
+	}
+
+	for _, style := range []IndexStyle{IndexBracket, IndexKey, IndexNone} {
+		f := NewFlattener().SetIndexStyle(style)
+		u := NewUnflattener().SetIndexStyle(style)
+		if f.SetSeparator("_") != nil || u.SetSeparator("_") != nil {
+			t.Fatal("separator")
+		}
+		if back := u.Handle(f.Handle(obj)); !reflect.DeepEqual(back, obj) {
+			t.Error(style, back)
+		}
+	}
+
+	empty := map[string]interface{}{}
+	if flat := NewFlattener().Handle(empty); !reflect.DeepEqual(flat, empty) {
+		t.Error(flat)
+	}
+	if back := NewUnflattener().Handle(empty); !reflect.DeepEqual(back, empty) {
+		t.Error(back)
+	}
+}
+
+func TestFlattenStyles(t *testing.T) {
+	obj := decode(t, `{"a":{"b":{"c":1},"d":[{"e":2},3]}}`)
+
+	f := NewFlattener().SetIndexStyle(IndexKey)
+	f.SetSeparator("_")
+	bin, _ := json.Marshal(f.Handle(obj))
+	if string(bin) != `{"a_b_c":1,"a_d_0_e":2,"a_d_1":3}` {
+		t.Error(string(bin))
+	}
+
+	f = NewFlattener().SetIndexStyle(IndexNone)
+	if err := f.SetMaxDepth(2); err != nil {
+		t.Fatal(err)
+	}
+	bin, _ = json.Marshal(f.Handle(obj))
+	if string(bin) != `{"a.b":{"c":1},"a.d":[{"e":2},3]}` {
+		t.Error(string(bin))
+	}
+
+	u := NewUnflattener()
+	u.SetMaxDepth(2)
+	bin, _ = json.Marshal(u.Handle(decode(t, `{"a.b.c":1,"x-y.z":2,"n":3,".f":4}`)))
+	if string(bin) != `{".f":4,"a":{"b.c":1},"n":3,"x-y":{"z":2}}` {
+		t.Error(string(bin))
+	}
+
+	if f.SetSeparator("") == nil || f.SetMaxDepth(-1) == nil {
+		t.Error("want error")
+	}
+}
@@ -0,0 +1,304 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	typeNull   = "null"
+	typeBool   = "bool"
+	typeInt    = "int"
+	typeFloat  = "float"
+	typeString = "string"
+	typeArray  = "array"
+	typeObject = "object"
+)
+
+var castTypeNames = map[string]string{
+	"int":     typeInt,
+	"integer": typeInt,
+	"bigint":  typeInt,
+	"long":    typeInt,
+	"float":   typeFloat,
+	"double":  typeFloat,
+	"real":    typeFloat,
+	"decimal": typeFloat,
+	"number":  typeFloat,
+	"string":  typeString,
+	"text":    typeString,
+	"varchar": typeString,
+	"char":    typeString,
+	"bool":    typeBool,
+	"boolean": typeBool,
+}
+
+// CastError is raised by CAST when a value can not be converted.
+// It aborts the evaluation of the whole expression, while TRY_CAST yields null instead.
+type CastError struct {
+	Value interface{}
+	Type  string
+}
+
+func (e *CastError) Error() string {
+	return fmt.Sprintf("can not cast %v(%s) as %s", e.Value, kindOf(e.Value), e.Type)
+}
+
+// kindOf classifies a value into one of the type* names, numbers are split into int and float
+func kindOf(val interface{}) string {
+	switch n := val.(type) {
+	case nil:
+		return typeNull
+	case bool:
+		return typeBool
+	case string:
+		return typeString
+	case float32, float64:
+		return typeFloat
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return typeInt
+	case json.Number:
+		if _, err := n.Int64(); err == nil {
+			return typeInt
+		}
+		return typeFloat
+	}
+
+	switch reflect.ValueOf(val).Kind() {
+	case reflect.Array, reflect.Slice:
+		return typeArray
+	case reflect.Map, reflect.Struct:
+		return typeObject
+	}
+	return ""
+}
+
+func toInt64(val interface{}) (int64, bool) {
+	switch n := val.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), n <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func toFloat64(val interface{}) (float64, bool) {
+	switch n := val.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	if i, ok := toInt64(val); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+func floatToInt64(f float64) (int64, bool) {
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// castValue converts val to the target type following the table documented in README
+func castValue(val interface{}, target string) (interface{}, bool) {
+	kind := kindOf(val)
+	if kind == typeNull {
+		return nil, true
+	}
+
+	switch target {
+	case typeInt:
+		switch kind {
+		case typeBool:
+			if val.(bool) {
+				return int64(1), true
+			}
+			return int64(0), true
+		case typeInt:
+			return toInt64(val)
+		case typeFloat:
+			f, _ := toFloat64(val)
+			return floatToInt64(f)
+		case typeString:
+			text := strings.TrimSpace(val.(string))
+			if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+				return i, true
+			}
+			if f, err := strconv.ParseFloat(text, 64); err == nil {
+				return floatToInt64(f)
+			}
+		}
+	case typeFloat:
+		switch kind {
+		case typeBool:
+			if val.(bool) {
+				return float64(1), true
+			}
+			return float64(0), true
+		case typeInt, typeFloat:
+			return toFloat64(val)
+		case typeString:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(val.(string)), 64); err == nil {
+				return f, true
+			}
+		}
+	case typeString:
+		switch kind {
+		case typeBool:
+			return strconv.FormatBool(val.(bool)), true
+		case typeInt:
+			i, ok := toInt64(val)
+			return strconv.FormatInt(i, 10), ok
+		case typeFloat:
+			f, _ := toFloat64(val)
+			return strconv.FormatFloat(f, 'f', -1, 64), true
+		case typeString:
+			return val, true
+		case typeArray, typeObject:
+			if bin, err := json.Marshal(val); err == nil {
+				return string(bin), true
+			}
+		}
+	case typeBool:
+		switch kind {
+		case typeBool:
+			return val, true
+		case typeInt, typeFloat:
+			f, _ := toFloat64(val)
+			return f != 0, true
+		case typeString:
+			if b, err := strconv.ParseBool(strings.ToLower(strings.TrimSpace(val.(string)))); err == nil {
+				return b, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func castTarget(args []interface{}) (string, bool) {
+	if len(args) < 2 {
+		return "", false
+	}
+	name, ok := args[1].(string)
+	if !ok {
+		return "", false
+	}
+	target, ok := castTypeNames[strings.ToLower(name)]
+	return target, ok
+}
+
+// Cast(val,type) is what CAST(val AS type) is translated into
+func (*functor) Cast(args []interface{}) interface{} {
+	target, ok := castTarget(args)
+	if !ok {
+		if len(args) < 2 {
+			panic(&CastError{Type: "unknown type"})
+		}
+		panic(&CastError{Value: args[0], Type: fmt.Sprint(args[1])})
+	}
+	ret, ok := castValue(args[0], target)
+	if !ok {
+		panic(&CastError{Value: args[0], Type: target})
+	}
+	return ret
+}
+
+// TryCast(val,type) is what TRY_CAST(val AS type) is translated into
+func (*functor) TryCast(args []interface{}) interface{} {
+	target, ok := castTarget(args)
+	if !ok {
+		return nil
+	}
+	if ret, ok := castValue(args[0], target); ok {
+		return ret
+	}
+	return nil
+}
+
+func (*functor) Bool(args []interface{}) interface{} {
+	if len(args) < 1 {
+		return nil
+	}
+	if ret, ok := castValue(args[0], typeBool); ok {
+		return ret
+	}
+	return nil
+}
+
+// TypeOf returns the json type name of val: null, bool, number, string, array or object
+func (*functor) TypeOf(args []interface{}) interface{} {
+	if len(args) < 1 {
+		return nil
+	}
+	switch kind := kindOf(args[0]); kind {
+	case typeInt, typeFloat:
+		return "number"
+	case "":
+		return "unknown"
+	default:
+		return kind
+	}
+}
+
+func (*functor) Coalesce(args []interface{}) interface{} {
+	for _, arg := range args {
+		if arg != nil {
+			return arg
+		}
+	}
+	return nil
+}
+
+func (*functor) IsNumber(args []interface{}) interface{} {
+	if len(args) < 1 {
+		return false
+	}
+	kind := kindOf(args[0])
+	return kind == typeInt || kind == typeFloat
+}
+
+func (*functor) IsString(args []interface{}) interface{} {
+	if len(args) < 1 {
+		return false
+	}
+	_, ok := args[0].(string)
+	return ok
+}
+
+func (*functor) IsBool(args []interface{}) interface{} {
+	if len(args) < 1 {
+		return false
+	}
+	_, ok := args[0].(bool)
+	return ok
+}
@@ -1,8 +1,10 @@
 package function
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 )
 
 type Functions interface {
@@ -12,8 +14,15 @@ type Functions interface {
 	Call(name string, args []interface{}) interface{}
 }
 
+// CallSites names the call sites of stateful functions parsed with the functions, see NewFunctions
+type CallSites interface {
+	CallSite(text string) string
+}
+
 type functions struct {
-	funcs map[string]func(value []interface{}) interface{}
+	funcs     map[string]func(value []interface{}) interface{}
+	sitesLock sync.Mutex
+	sites     map[string]int //numbers of the call sites parsed by text
 }
 
 var DefaultFunctions Functions
@@ -24,8 +33,20 @@ func init() {
 	}
 	DefaultFunctions = NewFunctions()
 	DefaultFunctions.Init(&defaultFunctor)
+
+	//sql style names which can not be go method names
+	DefaultFunctions.RegisterFunc("try_cast", defaultFunctor.TryCast).
+		RegisterFunc("is_number", defaultFunctor.IsNumber).
+		RegisterFunc("is_string", defaultFunctor.IsString).
+		RegisterFunc("is_bool", defaultFunctor.IsBool).
+		RegisterFunc("regex_extract", defaultFunctor.RegexExtract).
+		RegisterFunc("regex_extract_all", defaultFunctor.RegexExtractAll).
+		RegisterFunc("regex_replace", defaultFunctor.RegexReplace).
+		RegisterFunc("regex_split", defaultFunctor.RegexSplit)
 }
 
+// NewFunctions returns empty functions, which are also CallSites: the call sites of the same text are named
+// text, text#2, text#3... in the order they are parsed, so that each keeps its own state
 func NewFunctions() Functions {
 	return &functions{funcs: make(map[string]func(value []interface{}) interface{})}
 }
@@ -45,6 +66,19 @@ func (fs *functions) RegisterFunc(name string, f func([]interface{}) interface{}
 	return fs
 }
 
+func (fs *functions) CallSite(text string) string {
+	fs.sitesLock.Lock()
+	defer fs.sitesLock.Unlock()
+	if fs.sites == nil {
+		fs.sites = make(map[string]int)
+	}
+	fs.sites[text]++
+	if n := fs.sites[text]; n > 1 {
+		return fmt.Sprintf("%s#%d", text, n)
+	}
+	return text
+}
+
 func (fs *functions) Exists(name string) bool {
 	_, ok := fs.funcs[strings.ToLower(name)]
 	return ok
@@ -0,0 +1,196 @@
+package function
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAverageSkipsNil(t *testing.T) {
+	ret := DefaultFunctions.Call("average", []interface{}{[]interface{}{1.0, nil, 3.0}})
+	if ret != 2.0 {
+		t.Error(ret)
+	}
+
+	ret = DefaultFunctions.Call("average", []interface{}{1.0, nil, 3.0, nil})
+	if ret != 2.0 {
+		t.Error(ret)
+	}
+
+	ret = DefaultFunctions.Call("average", []interface{}{[]interface{}{nil}})
+	if ret != nil {
+		t.Error(ret)
+	}
+}
+
+func TestNumericFunctions(t *testing.T) {
+	cases := []struct {
+		name string
+		args []interface{}
+		want interface{}
+	}{
+		{"round", []interface{}{2.345, 2}, 2.35},
+		{"round", []interface{}{-2.5}, -3.0},
+		{"trunc", []interface{}{-2.7}, -2.0},
+		{"ln", []interface{}{math.E}, 1.0},
+		{"log", []interface{}{2, 8}, 3.0},
+		{"log10", []interface{}{1000}, 3.0},
+		{"sign", []interface{}{-0.1}, int64(-1)},
+		{"mod", []interface{}{7, 3}, int64(1)},
+		{"mod", []interface{}{7.5, 2}, 1.5},
+		{"mod", []interface{}{7, 0}, nil},
+		{"clamp", []interface{}{15, 0, 10}, 10.0},
+		{"median", []interface{}{[]interface{}{5.0, 1.0, 3.0, 2.0}}, 2.5},
+		{"median", []interface{}{5, 1, nil, 3}, 3.0},
+		{"percentile", []interface{}{[]interface{}{1.0, 2.0, 3.0, 4.0, 5.0}, 25}, 2.0},
+		{"percentile", []interface{}{1, 2, 3, 4, 5, 100}, 5.0},
+		{"variance", []interface{}{2, 4, 4, 4, 5, 5, 7, 9}, 4.0},
+		{"stddev", []interface{}{[]interface{}{2, 4, 4, 4, 5, 5, 7, 9}}, 2.0},
+		{"mode", []interface{}{[]interface{}{3.0, 1.0, 3.0, 2.0, 1.0}}, 1.0},
+		{"median", []interface{}{}, nil},
+	}
+
+	for _, c := range cases {
+		ret := DefaultFunctions.Call(c.name, c.args)
+		if f, ok := ret.(float64); ok {
+			if w, ok := c.want.(float64); ok && math.Abs(f-w) < DIFF {
+				continue
+			}
+		} else if ret == c.want {
+			continue
+		}
+		t.Errorf("%s%v = %v, want %v", c.name, c.args, ret, c.want)
+	}
+}
+
+func TestNumericFunctionsOnArray(t *testing.T) {
+	ret, ok := DefaultFunctions.Call("round", []interface{}{[]interface{}{1.26, nil, 2.71}, 1}).([]interface{})
+	if !ok || len(ret) != 3 || ret[0] != 1.3 || ret[1] != nil || ret[2] != 2.7 {
+		t.Error(ret)
+	}
+
+	r, ok := DefaultFunctions.Call("random", []interface{}{5, 6}).(float64)
+	if !ok || r < 5 || r >= 6 {
+		t.Error(r)
+	}
+}
+
+func TestCast(t *testing.T) {
+	cases := []struct {
+		val    interface{}
+		target string
+		want   interface{}
+		ok     bool
+	}{
+		{nil, "int", nil, true},
+		{true, "int", int64(1), true},
+		{3.9, "int", int64(3), true},
+		{" 42 ", "integer", int64(42), true},
+		{"4.5", "int", int64(4), true},
+		{"abc", "int", nil, false},
+		{math.Inf(1), "int", nil, false},
+		{false, "float", 0.0, true},
+		{int64(2), "double", 2.0, true},
+		{"1e3", "float", 1000.0, true},
+		{true, "string", "true", true},
+		{int64(7), "varchar", "7", true},
+		{2.5, "string", "2.5", true},
+		{[]interface{}{1.0, "a"}, "string", `[1,"a"]`, true},
+		{map[string]interface{}{"a": 1.0}, "string", `{"a":1}`, true},
+		{0.0, "bool", false, true},
+		{"TRUE", "boolean", true, true},
+		{"yes", "bool", nil, false},
+		{[]interface{}{}, "int", nil, false},
+	}
+
+	for _, c := range cases {
+		ret := DefaultFunctions.Call("try_cast", []interface{}{c.val, c.target})
+		if ret != c.want {
+			t.Errorf("try_cast(%v as %s) = %v, want %v", c.val, c.target, ret, c.want)
+		}
+
+		func() {
+			defer func() {
+				err := recover()
+				if _, isCastErr := err.(*CastError); isCastErr == c.ok {
+					t.Errorf("cast(%v as %s) panic %v", c.val, c.target, err)
+				}
+			}()
+			ret = DefaultFunctions.Call("cast", []interface{}{c.val, c.target})
+			if ret != c.want {
+				t.Errorf("cast(%v as %s) = %v, want %v", c.val, c.target, ret, c.want)
+			}
+		}()
+	}
+}
+
+func TestTypeFunctions(t *testing.T) {
+	if ret := DefaultFunctions.Call("coalesce", []interface{}{nil, nil, "a", "b"}); ret != "a" {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("ifnull", []interface{}{nil, 0}); ret != 0 {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("ifnull", []interface{}{nil}); ret != true {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("typeof", []interface{}{1.5}); ret != "number" {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("typeof", []interface{}{map[string]interface{}{}}); ret != "object" {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("is_number", []interface{}{"1"}); ret != false {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("is_string", []interface{}{"1"}); ret != true {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("is_bool", []interface{}{false}); ret != true {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("bool", []interface{}{"false"}); ret != false {
+		t.Error(ret)
+	}
+}
+
+func TestRegexFunctions(t *testing.T) {
+	if ret := DefaultFunctions.Call("regex_extract", []interface{}{"id=42;id=7", `id=(\d+)`, 1}); ret != "42" {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("regex_extract", []interface{}{"id=42", `id=(\d+)`, 2}); ret != nil {
+		t.Error(ret)
+	}
+	if ret, ok := DefaultFunctions.Call("regex_extract_all", []interface{}{"id=42;id=7", `id=(\d+)`, 1}).([]interface{}); !ok || len(ret) != 2 || ret[1] != "7" {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("regex_replace", []interface{}{"a-b-c", `-(\w)`, "+$1"}); ret != "a+b+c" {
+		t.Error(ret)
+	}
+	if ret, ok := DefaultFunctions.Call("regex_split", []interface{}{"a, b,c", `,\s*`}).([]interface{}); !ok || len(ret) != 3 || ret[2] != "c" {
+		t.Error(ret)
+	}
+	if ret := DefaultFunctions.Call("regex", []interface{}{"abc", `(`}); ret != false {
+		t.Error(ret)
+	}
+}
+
+func TestRegexCache(t *testing.T) {
+	defer SetRegexCacheSize(defaultRegexCacheSize)
+	SetRegexCacheSize(2)
+
+	first, _ := CompileRegex("a")
+	_, _ = CompileRegex("b")
+	if again, _ := CompileRegex("a"); again != first {
+		t.Error("want cached pattern")
+	}
+	_, _ = CompileRegex("c") //evicts b
+	if regexps.order.Len() != 2 {
+		t.Error(regexps.order.Len())
+	}
+	if _, ok := regexps.entries["b"]; ok {
+		t.Error("want b evicted")
+	}
+	if again, _ := CompileRegex("a"); again != first {
+		t.Error("want a kept")
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"github.com/sdghchj/sql-rules-engine/utils"
 	"math"
 	"reflect"
-	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -88,27 +88,28 @@ func (*functor) Average(args []interface{}) (ret interface{}) {
 			return nil
 		}
 		valType := reflect.ValueOf(args[0])
-		var sum float64 = 0
 		switch valType.Kind() {
 		case reflect.Array, reflect.Slice:
-			length = valType.Len()
-			for i := 0; i < length; i++ {
-				sum += utils.MustGetFloat64(valType.Index(i).Interface())
-			}
-			return sum / float64(length)
+			args = toInterfaceArray(valType)
+			length = len(args)
 		default:
 			return valType.Float()
 		}
 	}
 
 	var sum float64 = 0
+	count := 0
 	for i := 0; i < length; i++ {
 		if args[i] == nil {
 			continue
 		}
 		sum += utils.MustGetFloat64(args[i])
+		count++
+	}
+	if count == 0 {
+		return nil
 	}
-	return sum / float64(length)
+	return sum / float64(count)
 }
 
 func findExtremum(args []interface{}, cmp func(val, base float64) bool) (ret interface{}) {
@@ -198,6 +199,26 @@ func (*functor) Substr(args []interface{}) (ret interface{}) {
 	return text
 }
 
+func (*functor) Upper(args []interface{}) interface{} {
+	if len(args) < 1 {
+		return nil
+	}
+	if text, ok := args[0].(string); ok {
+		return strings.ToUpper(text)
+	}
+	return nil
+}
+
+func (*functor) Lower(args []interface{}) interface{} {
+	if len(args) < 1 {
+		return nil
+	}
+	if text, ok := args[0].(string); ok {
+		return strings.ToLower(text)
+	}
+	return nil
+}
+
 func (*functor) InRange(args []interface{}) (ret interface{}) {
 	if len(args) < 3 {
 		return nil
@@ -347,25 +368,6 @@ func (*functor) Second(args []interface{}) (ret interface{}) {
 	return time.Unix(int64(utils.MustGetFloat64(args[0])), 0).Second()
 }
 
-func (*functor) Regex(args []interface{}) interface{} {
-	if len(args) < 2 || args[0] == nil || args[1] == nil {
-		return false
-	}
-
-	text, ok := args[0].(string)
-	if !ok {
-		return false
-	}
-
-	pattern, ok := args[1].(string)
-	if !ok {
-		return false
-	}
-
-	match, err := regexp.MatchString(pattern, text)
-	return err == nil && match
-}
-
 const DIFF = 0.000001
 
 func (*functor) In(args []interface{}) (ret interface{}) {
@@ -433,11 +435,9 @@ func (*functor) Int(args []interface{}) (ret interface{}) {
 		return nil
 	} else if n, err := utils.GetInt64(args[0]); err == nil {
 		return n
-	} else {
-		return int64(reflect.ValueOf(args[0]).Float())
 	}
 
-	return nil
+	return int64(reflect.ValueOf(args[0]).Float())
 }
 
 func (*functor) Float(args []interface{}) (ret interface{}) {
@@ -526,7 +526,16 @@ func (*functor) NullIf(args []interface{}) interface{} {
 	return args[0]
 }
 
+// IfNull(val,fallback) returns fallback when val is null, or val.
+// IfNull(val) keeps the legacy behaviour and returns whether val is null
 func (*functor) IfNull(args []interface{}) interface{} {
+	if len(args) >= 2 {
+		if args[0] == nil {
+			return args[1]
+		}
+		return args[0]
+	}
+
 	if len(args) < 1 || args[0] == nil {
 		return true
 	}
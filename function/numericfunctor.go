@@ -0,0 +1,375 @@
+package function
+
+import (
+	"github.com/sdghchj/sql-rules-engine/utils"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+var randomLock sync.Mutex
+
+func toInterfaceArray(valType reflect.Value) []interface{} {
+	length := valType.Len()
+	arr := make([]interface{}, length)
+	for i := 0; i < length; i++ {
+		arr[i] = valType.Index(i).Interface()
+	}
+	return arr
+}
+
+func isArray(val interface{}) bool {
+	if val == nil {
+		return false
+	}
+	switch reflect.ValueOf(val).Kind() {
+	case reflect.Array, reflect.Slice:
+		return true
+	}
+	return false
+}
+
+// collectFloat64s accepts either one array argument or variadic arguments,nil entries are skipped
+func collectFloat64s(args []interface{}) []float64 {
+	if len(args) == 1 && isArray(args[0]) {
+		args = toInterfaceArray(reflect.ValueOf(args[0]))
+	}
+	values := make([]float64, 0, len(args))
+	for _, arg := range args {
+		if arg == nil {
+			continue
+		}
+		values = append(values, utils.MustGetFloat64(arg))
+	}
+	return values
+}
+
+// mapFloat64 applies f to a number, or to every element of an array of numbers
+func mapFloat64(arg interface{}, f func(float64) interface{}) (ret interface{}) {
+	if arg == nil {
+		return nil
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			ret = nil
+		}
+	}()
+
+	if isArray(arg) {
+		arr := toInterfaceArray(reflect.ValueOf(arg))
+		for i, v := range arr {
+			if v != nil {
+				arr[i] = f(utils.MustGetFloat64(v))
+			}
+		}
+		return arr
+	}
+	return f(utils.MustGetFloat64(arg))
+}
+
+func mapFloat64Func(args []interface{}, f func(float64) float64) interface{} {
+	if len(args) < 1 {
+		return nil
+	}
+	return mapFloat64(args[0], func(x float64) interface{} {
+		return f(x)
+	})
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	n := len(sorted)
+	if n == 1 {
+		return sorted[0]
+	}
+	if p <= 0 {
+		return sorted[0]
+	} else if p >= 100 {
+		return sorted[n-1]
+	}
+	//linear interpolation between closest ranks
+	rank := p / 100 * float64(n-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func variance(values []float64) float64 {
+	n := float64(len(values))
+	var sum float64 = 0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / n
+	var sq float64 = 0
+	for _, v := range values {
+		sq += (v - mean) * (v - mean)
+	}
+	return sq / n
+}
+
+// Round(x) rounds half away from zero, Round(x,n) keeps n decimal places
+func (*functor) Round(args []interface{}) (ret interface{}) {
+	if len(args) < 1 || args[0] == nil {
+		return nil
+	}
+
+	var places float64 = 0
+	if len(args) >= 2 && args[1] != nil {
+		n, err := utils.GetFloat64(args[1])
+		if err != nil {
+			return nil
+		}
+		places = math.Trunc(n)
+	}
+	scale := math.Pow(10, places)
+	return mapFloat64(args[0], func(x float64) interface{} {
+		return math.Round(x*scale) / scale
+	})
+}
+
+func (*functor) Trunc(args []interface{}) (ret interface{}) {
+	return mapFloat64Func(args, math.Trunc)
+}
+
+// Log(x) is the natural logarithm, Log(base,x) is the logarithm of x to base
+func (*functor) Log(args []interface{}) (ret interface{}) {
+	if len(args) >= 2 {
+		if args[0] == nil {
+			return nil
+		}
+		base, err := utils.GetFloat64(args[0])
+		if err != nil {
+			return nil
+		}
+		return mapFloat64(args[1], func(x float64) interface{} {
+			return math.Log(x) / math.Log(base)
+		})
+	}
+	return mapFloat64Func(args, math.Log)
+}
+
+func (*functor) Ln(args []interface{}) (ret interface{}) {
+	return mapFloat64Func(args, math.Log)
+}
+
+func (*functor) Log10(args []interface{}) (ret interface{}) {
+	return mapFloat64Func(args, math.Log10)
+}
+
+func (*functor) Sin(args []interface{}) (ret interface{}) {
+	return mapFloat64Func(args, math.Sin)
+}
+
+func (*functor) Cos(args []interface{}) (ret interface{}) {
+	return mapFloat64Func(args, math.Cos)
+}
+
+func (*functor) Tan(args []interface{}) (ret interface{}) {
+	return mapFloat64Func(args, math.Tan)
+}
+
+func (*functor) Asin(args []interface{}) (ret interface{}) {
+	return mapFloat64Func(args, math.Asin)
+}
+
+func (*functor) Acos(args []interface{}) (ret interface{}) {
+	return mapFloat64Func(args, math.Acos)
+}
+
+func (*functor) Atan(args []interface{}) (ret interface{}) {
+	return mapFloat64Func(args, math.Atan)
+}
+
+func (*functor) Atan2(args []interface{}) (ret interface{}) {
+	if len(args) < 2 || args[0] == nil || args[1] == nil {
+		return nil
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			ret = nil
+		}
+	}()
+
+	return math.Atan2(utils.MustGetFloat64(args[0]), utils.MustGetFloat64(args[1]))
+}
+
+func (*functor) Sign(args []interface{}) (ret interface{}) {
+	if len(args) < 1 {
+		return nil
+	}
+	return mapFloat64(args[0], func(x float64) interface{} {
+		if x > 0 {
+			return int64(1)
+		} else if x < 0 {
+			return int64(-1)
+		}
+		return int64(0)
+	})
+}
+
+// Mod returns an integer when both operands are integers, or else the float remainder
+func (*functor) Mod(args []interface{}) (ret interface{}) {
+	if len(args) < 2 || args[0] == nil || args[1] == nil {
+		return nil
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			ret = nil
+		}
+	}()
+
+	if x, err := utils.GetInt64(args[0]); err == nil {
+		if y, err := utils.GetInt64(args[1]); err == nil {
+			if y == 0 {
+				return nil
+			}
+			return x % y
+		}
+	}
+
+	y := utils.MustGetFloat64(args[1])
+	if y == 0 {
+		return nil
+	}
+	return math.Mod(utils.MustGetFloat64(args[0]), y)
+}
+
+// Clamp(x,min,max) limits x to the range [min,max]
+func (*functor) Clamp(args []interface{}) (ret interface{}) {
+	if len(args) < 3 || args[0] == nil || args[1] == nil || args[2] == nil {
+		return nil
+	}
+
+	min, err := utils.GetFloat64(args[1])
+	if err != nil {
+		return nil
+	}
+	max, err := utils.GetFloat64(args[2])
+	if err != nil {
+		return nil
+	}
+	return mapFloat64(args[0], func(x float64) interface{} {
+		return math.Max(min, math.Min(max, x))
+	})
+}
+
+// Random() returns a float in [0,1), Random(min,max) returns a float in [min,max)
+func (*functor) Random(args []interface{}) (ret interface{}) {
+	randomLock.Lock()
+	r := random.Float64()
+	randomLock.Unlock()
+
+	if len(args) >= 2 {
+		min, err := utils.GetFloat64(args[0])
+		if err != nil {
+			return nil
+		}
+		max, err := utils.GetFloat64(args[1])
+		if err != nil {
+			return nil
+		}
+		return min + r*(max-min)
+	}
+	return r
+}
+
+func (*functor) Median(args []interface{}) (ret interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			ret = nil
+		}
+	}()
+
+	values := collectFloat64s(args)
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+	return percentile(values, 50)
+}
+
+// Percentile(array,p) or Percentile(num1,num2,num3...,p), p is in [0,100]
+func (*functor) Percentile(args []interface{}) (ret interface{}) {
+	length := len(args)
+	if length < 2 || args[length-1] == nil {
+		return nil
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			ret = nil
+		}
+	}()
+
+	p := utils.MustGetFloat64(args[length-1])
+	values := collectFloat64s(args[:length-1])
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+	return percentile(values, p)
+}
+
+// Variance returns the population variance
+func (*functor) Variance(args []interface{}) (ret interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			ret = nil
+		}
+	}()
+
+	values := collectFloat64s(args)
+	if len(values) == 0 {
+		return nil
+	}
+	return variance(values)
+}
+
+// Stddev returns the population standard deviation
+func (*functor) Stddev(args []interface{}) (ret interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			ret = nil
+		}
+	}()
+
+	values := collectFloat64s(args)
+	if len(values) == 0 {
+		return nil
+	}
+	return math.Sqrt(variance(values))
+}
+
+// Mode returns the most frequent value, the smallest one wins a tie
+func (*functor) Mode(args []interface{}) (ret interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			ret = nil
+		}
+	}()
+
+	values := collectFloat64s(args)
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+	mode, best, count := values[0], 0, 0
+	for i, v := range values {
+		if i > 0 && v == values[i-1] {
+			count++
+		} else {
+			count = 1
+		}
+		if count > best {
+			mode, best = v, count
+		}
+	}
+	return mode
+}
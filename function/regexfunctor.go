@@ -0,0 +1,232 @@
+package function
+
+import (
+	"container/list"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const defaultRegexCacheSize = 256
+
+// regexCache is a bounded LRU cache of compiled patterns shared by all the regex functions
+type regexCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type regexCacheEntry struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+var regexps = &regexCache{size: defaultRegexCacheSize, entries: map[string]*list.Element{}, order: list.New()}
+
+// patternFunctions take a regex pattern as the second argument, which is compiled once when it is a literal
+var patternFunctions = map[string]bool{
+	"regex":             true,
+	"regex_extract":     true,
+	"regex_extract_all": true,
+	"regex_replace":     true,
+	"regex_split":       true,
+}
+
+func (c *regexCache) get(pattern string) (*regexp.Regexp, error) {
+	c.lock.Lock()
+	if elem, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(elem)
+		c.lock.Unlock()
+		return elem.Value.(*regexCacheEntry).re, nil
+	}
+	c.lock.Unlock()
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*regexCacheEntry).re, nil
+	}
+	c.entries[pattern] = c.order.PushFront(&regexCacheEntry{pattern: pattern, re: re})
+	c.evict()
+	return re, nil
+}
+
+func (c *regexCache) evict() {
+	for c.order.Len() > c.size && c.order.Len() > 0 {
+		elem := c.order.Back()
+		c.order.Remove(elem)
+		delete(c.entries, elem.Value.(*regexCacheEntry).pattern)
+	}
+}
+
+// SetRegexCacheSize changes how many compiled patterns are kept, 256 by default
+func SetRegexCacheSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	regexps.lock.Lock()
+	regexps.size = size
+	regexps.evict()
+	regexps.lock.Unlock()
+}
+
+// CompileRegex compiles pattern through the shared LRU cache
+func CompileRegex(pattern string) (*regexp.Regexp, error) {
+	return regexps.get(pattern)
+}
+
+// IsPatternFunction reports whether the second argument of the function is a regex pattern
+func IsPatternFunction(name string) bool {
+	return patternFunctions[strings.ToLower(name)]
+}
+
+// getRegex accepts either a pattern text or an already compiled *regexp.Regexp
+func getRegex(arg interface{}) *regexp.Regexp {
+	switch pattern := arg.(type) {
+	case *regexp.Regexp:
+		return pattern
+	case string:
+		re, err := CompileRegex(pattern)
+		if err != nil {
+			return nil
+		}
+		return re
+	}
+	return nil
+}
+
+func getGroup(args []interface{}, index int) (int, bool) {
+	if len(args) <= index || args[index] == nil {
+		return 0, true
+	}
+	n, ok := toInt64(args[index])
+	if !ok {
+		f, ok := toFloat64(args[index])
+		if !ok {
+			return 0, false
+		}
+		n = int64(f)
+	}
+	return int(n), n >= 0
+}
+
+func (*functor) Regex(args []interface{}) interface{} {
+	if len(args) < 2 || args[0] == nil || args[1] == nil {
+		return false
+	}
+
+	text, ok := args[0].(string)
+	if !ok {
+		return false
+	}
+
+	re := getRegex(args[1])
+	return re != nil && re.MatchString(text)
+}
+
+// RegexExtract(text,pattern,group) returns the group of the first match, the whole match when group is omitted
+func (*functor) RegexExtract(args []interface{}) interface{} {
+	if len(args) < 2 || args[0] == nil || args[1] == nil {
+		return nil
+	}
+
+	text, ok := args[0].(string)
+	if !ok {
+		return nil
+	}
+	re := getRegex(args[1])
+	if re == nil {
+		return nil
+	}
+	group, ok := getGroup(args, 2)
+	if !ok || group > re.NumSubexp() {
+		return nil
+	}
+
+	match := re.FindStringSubmatchIndex(text)
+	if match == nil || match[2*group] < 0 {
+		return nil
+	}
+	return text[match[2*group]:match[2*group+1]]
+}
+
+// RegexExtractAll(text,pattern,group) returns the group of every match
+func (*functor) RegexExtractAll(args []interface{}) interface{} {
+	if len(args) < 2 || args[0] == nil || args[1] == nil {
+		return nil
+	}
+
+	text, ok := args[0].(string)
+	if !ok {
+		return nil
+	}
+	re := getRegex(args[1])
+	if re == nil {
+		return nil
+	}
+	group, ok := getGroup(args, 2)
+	if !ok || group > re.NumSubexp() {
+		return nil
+	}
+
+	ret := []interface{}{}
+	for _, match := range re.FindAllStringSubmatchIndex(text, -1) {
+		if match[2*group] < 0 {
+			ret = append(ret, nil)
+		} else {
+			ret = append(ret, text[match[2*group]:match[2*group+1]])
+		}
+	}
+	return ret
+}
+
+// RegexReplace(text,pattern,repl) replaces every match, $1 or ${name} in repl refer to groups
+func (*functor) RegexReplace(args []interface{}) interface{} {
+	if len(args) < 3 || args[0] == nil || args[1] == nil || args[2] == nil {
+		return nil
+	}
+
+	text, ok := args[0].(string)
+	if !ok {
+		return nil
+	}
+	repl, ok := args[2].(string)
+	if !ok {
+		return nil
+	}
+	re := getRegex(args[1])
+	if re == nil {
+		return nil
+	}
+	return re.ReplaceAllString(text, repl)
+}
+
+// RegexSplit(text,pattern) splits text around every match
+func (*functor) RegexSplit(args []interface{}) interface{} {
+	if len(args) < 2 || args[0] == nil || args[1] == nil {
+		return nil
+	}
+
+	text, ok := args[0].(string)
+	if !ok {
+		return nil
+	}
+	re := getRegex(args[1])
+	if re == nil {
+		return nil
+	}
+
+	parts := re.Split(text, -1)
+	ret := make([]interface{}, len(parts))
+	for i, part := range parts {
+		ret[i] = part
+	}
+	return ret
+}
@@ -0,0 +1,194 @@
+package function
+
+import (
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/state"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statefulFunctions receive the name of their call site as a hidden last argument from the resolver,
+// which is the text of the call expression numbered by CallSites, so that every call site keeps its own state
+var statefulFunctions = map[string]bool{
+	"lag":        true,
+	"delta":      true,
+	"rate":       true,
+	"changed":    true,
+	"first_seen": true,
+}
+
+// IsStatefulFunction reports whether the function needs the text of its call expression as the last argument
+func IsStatefulFunction(name string) bool {
+	return statefulFunctions[strings.ToLower(name)]
+}
+
+// Scratch keeps the states written by stateful functions in evaluations which must leave their store unchanged,
+// such as traces. The states not written into it are read from the store.
+type Scratch struct {
+	lock   sync.Mutex
+	states map[string]interface{}
+}
+
+func NewScratch() *Scratch {
+	return &Scratch{states: map[string]interface{}{}}
+}
+
+func (s *Scratch) swap(store state.Store, key string, value interface{}) (old interface{}, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if old, ok = s.states[key]; !ok {
+		old, ok = store.Get(key)
+	}
+	s.states[key] = value
+	return old, ok
+}
+
+// ScratchSite is passed to a stateful function as the hidden last argument instead of the name of its call site,
+// so that it is evaluated against Scratch
+type ScratchSite struct {
+	Site    string
+	Scratch *Scratch
+}
+
+type statefulFunctor struct {
+	store state.Store
+	scope func() string
+}
+
+// RegisterStatefulFuncs registers lag, delta, rate, changed and first_seen into funcs.
+// Their states are kept in store under the keys of scope, call site and partition key,
+// scope is called on every call, usually returning the rule name.
+func RegisterStatefulFuncs(funcs Functions, store state.Store, scope func() string) Functions {
+	f := &statefulFunctor{store: store, scope: scope}
+	return funcs.RegisterFunc("lag", f.Lag).
+		RegisterFunc("delta", f.Delta).
+		RegisterFunc("rate", f.Rate).
+		RegisterFunc("changed", f.Changed).
+		RegisterFunc("first_seen", f.FirstSeen)
+}
+
+// split removes the hidden call site argument, and returns the partition key at index of the remaining arguments,
+// with the scratch of the call site if any
+func (f *statefulFunctor) split(args []interface{}, keyIndex int) (values []interface{}, key string, scratch *Scratch, ok bool) {
+	if len(args) == 0 {
+		return nil, "", nil, false
+	}
+	var site string
+	switch v := args[len(args)-1].(type) {
+	case string:
+		site = v
+	case *ScratchSite:
+		site, scratch = v.Site, v.Scratch
+	default:
+		return nil, "", nil, false
+	}
+	values = args[:len(args)-1]
+
+	var partition interface{}
+	if len(values) > keyIndex {
+		partition = values[keyIndex]
+	}
+	scope := ""
+	if f.scope != nil {
+		scope = f.scope()
+	}
+	return values, fmt.Sprintf("%s|%s|%v", scope, site, partition), scratch, true
+}
+
+// swapState stores value under key into scratch if any, or into the store, and returns the previous value
+func (f *statefulFunctor) swapState(scratch *Scratch, key string, value interface{}) (old interface{}, ok bool) {
+	if scratch != nil {
+		return scratch.swap(f.store, key, value)
+	}
+	return f.store.Swap(key, value)
+}
+
+// swap stores the current value of the call and returns the previous one, nil is never stored
+func (f *statefulFunctor) swap(args []interface{}, keyIndex int) (cur, prev interface{}, ok bool) {
+	values, key, scratch, ok := f.split(args, keyIndex)
+	if !ok || len(values) == 0 || values[0] == nil || f.store == nil {
+		return nil, nil, false
+	}
+	prev, ok = f.swapState(scratch, key, values[0])
+	return values[0], prev, ok
+}
+
+// Lag(expr,key) returns the value of expr in the previous message of the partition key, key is optional
+func (f *statefulFunctor) Lag(args []interface{}) interface{} {
+	_, prev, _ := f.swap(args, 1)
+	return prev
+}
+
+// Delta(expr,key) returns the difference between the current and the previous value of expr
+func (f *statefulFunctor) Delta(args []interface{}) interface{} {
+	cur, prev, ok := f.swap(args, 1)
+	if !ok {
+		return nil
+	}
+	x, okx := toFloat64(cur)
+	y, oky := toFloat64(prev)
+	if !okx || !oky {
+		return nil
+	}
+	return x - y
+}
+
+// Rate(expr,ts,key) returns the change of expr per unit of ts, ts defaults to the current unix time in seconds
+func (f *statefulFunctor) Rate(args []interface{}) interface{} {
+	values, key, scratch, ok := f.split(args, 2)
+	if !ok || len(values) == 0 || values[0] == nil || f.store == nil {
+		return nil
+	}
+	cur, ok := toFloat64(values[0])
+	if !ok {
+		return nil
+	}
+	ts := float64(time.Now().UnixNano()) / float64(time.Second)
+	if len(values) > 1 && values[1] != nil {
+		if ts, ok = toFloat64(values[1]); !ok {
+			return nil
+		}
+	}
+
+	old, ok := f.swapState(scratch, key, []interface{}{cur, ts})
+	if !ok {
+		return nil
+	}
+	prev, ok := old.([]interface{})
+	if !ok || len(prev) != 2 {
+		return nil
+	}
+	prevValue, okv := toFloat64(prev[0])
+	prevTs, okt := toFloat64(prev[1])
+	if !okv || !okt || ts == prevTs {
+		return nil
+	}
+	return (cur - prevValue) / (ts - prevTs)
+}
+
+// Changed(expr,key) returns whether expr differs from its previous value, it is false for the first value
+func (f *statefulFunctor) Changed(args []interface{}) interface{} {
+	cur, prev, ok := f.swap(args, 1)
+	if !ok {
+		return false
+	}
+	if x, okx := toFloat64(cur); okx {
+		if y, oky := toFloat64(prev); oky {
+			return math.Abs(x-y) >= DIFF
+		}
+	}
+	return !reflect.DeepEqual(cur, prev)
+}
+
+// FirstSeen(key) returns whether the partition key is seen for the first time
+func (f *statefulFunctor) FirstSeen(args []interface{}) interface{} {
+	_, key, scratch, ok := f.split(args, 0)
+	if !ok || f.store == nil {
+		return nil
+	}
+	_, seen := f.swapState(scratch, key, true)
+	return !seen
+}
@@ -0,0 +1,46 @@
+package function
+
+import (
+	"github.com/sdghchj/sql-rules-engine/utils"
+	"strings"
+)
+
+// Topical is an object published to a topic, such as a message delivered by an action
+type Topical interface {
+	MessageTopic() string
+}
+
+// rootFunctions receive the object being evaluated as a hidden last argument from the resolver
+var rootFunctions = map[string]bool{
+	"topic": true,
+}
+
+// IsRootFunction reports whether the function needs the object being evaluated as the last argument
+func IsRootFunction(name string) bool {
+	return rootFunctions[strings.ToLower(name)]
+}
+
+// Topic returns the level n (from 1) of the topic of the object being evaluated, or the whole topic without n.
+// It returns null for the objects which are not Topical, or when the topic has no level n.
+func (*functor) Topic(args []interface{}) interface{} {
+	if len(args) == 0 {
+		return nil
+	}
+	msg, ok := args[len(args)-1].(Topical)
+	if !ok {
+		return nil
+	}
+	topic := msg.MessageTopic()
+	if len(args) == 1 {
+		return topic
+	}
+	n, err := utils.GetInt64(args[0])
+	if err != nil {
+		return nil
+	}
+	levels := strings.Split(topic, "/")
+	if n < 1 || n > int64(len(levels)) {
+		return nil
+	}
+	return levels[n-1]
+}
@@ -1,5 +1,7 @@
 package handler
 
+import "context"
+
 type EventHandler func(obj interface{}) interface{}
 type AsyncEventHandler func(obj interface{})
 
@@ -7,3 +9,23 @@ type Handler interface {
 	Handle(obj interface{}) interface{}
 	HandleAsync(obj interface{})
 }
+
+// ContextHandler is a handler which can be cancelled, it returns nil with the error of ctx once ctx is done
+type ContextHandler interface {
+	HandleContext(ctx context.Context, obj interface{}) (interface{}, error)
+}
+
+// HandleContext handles obj by h with ctx when h is a ContextHandler, or by Handle when ctx is not done yet
+func HandleContext(ctx context.Context, h Handler, obj interface{}) (interface{}, error) {
+	if ch, ok := h.(ContextHandler); ok {
+		return ch.HandleContext(ctx, obj)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return h.Handle(obj), nil
+}
+
+// Results is returned by a handler which fans one input out into several outputs,
+// the following handlers take each element of it as a row
+type Results []interface{}
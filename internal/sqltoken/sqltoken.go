@@ -0,0 +1,67 @@
+package sqltoken
+
+import (
+	"go/scanner"
+	"go/token"
+	"strings"
+)
+
+// Token is a token of sql scanned as go, its Tok and Lit are rewritten in place by the parsers
+type Token struct {
+	Pos token.Pos
+	Tok token.Token
+	Lit string
+}
+
+// Scan returns the tokens of text and the file set of their positions
+func Scan(text string) ([]*Token, *token.FileSet) {
+	var tokens []*Token
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(text))
+	s.Init(file, []byte(text), nil, 0)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		} else if tok != token.SEMICOLON { //SEMICOLON means \n
+			tokens = append(tokens, &Token{pos, tok, lit})
+		}
+	}
+	return tokens, fset
+}
+
+// RewriteCast translates CAST(x AS type) and TRY_CAST(x AS type) of tokens into cast(x,"type") and try_cast(x,"type"),
+// so that AS inside them is not taken as an alias. It returns whether any cast is rewritten, and the index of an AS
+// inside a cast not followed by a type, or -1.
+func RewriteCast(tokens []*Token) (need bool, bad int) {
+	var casts []int //paren depths of the open cast calls
+	depth := 0
+	length := len(tokens)
+	for i := 0; i < length; i++ {
+		switch tokens[i].Tok {
+		case token.IDENT:
+			if (strings.EqualFold(tokens[i].Lit, "cast") || strings.EqualFold(tokens[i].Lit, "try_cast")) && i+1 < length {
+				if tokens[i+1].Tok == token.LPAREN {
+					casts = append(casts, depth+1)
+				}
+			} else if strings.EqualFold(tokens[i].Lit, "as") && len(casts) > 0 && casts[len(casts)-1] == depth {
+				if i+1 >= length || tokens[i+1].Tok != token.IDENT {
+					return need, i
+				}
+				tokens[i].Tok, tokens[i].Lit = token.COMMA, ","
+				tokens[i+1].Tok, tokens[i+1].Lit = token.STRING, `"`+tokens[i+1].Lit+`"`
+				i++
+				need = true
+			}
+		case token.LPAREN:
+			depth++
+		case token.RPAREN:
+			if len(casts) > 0 && casts[len(casts)-1] == depth {
+				casts = casts[:len(casts)-1]
+			}
+			depth--
+		}
+	}
+	return need, -1
+}
@@ -0,0 +1,43 @@
+package sqltoken
+
+import (
+	"testing"
+)
+
+func TestRewriteCast(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+		need bool
+		bad  int
+	}{
+		{"a as b", "aasb", false, -1},
+		{"CAST(a AS int) as b", `CAST(a,"int")asb`, true, -1},
+		{"try_cast(cast(a as text) as float)", `try_cast(cast(a,"text"),"float")`, true, -1},
+		{"cast((a) as int)", `cast((a),"int")`, true, -1},
+		{"cast(a as 1)", "", false, 3},
+		{"cast(a as", "", false, 3},
+	}
+	for _, c := range cases {
+		tokens, _ := Scan(c.text)
+		need, bad := RewriteCast(tokens)
+		if need != c.need || bad != c.bad {
+			t.Error(c.text, need, bad)
+			continue
+		}
+		if bad >= 0 {
+			continue
+		}
+		text := ""
+		for _, tok := range tokens {
+			if tok.Lit == "" {
+				text += tok.Tok.String()
+			} else {
+				text += tok.Lit
+			}
+		}
+		if text != c.want {
+			t.Error(c.text, text)
+		}
+	}
+}
@@ -1,8 +1,14 @@
 package mapper
 
 import (
+	"context"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/function"
+	"github.com/sdghchj/sql-rules-engine/handler"
 	"github.com/sdghchj/sql-rules-engine/parser"
 	"github.com/sdghchj/sql-rules-engine/utils"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -11,6 +17,25 @@ type FieldValueConverter interface {
 	ConvertToPath() string
 }
 
+// contextValueConverter is a FieldValueConverter whose evaluation can be cancelled
+type contextValueConverter interface {
+	ConvertValueContext(ctx context.Context, obj interface{}) (interface{}, error)
+}
+
+// convertValue converts obj by v with ctx, a nil ctx is never done
+func convertValue(ctx context.Context, v FieldValueConverter, obj interface{}) (interface{}, error) {
+	if ctx == nil {
+		return v.ConvertValue(obj), nil
+	}
+	if cv, ok := v.(contextValueConverter); ok {
+		return cv.ConvertValueContext(ctx, obj)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.ConvertValue(obj), nil
+}
+
 type fromCurrentTimestampFieldValue struct {
 	toPath  string
 	convert func(interface{}) interface{}
@@ -65,6 +90,16 @@ func (v *funcFieldValueConverter) ConvertValue(obj interface{}) interface{} {
 	return val
 }
 
+func (v *funcFieldValueConverter) ConvertValueContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	if v.resolver != nil && v.fromPath != "*" && !utils.IsLiteralString(v.fromPath) && !utils.IsLiteralNumber(v.fromPath) {
+		return v.resolver.EvaluateContext(ctx, obj)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.ConvertValue(obj), nil
+}
+
 func (v *funcFieldValueConverter) ConvertToPath() string {
 	if v.toPath != "" {
 		return v.toPath
@@ -101,6 +136,188 @@ func (v *fromMultipleFieldValue) ConvertValue(obj interface{}) interface{} {
 	return v.convert(values)
 }
 
+func (v *fromMultipleFieldValue) ConvertValueContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	if len(v.fromPaths) == 0 || v.convert == nil {
+		return nil, ctx.Err()
+	}
+	values := make([]interface{}, 0, len(v.fromPaths))
+	for path, resolver := range v.fromPaths {
+		var val interface{}
+		if path == "*" {
+			val = obj
+		} else if resolver != nil {
+			var err error
+			if val, err = resolver.EvaluateContext(ctx, obj); err != nil {
+				return nil, err
+			}
+		} else {
+			val = utils.GetByPath(obj, path)
+		}
+		values = append(values, val)
+	}
+	return v.convert(values), nil
+}
+
 func (v *fromMultipleFieldValue) ConvertToPath() string {
 	return v.toPath
 }
+
+type templateFieldValue struct {
+	template *parser.Template
+	toPath   string
+}
+
+func (v *templateFieldValue) ConvertValue(obj interface{}) interface{} {
+	return v.template.Render(obj)
+}
+
+func (v *templateFieldValue) ConvertValueContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	text, err := v.template.RenderContext(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	return text, nil
+}
+
+func (v *templateFieldValue) ConvertToPath() string {
+	return v.toPath
+}
+
+type handlerFieldValue struct {
+	handler handler.Handler
+	toPath  string
+}
+
+func (v *handlerFieldValue) ConvertValue(obj interface{}) interface{} {
+	return v.handler.Handle(obj)
+}
+
+func (v *handlerFieldValue) ConvertValueContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	return handler.HandleContext(ctx, v.handler, obj)
+}
+
+func (v *handlerFieldValue) ConvertToPath() string {
+	return v.toPath
+}
+
+// starFieldValue is SELECT * EXCEPT (...) REPLACE (...), a deep copy of the input without the excepted paths
+// and with the replaced paths
+type starFieldValue struct {
+	excepts  []string
+	replaces []FieldValueConverter
+}
+
+func (v *starFieldValue) ConvertValue(obj interface{}) interface{} {
+	ret, _ := v.ConvertValueContext(nil, obj)
+	return ret
+}
+
+func (v *starFieldValue) ConvertValueContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	ret, ok := utils.Plain(obj).(map[string]interface{}) //a deep copy, of a struct as well
+	if !ok {
+		return nil, nil
+	}
+	for _, path := range v.excepts {
+		utils.DeleteByPath(ret, path)
+	}
+	for _, replace := range v.replaces {
+		val, err := convertValue(ctx, replace, obj)
+		if err != nil {
+			return nil, err
+		}
+		if val != nil {
+			utils.SetByPath(ret, replace.ConvertToPath(), val)
+		} else {
+			utils.DeleteByPath(ret, replace.ConvertToPath())
+		}
+	}
+	return ret, nil
+}
+
+func (v *starFieldValue) ConvertToPath() string {
+	return "*"
+}
+
+type explainer interface {
+	Explain() string
+}
+
+type tracer interface {
+	Trace(obj interface{}) *parser.TraceNode
+}
+
+// explainField describes the source of the value of a field, with the functions it calls
+func explainField(v FieldValueConverter) (string, []parser.Function) {
+	switch f := v.(type) {
+	case *fromCurrentTimestampFieldValue:
+		return "CURRENT_TIMESTAMP", nil
+	case *constantFieldValue:
+		return parser.FormatValue(f.value), nil
+	case *funcFieldValueConverter:
+		if f.resolver != nil && f.fromPath != "*" && !utils.IsLiteralString(f.fromPath) && !utils.IsLiteralNumber(f.fromPath) {
+			return f.resolver.String(), f.resolver.Functions()
+		}
+		return f.fromPath, nil
+	case *fromMultipleFieldValue:
+		paths := make([]string, 0, len(f.fromPaths))
+		var funcs []parser.Function
+		for path, resolver := range f.fromPaths {
+			paths = append(paths, path)
+			if resolver != nil {
+				funcs = append(funcs, resolver.Functions()...)
+			}
+		}
+		sort.Strings(paths)
+		return "COMBINE(" + strings.Join(paths, ", ") + ")", funcs
+	case *templateFieldValue:
+		return "`" + f.template.String() + "`", f.template.Functions()
+	case *handlerFieldValue:
+		if e, ok := f.handler.(explainer); ok {
+			return "(\n  " + strings.Replace(e.Explain(), "\n", "\n  ", -1) + "\n)", nil
+		}
+		return "(handler)", nil
+	case *starFieldValue:
+		text := "*"
+		if len(f.excepts) > 0 {
+			text += " EXCEPT (" + strings.Join(f.excepts, ", ") + ")"
+		}
+		var funcs []parser.Function
+		if len(f.replaces) > 0 {
+			replaces := make([]string, len(f.replaces))
+			for i, replace := range f.replaces {
+				source, replaceFuncs := explainField(replace)
+				replaces[i] = source + " AS " + replace.ConvertToPath()
+				funcs = append(funcs, replaceFuncs...)
+			}
+			text += " REPLACE (" + strings.Join(replaces, ", ") + ")"
+		}
+		return text, funcs
+	}
+	return fmt.Sprintf("%T", v), nil
+}
+
+// traceValue converts the value of a field, with the evaluation of its expression
+func traceValue(v FieldValueConverter, obj interface{}) *parser.TraceNode {
+	source, _ := explainField(v)
+	node := &parser.TraceNode{Expr: source}
+	if toPath := v.ConvertToPath(); toPath != "*" {
+		node.Expr += " AS " + toPath
+	}
+	switch f := v.(type) {
+	case *funcFieldValueConverter:
+		if f.resolver != nil && f.fromPath != "*" && !utils.IsLiteralString(f.fromPath) && !utils.IsLiteralNumber(f.fromPath) {
+			eval := f.resolver.Trace(obj)
+			node.Value, node.Children = eval.Value, []*parser.TraceNode{eval}
+			return node
+		}
+	case *handlerFieldValue:
+		if t, ok := f.handler.(tracer); ok {
+			sub := t.Trace(obj)
+			node.Value, node.Children = sub.Value, []*parser.TraceNode{sub}
+			return node
+		}
+	}
+	//the states of stateful functions are left unchanged as by the traces of expressions
+	node.Value, _ = convertValue(parser.WithScratch(context.Background(), function.NewScratch()), v, obj)
+	return node
+}
@@ -1,32 +1,65 @@
 package mapper
 
 import (
+	"context"
 	"errors"
 	"github.com/sdghchj/sql-rules-engine/function"
 	"github.com/sdghchj/sql-rules-engine/handler"
 	"github.com/sdghchj/sql-rules-engine/parser"
 	"github.com/sdghchj/sql-rules-engine/utils"
+	"strings"
+	"sync"
 )
 
 var ErrInvalidFromKey = errors.New("invalid from-key")
 var ErrInvalidToKey = errors.New("invalid to-key")
 var ErrInvalidConvertingFunc = errors.New("invalid converting-function")
 var ErrNilParser = errors.New("nil parser")
+var ErrInvalidNullPolicy = errors.New("invalid null policy")
+
+// NullPolicy decides what is written for a field evaluated to null
+type NullPolicy int
+
+const (
+	NullOmit    NullPolicy = iota // the key is not written, the default
+	NullEmit                      // the key is written with a json null
+	NullDefault                   // the key is written with the default value of the field
+)
+
+type nullField struct {
+	policy NullPolicy
+	value  interface{}
+}
 
 type Mapper interface {
 	handler.Handler
+	handler.ContextHandler
 	SetFieldParser(parser parser.Parser) Mapper
 	AddCurrentTimestampField(toKeyPath string, convert func(interface{}) interface{}) error
 	AddConstField(value interface{}, toKeyPath string) error
 	AddField(fromKeyPath, toKeyPath string) error
 	AddFunctionField(fromKeyPath, toKeyPath string, convert func(interface{}) interface{}) error
 	AddFieldFromMultiplePath(fromKeyPaths []string, toKeyPath string, convert func([]interface{}) interface{}) error
+	AddTemplateField(template, toKeyPath string) error
+	AddHandlerField(h handler.Handler, toKeyPath string) error
+	AddStarField(excepts []string, replaces map[string]string) error
+	SetNullPolicy(policy NullPolicy) Mapper
+	SetFieldNullPolicy(toKeyPath string, policy NullPolicy) error
+	SetFieldDefault(toKeyPath string, value interface{}) error
+	KeyOrder() *utils.KeyOrder
+	Explain() string
+	Trace(obj interface{}) *parser.TraceNode
 }
 
 type mapper struct {
-	fields []FieldValueConverter
-	parser parser.Parser
-	funcs  function.Functions
+	fields     []FieldValueConverter
+	parser     parser.Parser
+	funcs      function.Functions
+	orderLock  sync.Mutex //guards order, which is built lazily by the goroutines converting
+	order      *utils.KeyOrder
+	orderN     int //number of fields in order
+	nulls      NullPolicy
+	fieldNulls map[string]*nullField //by target path
 }
 
 func NewMapper(funcs function.Functions) Mapper {
@@ -39,7 +72,7 @@ func (m *mapper) SetFieldParser(parser parser.Parser) Mapper {
 }
 
 func (m *mapper) AddCurrentTimestampField(toKeyPath string, convert func(interface{}) interface{}) error {
-	if toKeyPath == "" || !utils.IsValidKeyPath(toKeyPath) {
+	if toKeyPath == "" || !utils.IsValidTargetPath(toKeyPath) {
 		return ErrInvalidToKey
 	}
 	m.fields = append(m.fields, &fromCurrentTimestampFieldValue{toPath: toKeyPath, convert: convert})
@@ -47,7 +80,7 @@ func (m *mapper) AddCurrentTimestampField(toKeyPath string, convert func(interfa
 }
 
 func (m *mapper) AddConstField(value interface{}, toKeyPath string) error {
-	if toKeyPath == "" || !utils.IsValidKeyPath(toKeyPath) {
+	if toKeyPath == "" || !utils.IsValidTargetPath(toKeyPath) {
 		return ErrInvalidToKey
 	}
 	m.fields = append(m.fields, &constantFieldValue{toPath: toKeyPath, value: value})
@@ -58,15 +91,19 @@ func (m *mapper) AddField(fromKeyPath, toKeyPath string) error {
 	if !utils.IsValidKeyPath(fromKeyPath) {
 		if utils.IsLiteralNumber(fromKeyPath) {
 			return m.AddConstField(utils.LiteralNumber(fromKeyPath), toKeyPath)
+		} else if parser.IsTemplate(fromKeyPath) {
+			return m.AddTemplateField(fromKeyPath[1:len(fromKeyPath)-1], toKeyPath)
 		} else if utils.IsLiteralString(fromKeyPath) {
 			return m.AddConstField(utils.LiteralString(fromKeyPath), toKeyPath)
+		} else if !utils.IsKeyPath(fromKeyPath) || fromKeyPath[0] == '"' || strings.HasPrefix(fromKeyPath, "root[") {
+			return m.AddFunctionField(fromKeyPath, toKeyPath, nil)
 		}
-		return m.AddFunctionField(fromKeyPath, toKeyPath, nil)
+		//quoted keys like a.`content-type` or a['@timestamp'] are read by utils.GetByPath
 	}
 
 	if toKeyPath == "" {
 		toKeyPath = fromKeyPath
-	} else if !utils.IsValidKeyPath(toKeyPath) {
+	} else if !utils.IsValidTargetPath(toKeyPath) {
 		return ErrInvalidToKey
 	}
 
@@ -89,7 +126,7 @@ func (m *mapper) AddFunctionField(fromKeyPath, toKeyPath string, convert func(in
 
 	if toKeyPath == "" {
 		toKeyPath = utils.AdjustKeyPath(fromKeyPath)
-	} else if !utils.IsValidKeyPath(toKeyPath) {
+	} else if !utils.IsValidTargetPath(toKeyPath) {
 		return ErrInvalidToKey
 	}
 
@@ -97,6 +134,35 @@ func (m *mapper) AddFunctionField(fromKeyPath, toKeyPath string, convert func(in
 	return nil
 }
 
+// AddTemplateField adds a text rendered from template, whose placeholders ${expr} are parsed once here
+func (m *mapper) AddTemplateField(template, toKeyPath string) error {
+	if m.parser == nil {
+		return ErrNilParser
+	}
+	if toKeyPath == "" || !utils.IsValidTargetPath(toKeyPath) {
+		return ErrInvalidToKey
+	}
+	t, err := parser.ParseTemplate(template, m.parser, m.funcs)
+	if err != nil {
+		return err
+	}
+	m.fields = append(m.fields, &templateFieldValue{template: t, toPath: toKeyPath})
+	return nil
+}
+
+// AddHandlerField adds the input object handled by h, such as a flattener,
+// which is merged into the output like * when toKeyPath is *
+func (m *mapper) AddHandlerField(h handler.Handler, toKeyPath string) error {
+	if h == nil {
+		return ErrInvalidConvertingFunc
+	}
+	if toKeyPath == "" || !utils.IsValidTargetPath(toKeyPath) {
+		return ErrInvalidToKey
+	}
+	m.fields = append(m.fields, &handlerFieldValue{handler: h, toPath: toKeyPath})
+	return nil
+}
+
 func (m *mapper) AddFieldFromMultiplePath(fromKeyPaths []string, toKeyPath string, convert func([]interface{}) interface{}) error {
 	if m.parser == nil {
 		return ErrNilParser
@@ -114,7 +180,7 @@ func (m *mapper) AddFieldFromMultiplePath(fromKeyPaths []string, toKeyPath strin
 		fromPaths[fromPath] = resolver
 	}
 
-	if toKeyPath == "" || !utils.IsValidKeyPath(toKeyPath) {
+	if toKeyPath == "" || !utils.IsValidTargetPath(toKeyPath) {
 		return ErrInvalidToKey
 	}
 	if convert == nil {
@@ -125,28 +191,216 @@ func (m *mapper) AddFieldFromMultiplePath(fromKeyPaths []string, toKeyPath strin
 	return nil
 }
 
+// SetNullPolicy sets the policy of the fields evaluated to null which have no policy of their own,
+// NullDefault is not allowed as there is no default value for the whole mapper
+func (m *mapper) SetNullPolicy(policy NullPolicy) Mapper {
+	if policy == NullOmit || policy == NullEmit {
+		m.nulls = policy
+	}
+	return m
+}
+
+func (m *mapper) hasField(toKeyPath string) bool {
+	for _, v := range m.fields {
+		if v.ConvertToPath() == toKeyPath && toKeyPath != "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFieldNullPolicy sets the policy of the fields written to toKeyPath, use SetFieldDefault for NullDefault
+func (m *mapper) SetFieldNullPolicy(toKeyPath string, policy NullPolicy) error {
+	if !m.hasField(toKeyPath) {
+		return ErrInvalidToKey
+	}
+	if policy != NullOmit && policy != NullEmit {
+		return ErrInvalidNullPolicy
+	}
+	if m.fieldNulls == nil {
+		m.fieldNulls = map[string]*nullField{}
+	}
+	m.fieldNulls[toKeyPath] = &nullField{policy: policy}
+	return nil
+}
+
+// SetFieldDefault sets the value written to toKeyPath when its field is evaluated to null
+func (m *mapper) SetFieldDefault(toKeyPath string, value interface{}) error {
+	if !m.hasField(toKeyPath) {
+		return ErrInvalidToKey
+	}
+	if m.fieldNulls == nil {
+		m.fieldNulls = map[string]*nullField{}
+	}
+	m.fieldNulls[toKeyPath] = &nullField{policy: NullDefault, value: value}
+	return nil
+}
+
+// KeyOrder returns the order of the output keys as the order of the fields, the keys of * are put at its position
+func (m *mapper) KeyOrder() *utils.KeyOrder {
+	m.orderLock.Lock()
+	defer m.orderLock.Unlock()
+	if m.order == nil || m.orderN != len(m.fields) {
+		order := utils.NewKeyOrder()
+		for _, v := range m.fields {
+			order.Add(v.ConvertToPath())
+		}
+		m.order, m.orderN = order, len(m.fields)
+	}
+	return m.order
+}
+
+// AddStarField adds SELECT * EXCEPT (excepts) REPLACE (replaces), which copies the input object
+// without the key paths of excepts, and with the key paths of replaces set by the expressions they map to
+func (m *mapper) AddStarField(excepts []string, replaces map[string]string) error {
+	for _, path := range excepts {
+		if !utils.IsKeyPath(path) {
+			return ErrInvalidFromKey
+		}
+	}
+
+	star := &starFieldValue{excepts: excepts}
+	for toKeyPath, fromKeyPath := range replaces {
+		if !utils.IsKeyPath(toKeyPath) {
+			return ErrInvalidToKey
+		}
+		replace := &mapper{parser: m.parser, funcs: m.funcs}
+		if err := replace.AddField(fromKeyPath, toKeyPath); err != nil {
+			return err
+		}
+		star.replaces = append(star.replaces, replace.fields...)
+	}
+	m.fields = append(m.fields, star)
+	return nil
+}
+
+// Handle copies the objects of the fields mapped to * first, merging them when there are more than one.
+// The other fields are then set onto the copy in order, an object value is merged into the object
+// already at its path, with its own keys winning.
 func (m *mapper) Handle(obj interface{}) interface{} {
+	ret, _ := m.handle(obj, func(v FieldValueConverter) (interface{}, error) {
+		return v.ConvertValue(obj), nil
+	})
+	return ret
+}
+
+// HandleContext is Handle which returns the error of ctx once ctx is done, which is checked for every field
+func (m *mapper) HandleContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	return m.handle(obj, func(v FieldValueConverter) (interface{}, error) {
+		return convertValue(ctx, v, obj)
+	})
+}
+
+// Trace maps obj, returning the output with the value of every field and the evaluations of their expressions
+func (m *mapper) Trace(obj interface{}) *parser.TraceNode {
+	node := &parser.TraceNode{Expr: "SELECT"}
+	node.Value, _ = m.handle(obj, func(v FieldValueConverter) (interface{}, error) {
+		field := traceValue(v, obj)
+		node.Children = append(node.Children, field)
+		return field.Value, nil
+	})
+	return node
+}
+
+// handle maps obj with the values of the fields converted by convert, which stops at the first error
+func (m *mapper) handle(obj interface{}, convert func(v FieldValueConverter) (interface{}, error)) (interface{}, error) {
 	if m == nil {
-		return nil
+		return nil, nil
 	} else if len(m.fields) == 0 {
-		return map[string]interface{}{}
+		return map[string]interface{}{}, nil
 	}
-	ret := make(map[string]interface{})
+	var ret map[string]interface{}
 	for _, v := range m.fields {
-		val := v.ConvertValue(obj)
-		if val == nil {
-			continue //skip
+		if v.ConvertToPath() != "*" {
+			continue
+		}
+		val, err := convert(v)
+		if err != nil {
+			return nil, err
 		}
+		if temp, ok := utils.Plain(val).(map[string]interface{}); ok { //structs are copied as objects
+			if ret == nil {
+				ret = temp
+			} else {
+				ret = utils.MergeValue(ret, temp).(map[string]interface{})
+			}
+		}
+	}
+	if ret == nil {
+		ret = make(map[string]interface{})
+	}
+
+	for _, v := range m.fields {
 		toPath := v.ConvertToPath()
 		if toPath == "*" {
-			if temp, ok := val.(map[string]interface{}); ok {
-				ret = temp
+			continue
+		}
+		val, err := convert(v)
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			policy := m.nulls
+			if nf, ok := m.fieldNulls[toPath]; ok {
+				policy, val = nf.policy, nf.value
+			}
+			if policy == NullOmit {
+				continue //skip
 			}
-		} else if utils.IsValidKeyPath(toPath) {
-			utils.SetByPath(ret, v.ConvertToPath(), val)
+		}
+		if utils.IsValidTargetPath(toPath) {
+			//the objects of the input are copied, so that the fields written into them afterwards do not modify the input
+			utils.MergeByPath(ret, toPath, utils.DeepCopy(val))
 		}
 	}
-	return ret
+	return ret, nil
+}
+
+// Explain describes the fields in order with the functions they call, and their null policies
+func (m *mapper) Explain() string {
+	lines := []string{"SELECT"}
+	var funcs []parser.Function
+	for _, v := range m.fields {
+		source, fieldFuncs := explainField(v)
+		toPath := v.ConvertToPath()
+		line := source
+		if toPath != "*" {
+			line += " AS " + toPath
+		}
+		if nf, ok := m.fieldNulls[toPath]; ok {
+			if nf.policy == NullDefault {
+				line += " DEFAULT " + parser.FormatValue(nf.value)
+			} else if nf.policy == NullEmit {
+				line += " DEFAULT null"
+			}
+		}
+		lines = append(lines, "  "+strings.Replace(line, "\n", "\n  ", -1))
+		for _, f := range fieldFuncs {
+			funcs = appendFunction(funcs, f)
+		}
+	}
+	if len(funcs) > 0 {
+		names := make([]string, len(funcs))
+		for i, f := range funcs {
+			names[i] = f.String()
+		}
+		lines = append(lines, "  functions: "+strings.Join(names, ", "))
+	}
+	if m.nulls == NullEmit {
+		lines = append(lines, "  nulls: emit")
+	} else {
+		lines = append(lines, "  nulls: omit")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func appendFunction(funcs []parser.Function, f parser.Function) []parser.Function {
+	for _, g := range funcs {
+		if strings.EqualFold(f.Name, g.Name) {
+			return funcs
+		}
+	}
+	return append(funcs, f)
 }
 
 func (f *mapper) HandleAsync(obj interface{}) {
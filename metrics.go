@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"github.com/sdghchj/sql-rules-engine/metrics"
+	"net/http"
+	"sort"
+)
+
+// ruleMetrics returns the metrics of the rule id, which are kept for the new versions of the rule until it is removed
+func (e *jsonEngine) ruleMetrics(id string) *metrics.Rule {
+	if m, ok := e.metrics.Load(id); ok {
+		return m.(*metrics.Rule)
+	}
+	m, _ := e.metrics.LoadOrStore(id, metrics.NewRule())
+	return m.(*metrics.Rule)
+}
+
+// Metrics returns the metrics of the rules by id: the messages received, matched, filtered out and failed,
+// the outputs emitted, the latency of the evaluations, and the outputs delivered and failed by every action
+func (e *jsonEngine) Metrics() []metrics.Snapshot {
+	var snapshots []metrics.Snapshot
+	e.metrics.Range(func(key, value interface{}) bool {
+		snapshots = append(snapshots, value.(*metrics.Rule).Snapshot(key.(string)))
+		return true
+	})
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Rule < snapshots[j].Rule
+	})
+	return snapshots
+}
+
+// MetricsHandler serves the metrics of the rules in the prometheus text exposition format
+func (e *jsonEngine) MetricsHandler() http.Handler {
+	return metrics.Handler(e.Metrics)
+}
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the buckets of the latency histograms
+var DefaultBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Rule collects the metrics of a rule, it is safe for concurrent use
+type Rule struct {
+	received   uint64 //first for the alignment of atomic operations
+	matched    uint64
+	filtered   uint64
+	emitted    uint64
+	failed     uint64
+	dropped    uint64
+	latencySum uint64   //in nanoseconds
+	buckets    []uint64 //by DefaultBuckets, and the last one for +Inf
+	lock       sync.Mutex
+	actions    map[string]*actionCounts
+}
+
+type actionCounts struct {
+	successes uint64
+	failures  uint64
+}
+
+func NewRule() *Rule {
+	return &Rule{buckets: make([]uint64, len(DefaultBuckets)+1)}
+}
+
+// Observe records a message evaluated in latency into outputs, which failed when an expression of it failed
+// or the evaluation was cancelled. A message without output is filtered out unless it failed.
+func (r *Rule) Observe(latency time.Duration, outputs int, failed bool) {
+	atomic.AddUint64(&r.received, 1)
+	if failed {
+		atomic.AddUint64(&r.failed, 1)
+	}
+	if outputs > 0 {
+		atomic.AddUint64(&r.matched, 1)
+		atomic.AddUint64(&r.emitted, uint64(outputs))
+	} else if !failed {
+		atomic.AddUint64(&r.filtered, 1)
+	}
+	r.observeLatency(latency)
+}
+
+// ObserveAsync records a message handled by async event handlers, whose filter is evaluated in latency
+func (r *Rule) ObserveAsync(latency time.Duration) {
+	atomic.AddUint64(&r.received, 1)
+	r.observeLatency(latency)
+}
+
+// ObserveFailure records a message failing before it is evaluated, such as json failing to decode
+func (r *Rule) ObserveFailure() {
+	atomic.AddUint64(&r.received, 1)
+	atomic.AddUint64(&r.failed, 1)
+}
+
+// ObserveDropped records an async handler the executor did not run, dropped by its policy or its shutdown
+func (r *Rule) ObserveDropped() {
+	atomic.AddUint64(&r.dropped, 1)
+}
+
+func (r *Rule) observeLatency(latency time.Duration) {
+	seconds := latency.Seconds()
+	i := sort.SearchFloat64s(DefaultBuckets, seconds) //the first upper bound not less than seconds
+	atomic.AddUint64(&r.buckets[i], 1)
+	atomic.AddUint64(&r.latencySum, uint64(latency))
+}
+
+// ObserveAction records an output delivered by the action name, which failed when err is not nil
+func (r *Rule) ObserveAction(name string, err error) {
+	r.lock.Lock()
+	counts, ok := r.actions[name]
+	if !ok {
+		if r.actions == nil {
+			r.actions = map[string]*actionCounts{}
+		}
+		counts = &actionCounts{}
+		r.actions[name] = counts
+	}
+	r.lock.Unlock()
+	if err != nil {
+		atomic.AddUint64(&counts.failures, 1)
+	} else {
+		atomic.AddUint64(&counts.successes, 1)
+	}
+}
+
+// Snapshot is the metrics of a rule at a time
+type Snapshot struct {
+	Rule     string
+	Received uint64 //messages evaluated
+	Matched  uint64 //messages with at least one output
+	Filtered uint64 //messages without output and not failed
+	Emitted  uint64 //outputs
+	Failed   uint64 //messages failing to decode, with an expression failing, or cancelled
+	Dropped  uint64 //async handlers the executor did not run
+	Latency  Histogram
+	Actions  []Action //by name
+}
+
+// Histogram is the distribution of the evaluation latencies
+type Histogram struct {
+	Count   uint64
+	Sum     time.Duration
+	Buckets []Bucket //by upper bound, without +Inf which is Count
+}
+
+// Bucket counts the latencies not greater than UpperBound in seconds, it is cumulative
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// Action is the numbers of the outputs an action of a rule delivered and failed to deliver
+type Action struct {
+	Name      string
+	Successes uint64
+	Failures  uint64
+}
+
+// Snapshot returns the metrics collected of the rule id
+func (r *Rule) Snapshot(id string) Snapshot {
+	s := Snapshot{
+		Rule:     id,
+		Received: atomic.LoadUint64(&r.received),
+		Matched:  atomic.LoadUint64(&r.matched),
+		Filtered: atomic.LoadUint64(&r.filtered),
+		Emitted:  atomic.LoadUint64(&r.emitted),
+		Failed:   atomic.LoadUint64(&r.failed),
+		Dropped:  atomic.LoadUint64(&r.dropped),
+	}
+	s.Latency.Sum = time.Duration(atomic.LoadUint64(&r.latencySum))
+	var cumulative uint64
+	s.Latency.Buckets = make([]Bucket, len(DefaultBuckets))
+	for i, bound := range DefaultBuckets {
+		cumulative += atomic.LoadUint64(&r.buckets[i])
+		s.Latency.Buckets[i] = Bucket{UpperBound: bound, Count: cumulative}
+	}
+	s.Latency.Count = cumulative + atomic.LoadUint64(&r.buckets[len(DefaultBuckets)])
+
+	r.lock.Lock()
+	for name, counts := range r.actions {
+		s.Actions = append(s.Actions, Action{Name: name, Successes: atomic.LoadUint64(&counts.successes),
+			Failures: atomic.LoadUint64(&counts.failures)})
+	}
+	r.lock.Unlock()
+	sort.Slice(s.Actions, func(i, j int) bool {
+		return s.Actions[i].Name < s.Actions[j].Name
+	})
+	return s
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRule(t *testing.T) {
+	r := NewRule()
+	r.Observe(50*time.Microsecond, 2, false)
+	r.Observe(3*time.Millisecond, 0, false)
+	r.Observe(2*time.Second, 0, true)
+	r.Observe(time.Millisecond, 1, true)
+	r.ObserveFailure()
+	r.ObserveAction("b", nil)
+	r.ObserveAction("a", errors.New("failed"))
+	r.ObserveAction("b", nil)
+
+	s := r.Snapshot("x")
+	if s.Rule != "x" || s.Received != 5 || s.Matched != 2 || s.Filtered != 1 || s.Emitted != 3 || s.Failed != 3 {
+		t.Error(s)
+	}
+	if s.Latency.Count != 4 || s.Latency.Sum != 2*time.Second+4050*time.Microsecond {
+		t.Error(s.Latency)
+	}
+	//0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, ...
+	for i, count := range []uint64{1, 1, 1, 2, 2, 3} {
+		if s.Latency.Buckets[i].Count != count {
+			t.Error(i, s.Latency.Buckets[i])
+		}
+	}
+	if last := s.Latency.Buckets[len(s.Latency.Buckets)-1]; last.UpperBound != 1 || last.Count != 3 {
+		t.Error(last)
+	}
+	if len(s.Actions) != 2 || s.Actions[0] != (Action{Name: "a", Failures: 1}) || s.Actions[1] != (Action{Name: "b", Successes: 2}) {
+		t.Error(s.Actions)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	r := NewRule()
+	r.Observe(time.Millisecond, 1, false)
+	r.ObserveAction("stdout", nil)
+	snapshots := []Snapshot{r.Snapshot(`sensors/"+"`)}
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, snapshots); err != nil {
+		t.Fatal(err)
+	}
+	text := buf.String()
+	for _, line := range []string{
+		"# TYPE sqlrules_rule_received_total counter",
+		`sqlrules_rule_received_total{rule="sensors/\"+\""} 1`,
+		`sqlrules_rule_filtered_total{rule="sensors/\"+\""} 0`,
+		"# TYPE sqlrules_rule_evaluation_seconds histogram",
+		`sqlrules_rule_evaluation_seconds_bucket{rule="sensors/\"+\"",le="0.0005"} 0`,
+		`sqlrules_rule_evaluation_seconds_bucket{rule="sensors/\"+\"",le="0.001"} 1`,
+		`sqlrules_rule_evaluation_seconds_bucket{rule="sensors/\"+\"",le="+Inf"} 1`,
+		`sqlrules_rule_evaluation_seconds_sum{rule="sensors/\"+\""} 0.001`,
+		`sqlrules_rule_evaluation_seconds_count{rule="sensors/\"+\""} 1`,
+		`sqlrules_action_successes_total{rule="sensors/\"+\"",action="stdout"} 1`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Error(line)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	Handler(func() []Snapshot { return snapshots }).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Header().Get("Content-Type") != ContentType || rec.Body.String() != text {
+		t.Error(rec.Header(), rec.Body.String())
+	}
+}
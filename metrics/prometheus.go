@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content type of the prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name string, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WritePrometheus writes snapshots into w in the prometheus text exposition format, the metric names are
+// prefixed by sqlrules_ and labeled by rule, and by action for the actions
+func WritePrometheus(w io.Writer, snapshots []Snapshot) error {
+	bw := bufio.NewWriter(w)
+	counters := []struct {
+		name  string
+		help  string
+		value func(s *Snapshot) uint64
+	}{
+		{"sqlrules_rule_received_total", "Messages evaluated by the rule.", func(s *Snapshot) uint64 { return s.Received }},
+		{"sqlrules_rule_matched_total", "Messages with at least one output.", func(s *Snapshot) uint64 { return s.Matched }},
+		{"sqlrules_rule_filtered_total", "Messages filtered out without output.", func(s *Snapshot) uint64 { return s.Filtered }},
+		{"sqlrules_rule_emitted_total", "Outputs of the rule.", func(s *Snapshot) uint64 { return s.Emitted }},
+		{"sqlrules_rule_failed_total", "Messages failing to decode or evaluate.", func(s *Snapshot) uint64 { return s.Failed }},
+		{"sqlrules_rule_dropped_total", "Async handlers the executor did not run.", func(s *Snapshot) uint64 { return s.Dropped }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for i := range snapshots {
+			fmt.Fprintf(bw, "%s{%s} %d\n", c.name, label("rule", snapshots[i].Rule), c.value(&snapshots[i]))
+		}
+	}
+
+	const latency = "sqlrules_rule_evaluation_seconds"
+	fmt.Fprintf(bw, "# HELP %s Latency of evaluating a message.\n# TYPE %s histogram\n", latency, latency)
+	for _, s := range snapshots {
+		rule := label("rule", s.Rule)
+		for _, b := range s.Latency.Buckets {
+			fmt.Fprintf(bw, "%s_bucket{%s,%s} %d\n", latency, rule, label("le", formatFloat(b.UpperBound)), b.Count)
+		}
+		fmt.Fprintf(bw, "%s_bucket{%s,%s} %d\n", latency, rule, label("le", "+Inf"), s.Latency.Count)
+		fmt.Fprintf(bw, "%s_sum{%s} %s\n", latency, rule, formatFloat(s.Latency.Sum.Seconds()))
+		fmt.Fprintf(bw, "%s_count{%s} %d\n", latency, rule, s.Latency.Count)
+	}
+
+	actions := []struct {
+		name  string
+		help  string
+		value func(a *Action) uint64
+	}{
+		{"sqlrules_action_successes_total", "Outputs delivered by the action.", func(a *Action) uint64 { return a.Successes }},
+		{"sqlrules_action_failures_total", "Outputs the action failed to deliver after its retries.", func(a *Action) uint64 { return a.Failures }},
+	}
+	for _, c := range actions {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, s := range snapshots {
+			for i := range s.Actions {
+				fmt.Fprintf(bw, "%s{%s,%s} %d\n", c.name, label("rule", s.Rule), label("action", s.Actions[i].Name), c.value(&s.Actions[i]))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler serves the snapshots returned by snapshot in the prometheus text exposition format
+func Handler(snapshot func() []Snapshot) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		WritePrometheus(w, snapshot())
+	})
+}
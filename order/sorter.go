@@ -0,0 +1,283 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/function"
+	"github.com/sdghchj/sql-rules-engine/handler"
+	"github.com/sdghchj/sql-rules-engine/parser"
+	"github.com/sdghchj/sql-rules-engine/utils"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidOrderExpr = errors.New("invalid order expression")
+var ErrInvalidLimit = errors.New("invalid limit")
+
+// Sorter sorts the elements of an array by ORDER BY expressions and truncates it by LIMIT and OFFSET,
+// other values are returned unchanged
+type Sorter interface {
+	handler.Handler
+	handler.ContextHandler
+	AddOrder(expr string, desc bool, nullsFirst bool) error
+	SetLimit(limit, offset int) error
+	Explain() string
+	Trace(obj interface{}) *parser.TraceNode
+}
+
+type orderBy struct {
+	expr       string
+	resolver   parser.Resolver
+	desc       bool
+	nullsFirst bool
+}
+
+type sorter struct {
+	parser parser.Parser
+	funcs  function.Functions
+	orders []*orderBy
+	limit  int
+	offset int
+}
+
+func NewSorter(funcs function.Functions) Sorter {
+	return &sorter{parser: parser.DefaultGoParser, funcs: funcs, limit: -1}
+}
+
+// AddOrder appends an ORDER BY expression evaluated on every element,
+// nullsFirst is usually true for descending order and false for ascending order as the sql default
+func (s *sorter) AddOrder(expr string, desc bool, nullsFirst bool) error {
+	if expr == "" {
+		return ErrInvalidOrderExpr
+	}
+	o := &orderBy{expr: expr, desc: desc, nullsFirst: nullsFirst}
+	if !utils.IsValidKeyPath(expr) || expr == "*" {
+		r, err := s.parser.Parse(expr, s.funcs)
+		if err != nil {
+			return err
+		}
+		o.resolver = r
+	}
+	s.orders = append(s.orders, o)
+	return nil
+}
+
+// SetLimit keeps at most limit elements after skipping offset elements, a negative limit means no limit
+func (s *sorter) SetLimit(limit, offset int) error {
+	if offset < 0 {
+		return ErrInvalidLimit
+	}
+	s.limit = limit
+	s.offset = offset
+	return nil
+}
+
+// evaluate evaluates the order expression on obj with ctx, a nil ctx is never done
+func (o *orderBy) evaluate(ctx context.Context, obj interface{}) (interface{}, error) {
+	if o.resolver == nil {
+		return utils.GetByPath(obj, o.expr), nil
+	} else if ctx == nil {
+		return o.resolver.Evaluate(obj), nil
+	}
+	return o.resolver.EvaluateContext(ctx, obj)
+}
+
+// typeRank orders values of different types: bool < number < string < others
+func typeRank(val interface{}) int {
+	if _, ok := val.(bool); ok {
+		return 0
+	} else if _, err := utils.GetFloat64(val); err == nil {
+		return 1
+	} else if _, ok := val.(string); ok {
+		return 2
+	}
+	return 3
+}
+
+func compare(x, y interface{}) int {
+	rx, ry := typeRank(x), typeRank(y)
+	if rx != ry {
+		return rx - ry
+	}
+	switch rx {
+	case 0:
+		bx, by := x.(bool), y.(bool)
+		if bx == by {
+			return 0
+		} else if !bx {
+			return -1
+		}
+		return 1
+	case 1:
+		fx, fy := utils.MustGetFloat64(x), utils.MustGetFloat64(y)
+		if fx < fy {
+			return -1
+		} else if fx > fy {
+			return 1
+		}
+	case 2:
+		sx, sy := x.(string), y.(string)
+		if sx < sy {
+			return -1
+		} else if sx > sy {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (s *sorter) Handle(obj interface{}) interface{} {
+	ret, _ := s.handle(obj, func(o *orderBy, i int, row interface{}) (interface{}, error) {
+		return o.evaluate(nil, row)
+	})
+	return ret
+}
+
+// HandleContext is Handle which returns the error of ctx once ctx is done, which is checked for every key of every row
+func (s *sorter) HandleContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	return s.handle(obj, func(o *orderBy, i int, row interface{}) (interface{}, error) {
+		return o.evaluate(ctx, row)
+	})
+}
+
+// Trace sorts obj, returning the output with the keys of every row
+func (s *sorter) Trace(obj interface{}) *parser.TraceNode {
+	node := &parser.TraceNode{Expr: s.header()}
+	node.Value, _ = s.handle(obj, func(o *orderBy, i int, row interface{}) (interface{}, error) {
+		key := &parser.TraceNode{Expr: fmt.Sprintf("row %d: %s", i, o.expr)}
+		if o.resolver != nil {
+			eval := o.resolver.Trace(row)
+			key.Value, key.Children = eval.Value, []*parser.TraceNode{eval}
+		} else {
+			key.Value = utils.GetByPath(row, o.expr)
+		}
+		node.Children = append(node.Children, key)
+		return key.Value, nil
+	})
+	return node
+}
+
+// header is the ORDER BY, LIMIT and OFFSET clauses
+func (s *sorter) header() string {
+	var clauses []string
+	if len(s.orders) > 0 {
+		orders := make([]string, len(s.orders))
+		for i, o := range s.orders {
+			orders[i] = o.expr
+			if o.desc {
+				orders[i] += " DESC"
+			}
+			if o.nullsFirst {
+				orders[i] += " NULLS FIRST"
+			} else {
+				orders[i] += " NULLS LAST"
+			}
+		}
+		clauses = append(clauses, "ORDER BY "+strings.Join(orders, ", "))
+	}
+	if s.limit >= 0 {
+		clauses = append(clauses, fmt.Sprintf("LIMIT %d", s.limit))
+	}
+	if s.offset > 0 {
+		clauses = append(clauses, fmt.Sprintf("OFFSET %d", s.offset))
+	}
+	return strings.Join(clauses, " ")
+}
+
+// Explain describes the orders and the limit, with the functions the orders call
+func (s *sorter) Explain() string {
+	text := s.header()
+	var names []string
+	for _, o := range s.orders {
+		if o.resolver == nil {
+			continue
+		}
+		for _, f := range o.resolver.Functions() {
+			names = append(names, f.String())
+		}
+	}
+	if len(names) > 0 {
+		text += "\n  functions: " + strings.Join(names, ", ")
+	}
+	return text
+}
+
+// handle sorts obj by the keys evaluated by evaluate for every order of every row, which stops at the first error
+func (s *sorter) handle(obj interface{}, evaluate func(o *orderBy, i int, row interface{}) (interface{}, error)) (interface{}, error) {
+	if obj == nil {
+		return nil, nil
+	}
+	val := reflect.ValueOf(obj)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return obj, nil
+	}
+
+	length := val.Len()
+	rows := make([]interface{}, length)
+	for i := 0; i < length; i++ {
+		rows[i] = val.Index(i).Interface()
+	}
+
+	if len(s.orders) > 0 {
+		keys := make([][]interface{}, length)
+		for i, row := range rows {
+			keys[i] = make([]interface{}, len(s.orders))
+			for j, o := range s.orders {
+				key, err := evaluate(o, i, row)
+				if err != nil {
+					return nil, err
+				}
+				keys[i][j] = key
+			}
+		}
+		index := make([]int, length)
+		for i := range index {
+			index[i] = i
+		}
+		sort.SliceStable(index, func(a, b int) bool {
+			ka, kb := keys[index[a]], keys[index[b]]
+			for j, o := range s.orders {
+				x, y := ka[j], kb[j]
+				if x == nil || y == nil {
+					if x == nil && y == nil {
+						continue
+					}
+					return (x == nil) == o.nullsFirst
+				}
+				c := compare(x, y)
+				if c == 0 {
+					continue
+				}
+				if o.desc {
+					return c > 0
+				}
+				return c < 0
+			}
+			return false
+		})
+		sorted := make([]interface{}, length)
+		for i, j := range index {
+			sorted[i] = rows[j]
+		}
+		rows = sorted
+	}
+
+	if s.offset >= len(rows) {
+		rows = []interface{}{}
+	} else {
+		rows = rows[s.offset:]
+		if s.limit >= 0 && s.limit < len(rows) {
+			rows = rows[:s.limit]
+		}
+	}
+	if _, ok := obj.(handler.Results); ok {
+		return handler.Results(rows), nil
+	}
+	return rows, nil
+}
+
+func (s *sorter) HandleAsync(obj interface{}) {
+
+}
@@ -3,8 +3,8 @@ package parser
 import (
 	"errors"
 	"github.com/sdghchj/sql-rules-engine/function"
+	"github.com/sdghchj/sql-rules-engine/internal/sqltoken"
 	"go/parser"
-	"go/scanner"
 	"go/token"
 	"strings"
 )
@@ -19,26 +19,8 @@ var DefaultGoParser goParser
 
 var ErrTypeError = errors.New("type error")
 
-type sqlToken struct {
-	pos token.Pos
-	tok token.Token
-	lit string
-}
-
 func (goParser) translateSqlWhere(where string) string {
-	var tokens []*sqlToken
-	var s scanner.Scanner
-	fset := token.NewFileSet()
-	file := fset.AddFile("", fset.Base(), len(where))
-	s.Init(file, []byte(where), nil, 0)
-	for {
-		pos, tok, lit := s.Scan()
-		if tok == token.EOF {
-			break
-		} else if tok != token.SEMICOLON { //SEMICOLON means \n
-			tokens = append(tokens, &sqlToken{pos, tok, lit})
-		}
-	}
+	tokens, _ := sqltoken.Scan(where)
 	if tokens == nil {
 		return ""
 	}
@@ -46,7 +28,7 @@ func (goParser) translateSqlWhere(where string) string {
 	length := len(tokens)
 
 	for i := 0; i < length; i++ {
-		switch tokens[i].tok {
+		switch tokens[i].Tok {
 		case token.IDENT, token.INT, token.FLOAT, token.STRING, token.CHAR:
 			break
 		case token.LPAREN, token.LBRACK, token.RPAREN, token.RBRACK,
@@ -54,56 +36,90 @@ func (goParser) translateSqlWhere(where string) string {
 			token.ASSIGN, token.EQL, token.NEQ, token.GTR, token.GEQ, token.LSS, token.LEQ,
 			token.AND, token.OR, token.NOT, token.XOR, token.LOR, token.LAND,
 			token.COMMA, token.PERIOD,
-			token.SHL, token.SHR: //tokens[i].tok.IsOperator()
-			tokens[i].lit = tokens[i].tok.String()
+			token.SHL, token.SHR: //tokens[i].Tok.IsOperator()
+			tokens[i].Lit = tokens[i].Tok.String()
 			break
 		default:
 		}
 	}
 
-	var need = false
+	need, _ := sqltoken.RewriteCast(tokens)
 	for i := 0; i < length; i++ {
-		switch tokens[i].tok {
+		switch tokens[i].Tok {
 		case token.IDENT:
-			if i > 0 && tokens[i-1].tok == token.PERIOD || i < length-1 && tokens[i+1].tok == token.PERIOD {
+			if i > 0 && tokens[i-1].Tok == token.PERIOD || i < length-1 && tokens[i+1].Tok == token.PERIOD {
 				continue
 			}
 
-			if strings.EqualFold(tokens[i].lit, "and") {
-				tokens[i].tok = token.LAND
-				tokens[i].lit = "&&"
+			if strings.EqualFold(tokens[i].Lit, "and") {
+				tokens[i].Tok = token.LAND
+				tokens[i].Lit = "&&"
 				need = true
-			} else if strings.EqualFold(tokens[i].lit, "or") {
-				tokens[i].tok = token.LOR
-				tokens[i].lit = "||"
+			} else if strings.EqualFold(tokens[i].Lit, "or") {
+				tokens[i].Tok = token.LOR
+				tokens[i].Lit = "||"
 				need = true
-			} else if strings.EqualFold(tokens[i].lit, "not") {
-				tokens[i].tok = token.NOT
-				tokens[i].lit = "!"
+			} else if strings.EqualFold(tokens[i].Lit, "not") {
+				tokens[i].Tok = token.NOT
+				tokens[i].Lit = "!"
 				need = true
-			} else if strings.EqualFold(tokens[i].lit, "null") {
-				tokens[i].lit = "nil"
+			} else if strings.EqualFold(tokens[i].Lit, "null") {
+				tokens[i].Lit = "nil"
 				need = true
-			} else if i > 0 && i+1 < length && strings.EqualFold(tokens[i].lit, "in") && tokens[i-1].tok >= token.IDENT && tokens[i-1].tok <= token.STRING && tokens[i+1].tok == token.LPAREN {
+			} else if i > 0 && i+1 < length && strings.EqualFold(tokens[i].Lit, "in") && tokens[i-1].Tok >= token.IDENT && tokens[i-1].Tok <= token.STRING && tokens[i+1].Tok == token.LPAREN {
 				// val in (comma separated array)
 				temp := tokens[i-1]
 				tokens[i-1] = tokens[i]
 				tokens[i] = tokens[i+1]
 				tokens[i+1] = temp
-				tokens[i+1].lit += ","
+				tokens[i+1].Lit += ","
 				need = true
 			}
 			break
 		case token.MUL:
-			if i > 0 && i+1 < length && tokens[i-1].tok == token.LBRACK && tokens[i+1].tok == token.RBRACK {
-				tokens[i].tok = token.INT
-				tokens[i].lit = "-1"
+			if i > 0 && i+1 < length && tokens[i-1].Tok == token.LBRACK && tokens[i+1].Tok == token.RBRACK {
+				tokens[i].Tok = token.INT
+				tokens[i].Lit = "-1"
 				need = true
 			}
 		case token.ASSIGN:
-			tokens[i].lit = "=="
+			tokens[i].Lit = "=="
 			need = true
 			break
+		case token.STRING:
+			//`content-type` is root["content-type"] and a.`content-type` is a["content-type"], the way a select field
+			//of a single backtick text is a key, a[`content-type`] is a["content-type"] as well.
+			//Raw strings with placeholders are templates.
+			if tokens[i].Lit[0] != '`' || IsTemplate(tokens[i].Lit) {
+				break
+			}
+			key := tokens[i].Lit
+			if !strings.ContainsAny(key, "\\\"") {
+				key = `"` + key[1:len(key)-1] + `"`
+			}
+			if i > 0 && tokens[i-1].Tok == token.PERIOD {
+				tokens[i-1].Lit = ""
+				tokens[i].Lit = "[" + key + "]"
+			} else if i > 0 && tokens[i-1].Tok == token.LBRACK && i+1 < length && tokens[i+1].Tok == token.RBRACK {
+				tokens[i].Lit = key
+			} else {
+				tokens[i].Lit = "root[" + key + "]"
+			}
+			need = true
+			break
+		case token.CHAR:
+			//'text' of sql is a string rather than a go rune, backslashes are kept as they are by a raw string
+			text := tokens[i].Lit[1 : len(tokens[i].Lit)-1]
+			if !strings.ContainsAny(text, "\\\"") {
+				tokens[i].Tok = token.STRING
+				tokens[i].Lit = `"` + text + `"`
+				need = true
+			} else if !strings.Contains(text, "`") && !strings.Contains(text, "${") {
+				tokens[i].Tok = token.STRING
+				tokens[i].Lit = "`" + text + "`"
+				need = true
+			}
+			break
 		default:
 			break
 		}
@@ -112,7 +128,7 @@ func (goParser) translateSqlWhere(where string) string {
 	if need {
 		where = ""
 		for i := 0; i < length; i++ {
-			where += tokens[i].lit
+			where += tokens[i].Lit
 		}
 	}
 
@@ -125,5 +141,9 @@ func (p goParser) Parse(text string, funcs function.Functions) (Resolver, error)
 	if err != nil {
 		return nil, err
 	}
-	return NewGoResolver(exp, funcs), nil
+	r, err := newGoResolver(exp, funcs)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
 }
@@ -1,38 +1,252 @@
 package parser
 
 import (
+	"context"
+	"fmt"
 	"github.com/sdghchj/sql-rules-engine/function"
 	"github.com/sdghchj/sql-rules-engine/utils"
 	"go/ast"
 	"go/token"
+	"go/types"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 type Resolver interface {
 	Evaluate(obj interface{}) interface{}
+	// Trace evaluates obj, returning the tree of the values of the sub-expressions evaluated.
+	// The stateful functions read their states without writing them.
+	Trace(obj interface{}) *TraceNode
+	// String returns the expression parsed in go syntax, such as a == 1 && Len(b) > 2
+	String() string
+	// Functions returns the functions called by the expression in the order of their first calls
+	Functions() []Function
+	// Keys returns the top level keys of the input read by the expression, such as a of a.b and x-y of root['x-y'],
+	// in the order of their first reads
+	Keys() []string
+	// EvaluateContext is Evaluate which is checked for the cancellation of ctx before every sub-expression
+	// and function call, it returns nil with the error of ctx once ctx is done
+	EvaluateContext(ctx context.Context, obj interface{}) (interface{}, error)
 }
 
 type goResolver struct {
-	funcs function.Functions
-	node  ast.Expr
+	funcs    function.Functions
+	node     ast.Expr
+	patterns map[*ast.BasicLit]*regexp.Regexp //literal patterns of regex functions compiled at parse time
+	sites    map[*ast.CallExpr]string         //call site names passed to stateful functions as the last argument
+	literals map[*ast.BasicLit]*Template      //raw string literals with placeholders
+	formats  map[*ast.CallExpr]*Template      //literal formats of template functions
+	ctx      context.Context                  //of an evaluation by EvaluateContext, nil otherwise
+	onError  func(err *EvaluationError)       //of the context of an evaluation
+	tracer   *tracer                          //of an evaluation by Trace
+	scratch  *function.Scratch                //of an evaluation which must not change the states of stateful functions
+}
+
+// EvaluationError is a panic of an expression recovered into nil, such as a failed cast
+type EvaluationError struct {
+	Expr  string
+	Value interface{} //recovered
+}
+
+func (e *EvaluationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Expr, e.Value)
+}
+
+type errorHandlerKey struct{}
+
+// WithErrorHandler returns a context by which the evaluations by EvaluateContext call handler
+// with every panic recovered into nil
+func WithErrorHandler(ctx context.Context, handler func(err *EvaluationError)) context.Context {
+	return context.WithValue(ctx, errorHandlerKey{}, handler)
+}
+
+type scratchKey struct{}
+
+// WithScratch returns a context by which the evaluations by EvaluateContext keep the states written by
+// stateful functions in scratch, leaving their store unchanged
+func WithScratch(ctx context.Context, scratch *function.Scratch) context.Context {
+	return context.WithValue(ctx, scratchKey{}, scratch)
 }
 
 func NewGoResolver(node ast.Expr, funcs function.Functions) Resolver {
-	return &goResolver{node: node, funcs: funcs}
+	r, _ := newGoResolver(node, funcs)
+	return r
 }
 
-func (r *goResolver) Evaluate(obj interface{}) interface{} {
-	return r.visit(r.node, obj)
+func newGoResolver(node ast.Expr, funcs function.Functions) (*goResolver, error) {
+	r := &goResolver{node: node, funcs: funcs}
+	err := r.prepareCalls()
+	return r, err
 }
 
-func (r *goResolver) visitBinaryExpression(exp *ast.BinaryExpr, obj interface{}) (ret interface{}) {
+// prepareCalls compiles the literal regex patterns and templates, and records the call sites of stateful functions
+func (r *goResolver) prepareCalls() (err error) {
+	ast.Inspect(r.node, func(node ast.Node) bool {
+		if lit, ok := node.(*ast.BasicLit); ok && lit.Kind == token.STRING && IsTemplate(lit.Value) {
+			t, e := ParseTemplate(lit.Value[1:len(lit.Value)-1], DefaultGoParser, r.funcs)
+			if e != nil {
+				if err == nil {
+					err = e
+				}
+				return true
+			}
+			if r.literals == nil {
+				r.literals = map[*ast.BasicLit]*Template{}
+			}
+			r.literals[lit] = t
+			return true
+		}
+		call, ok := node.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		ident, ok := call.Fun.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if strings.EqualFold(ident.Name, "template") && len(call.Args) > 0 {
+			if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				t, e := ParseTemplate(lit.Value[1:len(lit.Value)-1], DefaultGoParser, r.funcs)
+				if e != nil {
+					if err == nil {
+						err = e
+					}
+					return true
+				}
+				if r.formats == nil {
+					r.formats = map[*ast.CallExpr]*Template{}
+				}
+				r.formats[call] = t
+			}
+			return true
+		}
+		if function.IsStatefulFunction(ident.Name) {
+			if r.sites == nil {
+				r.sites = map[*ast.CallExpr]string{}
+			}
+			site := types.ExprString(call)
+			if sites, ok := r.funcs.(function.CallSites); ok {
+				site = sites.CallSite(site)
+			}
+			r.sites[call] = site
+			return true
+		}
+		if len(call.Args) < 2 || !function.IsPatternFunction(ident.Name) || r.funcs != nil && r.funcs.Exists(ident.Name) {
+			return true
+		}
+		lit, ok := call.Args[1].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		re, e := function.CompileRegex(lit.Value[1 : len(lit.Value)-1])
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			return true
+		}
+		if r.patterns == nil {
+			r.patterns = map[*ast.BasicLit]*regexp.Regexp{}
+		}
+		r.patterns[lit] = re
+		return true
+	})
+	return
+}
+
+func (r *goResolver) Evaluate(obj interface{}) (ret interface{}) {
 	defer func() {
 		if err := recover(); err != nil {
+			if _, ok := err.(*function.CastError); !ok {
+				panic(err)
+			}
 			ret = nil
 		}
 	}()
+	return r.visit(r.node, obj)
+}
+
+func (r *goResolver) EvaluateContext(ctx context.Context, obj interface{}) (ret interface{}, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	evaluation := *r
+	evaluation.ctx = ctx
+	evaluation.onError, _ = ctx.Value(errorHandlerKey{}).(func(err *EvaluationError))
+	if scratch, ok := ctx.Value(scratchKey{}).(*function.Scratch); ok {
+		evaluation.scratch = scratch
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			switch e := e.(type) {
+			case *canceled:
+				ret, err = nil, e.err
+			case *function.CastError:
+				ret = nil
+				evaluation.reportError(evaluation.node, e)
+			default:
+				panic(e)
+			}
+		}
+	}()
+	return evaluation.visit(evaluation.node, obj), nil
+}
+
+// canceled is panicked when the context of an evaluation is done, which aborts the whole evaluation
+type canceled struct {
+	err error
+}
+
+// checkContext panics canceled when the context of the evaluation is done
+func (r *goResolver) checkContext() {
+	if r.ctx == nil {
+		return
+	}
+	if err := r.ctx.Err(); err != nil {
+		panic(&canceled{err: err})
+	}
+}
+
+// render renders t on obj with the context and the scratch of the evaluation
+func (r *goResolver) render(t *Template, obj interface{}) string {
+	ctx := r.ctx
+	if ctx == nil && r.scratch != nil {
+		ctx = WithScratch(context.Background(), r.scratch)
+	}
+	text, err := t.RenderContext(ctx, obj)
+	if err != nil {
+		panic(&canceled{err: err})
+	}
+	return text
+}
+
+// recoverValue is deferred by visitors to turn a panic of exp into nil, except for a CastError or a cancellation
+// which aborts the whole evaluation
+func (r *goResolver) recoverValue(exp ast.Expr, ret *interface{}) {
+	if err := recover(); err != nil {
+		switch err.(type) {
+		case *function.CastError, *canceled:
+			panic(err)
+		}
+		*ret = nil
+		r.reportError(exp, err)
+	}
+}
+
+// reportError calls the error handler of the evaluation with a panic of exp
+func (r *goResolver) reportError(exp ast.Expr, value interface{}) {
+	if r.tracer != nil && r.tracer.current != nil {
+		r.tracer.current.Error = fmt.Sprint(value)
+	}
+	if r.onError != nil {
+		r.onError(&EvaluationError{Expr: types.ExprString(exp), Value: value})
+	}
+}
+
+func (r *goResolver) visitBinaryExpression(exp *ast.BinaryExpr, obj interface{}) (ret interface{}) {
+	defer r.recoverValue(exp, &ret)
 
 	var bx, by interface{}
 	if exp.Y != nil {
@@ -176,6 +390,10 @@ func (r *goResolver) visitArrayIndexExpression(exp *ast.IndexExpr, obj interface
 	if index == nil {
 		return nil
 	}
+	if key, ok := index.(string); ok { //obj['@timestamp']
+		ret, _ = utils.GetField(val, key)
+		return ret
+	}
 	indexValue := reflect.ValueOf(index)
 
 	defer func() {
@@ -195,16 +413,15 @@ func (r *goResolver) visitArrayIndexExpression(exp *ast.IndexExpr, obj interface
 }
 
 func (r *goResolver) visitFuncExpression(exp *ast.CallExpr, obj interface{}) (ret interface{}) {
-	defer func() {
-		if err := recover(); err != nil {
-			ret = nil
-		}
-	}()
+	defer r.recoverValue(exp, &ret)
 
 	ident, ok := exp.Fun.(*ast.Ident)
 	if !ok {
 		return nil
 	}
+	if strings.EqualFold(ident.Name, "template") && (r.funcs == nil || !r.funcs.Exists(ident.Name)) {
+		return r.visitTemplate(exp, obj)
+	}
 
 	var args []interface{}
 	length := len(exp.Args)
@@ -215,17 +432,67 @@ func (r *goResolver) visitFuncExpression(exp *ast.CallExpr, obj interface{}) (re
 	for i, arg := range exp.Args {
 		args[i] = r.visit(arg, obj)
 	}
+	if site, ok := r.sites[exp]; ok {
+		if r.scratch != nil {
+			args = append(args, &function.ScratchSite{Site: site, Scratch: r.scratch})
+		} else {
+			args = append(args, site)
+		}
+	} else if function.IsRootFunction(ident.Name) {
+		args = append(args, obj)
+	}
 
+	r.checkContext()
 	if r.funcs != nil && r.funcs.Exists(ident.Name) {
 		ret = r.funcs.Call(ident.Name, args)
 	} else {
 		ret = function.DefaultFunctions.Call(ident.Name, args)
 	}
+	r.checkContext()
 
 	return ret
 }
 
+// visitTemplate renders template(format[, obj]) on the object of the second argument, or the input object by default.
+// The format is parsed for every call when it is not a literal.
+func (r *goResolver) visitTemplate(exp *ast.CallExpr, obj interface{}) interface{} {
+	if len(exp.Args) == 0 || len(exp.Args) > 2 {
+		return nil
+	}
+	t, ok := r.formats[exp]
+	if !ok {
+		format, ok := r.visit(exp.Args[0], obj).(string)
+		if !ok {
+			return nil
+		}
+		var err error
+		if t, err = ParseTemplate(format, DefaultGoParser, r.funcs); err != nil {
+			return nil
+		}
+	}
+	if len(exp.Args) == 2 {
+		obj = r.visit(exp.Args[1], obj)
+	}
+	return r.render(t, obj)
+}
+
+func isArray(obj interface{}) bool {
+	if obj == nil {
+		return false
+	}
+	kind := reflect.TypeOf(obj).Kind()
+	return kind == reflect.Slice || kind == reflect.Array
+}
+
 func (r *goResolver) visit(node ast.Expr, obj interface{}) interface{} {
+	r.checkContext()
+	if r.tracer != nil {
+		return r.tracer.visit(r, node, obj)
+	}
+	return r.visitNode(node, obj)
+}
+
+func (r *goResolver) visitNode(node ast.Expr, obj interface{}) interface{} {
 	switch exp := node.(type) {
 	case *ast.BinaryExpr:
 		return r.visitBinaryExpression(exp, obj)
@@ -244,6 +511,12 @@ func (r *goResolver) visit(node ast.Expr, obj interface{}) interface{} {
 			}
 			return x
 		case token.STRING:
+			if re, ok := r.patterns[exp]; ok {
+				return re
+			}
+			if t, ok := r.literals[exp]; ok {
+				return r.render(t, obj)
+			}
 			return exp.Value[1 : len(exp.Value)-1] //remove "
 		}
 		break
@@ -256,10 +529,9 @@ func (r *goResolver) visit(node ast.Expr, obj interface{}) interface{} {
 		case "false":
 			return false
 		default:
-			if mp, ok := obj.(map[string]interface{}); ok {
-				if val, ok := mp[exp.Name]; ok {
-					return val
-				}
+			if !isArray(obj) { //the root of an array is root[index]
+				val, _ := utils.GetField(obj, exp.Name)
+				return val
 			}
 		}
 		break
@@ -268,26 +540,13 @@ func (r *goResolver) visit(node ast.Expr, obj interface{}) interface{} {
 		if x == nil {
 			return nil
 		}
-		if mp, ok := x.(map[string]interface{}); ok {
-			if val, ok := mp[exp.Sel.Name]; ok {
-				return val
-			}
-		} else if arrMap, ok := x.([]map[string]interface{}); ok {
-			var ret []interface{}
-			for _, mp := range arrMap {
-				if val, ok := mp[exp.Sel.Name]; ok {
-					ret = append(ret, val)
-				}
-			}
-			return ret
-		}
-		break
+		//the members of the objects of an array are returned in an array
+		val, _ := utils.GetField(x, exp.Sel.Name)
+		return val
 	case *ast.CallExpr:
 		return r.visitFuncExpression(exp, obj)
-		break
 	case *ast.IndexExpr:
 		return r.visitArrayIndexExpression(exp, obj)
-		break
 	case *ast.UnaryExpr:
 		x := r.visit(exp.X, obj)
 		if x == nil {
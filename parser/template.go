@@ -0,0 +1,173 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/function"
+	"github.com/sdghchj/sql-rules-engine/utils"
+	"strings"
+)
+
+var ErrInvalidTemplate = errors.New("invalid template")
+
+// Template is a text with placeholders ${expr} or ${expr:%verb}, which is parsed once and rendered for every object.
+// $$ writes a single $.
+type Template struct {
+	text  string
+	parts []*templatePart
+}
+
+type templatePart struct {
+	text     string
+	resolver Resolver
+	verb     string
+}
+
+// IsTemplate reports whether text is a raw string literal `...` with placeholders
+func IsTemplate(text string) bool {
+	return len(text) > 1 && text[0] == '`' && text[len(text)-1] == '`' && strings.Contains(text, "${")
+}
+
+// ParseTemplate parses the content of a template, the expressions of the placeholders are parsed by p with funcs
+func ParseTemplate(text string, p Parser, funcs function.Functions) (*Template, error) {
+	t := &Template{text: text}
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '$' || i+1 >= len(text) {
+			sb.WriteByte(text[i])
+			continue
+		}
+		if text[i+1] == '$' {
+			sb.WriteByte('$')
+			i++
+			continue
+		} else if text[i+1] != '{' {
+			sb.WriteByte('$')
+			continue
+		}
+
+		end := placeholderEnd(text, i+2)
+		if end < 0 {
+			return nil, ErrInvalidTemplate
+		}
+		expr, verb := strings.TrimSpace(text[i+2:end]), ""
+		if n := strings.LastIndex(expr, ":%"); n >= 0 {
+			expr, verb = strings.TrimSpace(expr[:n]), expr[n+1:]
+		}
+		if expr == "" {
+			return nil, ErrInvalidTemplate
+		}
+		resolver, err := p.Parse(expr, funcs)
+		if err != nil {
+			return nil, err
+		}
+		if sb.Len() > 0 {
+			t.parts = append(t.parts, &templatePart{text: sb.String()})
+			sb.Reset()
+		}
+		t.parts = append(t.parts, &templatePart{resolver: resolver, verb: verb})
+		i = end
+	}
+	if sb.Len() > 0 {
+		t.parts = append(t.parts, &templatePart{text: sb.String()})
+	}
+	return t, nil
+}
+
+// placeholderEnd returns the index of the } closing a placeholder, skipping the braces in quotes or nested, or -1
+func placeholderEnd(text string, start int) int {
+	depth := 0
+	var quote byte
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		if quote != 0 {
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// Render writes the values of the placeholders evaluated on obj into the text, a null value writes nothing
+func (t *Template) Render(obj interface{}) string {
+	text, _ := t.RenderContext(nil, obj)
+	return text
+}
+
+// RenderContext is Render which stops with the error of ctx when it is done, a nil ctx is never done
+func (t *Template) RenderContext(ctx context.Context, obj interface{}) (string, error) {
+	var sb strings.Builder
+	for _, part := range t.parts {
+		if part.resolver == nil {
+			sb.WriteString(part.text)
+			continue
+		}
+		var val interface{}
+		if ctx == nil {
+			val = part.resolver.Evaluate(obj)
+		} else {
+			var err error
+			if val, err = part.resolver.EvaluateContext(ctx, obj); err != nil {
+				return "", err
+			}
+		}
+		if val == nil {
+			continue
+		}
+		if part.verb != "" {
+			sb.WriteString(formatVerb(part.verb, val))
+		} else if text, ok := function.DefaultFunctions.Call("try_cast", []interface{}{val, "string"}).(string); ok {
+			sb.WriteString(text)
+		} else {
+			sb.WriteString(fmt.Sprint(val))
+		}
+	}
+	return sb.String(), nil
+}
+
+// String returns the text of the template
+func (t *Template) String() string {
+	return t.text
+}
+
+// Functions returns the functions called by the placeholders of the template
+func (t *Template) Functions() []Function {
+	var funcs []Function
+	for _, part := range t.parts {
+		if part.resolver != nil {
+			funcs = appendFunctions(funcs, part.resolver.Functions()...)
+		}
+	}
+	return funcs
+}
+
+// formatVerb formats val by fmt, an integral float is formatted as an integer by the integer verbs
+func formatVerb(verb string, val interface{}) string {
+	switch verb[len(verb)-1] {
+	case 'd', 'b', 'o', 'O', 'x', 'X', 'c', 'U':
+		if f, ok := val.(float64); ok && f == float64(int64(f)) {
+			val = int64(f)
+		}
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		if f, err := utils.GetFloat64(val); err == nil {
+			val = f
+		}
+	}
+	return fmt.Sprintf(verb, val)
+}
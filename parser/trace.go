@@ -0,0 +1,217 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/function"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// TraceNode is the value of an expression evaluated, with the ones of its sub-expressions evaluated for it
+// in the order of the expression. The sub-expressions skipped, such as the left side of && when the right side
+// is false, and the literals are not in Children.
+type TraceNode struct {
+	Expr     string       `json:"expr"`
+	Value    interface{}  `json:"value"`
+	Error    string       `json:"error,omitempty"` //of a panic, which makes the expressions up to the one recovering it null
+	Children []*TraceNode `json:"children,omitempty"`
+	pos      token.Pos
+}
+
+// String returns the tree indented by two spaces per level, one expression per line, such as
+//
+//	a > 1 && b == "x" = false
+//	  b == "x" = false
+//	    b = "y"
+func (n *TraceNode) String() string {
+	var sb strings.Builder
+	n.write(&sb, 0)
+	return sb.String()
+}
+
+func (n *TraceNode) write(sb *strings.Builder, depth int) {
+	sb.WriteString(strings.Repeat("  ", depth))
+	sb.WriteString(n.Expr)
+	sb.WriteString(" = ")
+	sb.WriteString(FormatValue(n.Value))
+	if n.Error != "" {
+		sb.WriteString("  ! ")
+		sb.WriteString(n.Error)
+	}
+	sb.WriteByte('\n')
+	for _, child := range n.Children {
+		child.write(sb, depth+1)
+	}
+}
+
+// FormatValue formats a value in json, or by fmt when it is not valid json
+func FormatValue(val interface{}) string {
+	if bin, err := json.Marshal(val); err == nil {
+		return string(bin)
+	}
+	return fmt.Sprint(val)
+}
+
+// tracer builds the tree of an evaluation by Trace
+type tracer struct {
+	root    *TraceNode
+	current *TraceNode
+}
+
+func (t *tracer) visit(r *goResolver, node ast.Expr, obj interface{}) (ret interface{}) {
+	if lit, ok := node.(*ast.BasicLit); ok && r.literals[lit] == nil {
+		return r.visitNode(node, obj)
+	}
+	n := &TraceNode{Expr: types.ExprString(node), pos: node.Pos()}
+	parent := t.current
+	if parent == nil {
+		t.root = n
+	} else {
+		parent.Children = append(parent.Children, n)
+	}
+	t.current = n
+	defer func() {
+		t.current = parent
+		sort.SliceStable(n.Children, func(i, j int) bool {
+			return n.Children[i].pos < n.Children[j].pos
+		})
+		if err := recover(); err != nil {
+			if e, ok := err.(*canceled); ok {
+				n.Error = e.err.Error()
+			} else {
+				n.Error = fmt.Sprint(err)
+			}
+			panic(err)
+		}
+		n.Value = ret
+	}()
+	return r.visitNode(node, obj)
+}
+
+func (r *goResolver) Trace(obj interface{}) *TraceNode {
+	evaluation := *r
+	evaluation.tracer = &tracer{}
+	evaluation.scratch = function.NewScratch()
+	evaluation.Evaluate(obj)
+	return evaluation.tracer.root
+}
+
+func (r *goResolver) String() string {
+	return types.ExprString(r.node)
+}
+
+// FunctionKind is where a function called by an expression is resolved
+type FunctionKind string
+
+const (
+	FunctionBuiltin   FunctionKind = "builtin"   // a function of this package
+	FunctionRule      FunctionKind = "rule"      // a function registered for the rule, such as by Engine.RegisterRuleFunction
+	FunctionStateful  FunctionKind = "stateful"  // a stateful function of the rule
+	FunctionUndefined FunctionKind = "undefined" // evaluates to null
+)
+
+// Function is a function called by an expression
+type Function struct {
+	Name string
+	Kind FunctionKind
+}
+
+func (f Function) String() string {
+	return f.Name + " (" + string(f.Kind) + ")"
+}
+
+// appendFunctions appends the functions not in funcs yet
+func appendFunctions(funcs []Function, more ...Function) []Function {
+	for _, f := range more {
+		found := false
+		for _, g := range funcs {
+			if strings.EqualFold(f.Name, g.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			funcs = append(funcs, f)
+		}
+	}
+	return funcs
+}
+
+func (r *goResolver) Functions() []Function {
+	var funcs []Function
+	ast.Inspect(r.node, func(node ast.Node) bool {
+		if lit, ok := node.(*ast.BasicLit); ok {
+			if t, ok := r.literals[lit]; ok {
+				funcs = appendFunctions(funcs, t.Functions()...)
+			}
+			return true
+		}
+		call, ok := node.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		ident, ok := call.Fun.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		f := Function{Name: ident.Name, Kind: FunctionUndefined}
+		if r.funcs != nil && r.funcs.Exists(ident.Name) {
+			f.Kind = FunctionRule
+			if function.IsStatefulFunction(ident.Name) {
+				f.Kind = FunctionStateful
+			}
+		} else if strings.EqualFold(ident.Name, "template") || function.DefaultFunctions.Exists(ident.Name) {
+			f.Kind = FunctionBuiltin
+		}
+		funcs = appendFunctions(funcs, f)
+		if t, ok := r.formats[call]; ok {
+			funcs = appendFunctions(funcs, t.Functions()...)
+		}
+		return true
+	})
+	return funcs
+}
+
+func (r *goResolver) Keys() []string {
+	var keys []string
+	seen := map[string]bool{}
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	var inspect func(node ast.Node) bool
+	inspect = func(node ast.Node) bool {
+		switch exp := node.(type) {
+		case *ast.CallExpr: //the names of functions are not keys
+			for _, arg := range exp.Args {
+				ast.Inspect(arg, inspect)
+			}
+			return false
+		case *ast.SelectorExpr: //nor the members of keys
+			ast.Inspect(exp.X, inspect)
+			return false
+		case *ast.IndexExpr:
+			if idt, ok := exp.X.(*ast.Ident); ok && strings.EqualFold(idt.Name, "root") {
+				if lit, ok := exp.Index.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					add(lit.Value[1 : len(lit.Value)-1])
+				} else {
+					ast.Inspect(exp.Index, inspect)
+				}
+				return false
+			}
+		case *ast.Ident:
+			if exp.Name != "nil" && exp.Name != "true" && exp.Name != "false" {
+				add(exp.Name)
+			}
+		}
+		return true
+	}
+	ast.Inspect(r.node, inspect)
+	return keys
+}
@@ -0,0 +1,119 @@
+package rule
+
+import (
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/handler"
+	"github.com/sdghchj/sql-rules-engine/parser"
+	"sort"
+	"strings"
+)
+
+type explainer interface {
+	Explain() string
+}
+
+type tracer interface {
+	Trace(obj interface{}) *parser.TraceNode
+}
+
+func indent(text string) string {
+	return strings.Replace(text, "\n", "\n  ", -1)
+}
+
+func joinFunctions(funcs []parser.Function) string {
+	names := make([]string, len(funcs))
+	for i, f := range funcs {
+		names[i] = f.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+func explainHandler(h handler.Handler) string {
+	if e, ok := h.(explainer); ok {
+		return e.Explain()
+	}
+	return fmt.Sprintf("handler %T", h)
+}
+
+func explainHandlers(handlers []handler.Handler) string {
+	texts := make([]string, len(handlers))
+	for i, h := range handlers {
+		texts[i] = explainHandler(h)
+	}
+	return strings.Join(texts, "\n")
+}
+
+// traceHandlers handles obj by handlers in order, returning the output with the trace of every handler run
+func traceHandlers(handlers []handler.Handler, obj interface{}) (interface{}, []*parser.TraceNode) {
+	var nodes []*parser.TraceNode
+	for _, h := range handlers {
+		if obj == nil {
+			break
+		}
+		var node *parser.TraceNode
+		if t, ok := h.(tracer); ok {
+			node = t.Trace(obj)
+		} else {
+			node = &parser.TraceNode{Expr: strings.SplitN(explainHandler(h), "\n", 2)[0], Value: h.Handle(obj)}
+		}
+		nodes = append(nodes, node)
+		obj = node.Value
+	}
+	return obj, nodes
+}
+
+// String returns the call in sql, such as republish('alerts', retries = 3)
+func (c ActionCall) String() string {
+	args := make([]string, 0, len(c.Args)+len(c.Params))
+	for _, arg := range c.Args {
+		args = append(args, formatLiteral(arg))
+	}
+	names := make([]string, 0, len(c.Params))
+	for name := range c.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, name+" = "+formatLiteral(c.Params[name]))
+	}
+	return c.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func formatLiteral(val interface{}) string {
+	if s, ok := val.(string); ok {
+		return "'" + strings.Replace(s, "'", "''", -1) + "'"
+	}
+	return parser.FormatValue(val)
+}
+
+// Explain describes the plan of the rule: its handlers in order, such as the filter, the mapper and the sorter,
+// with the expressions parsed and the functions they call, followed by its actions
+func (r *jsonRule) Explain() string {
+	lines := []string{fmt.Sprintf("RULE %q", r.name)}
+	for _, h := range r.handlers {
+		lines = append(lines, "  "+indent(explainHandler(h)))
+	}
+	if r.partition != nil {
+		lines = append(lines, "  PARTITION BY "+r.partition.String())
+	}
+	if r.budget > 0 {
+		lines = append(lines, "  TIME BUDGET "+r.budget.String())
+	}
+	if len(r.actions) > 0 {
+		calls := make([]string, len(r.actions))
+		for i, call := range r.actions {
+			calls[i] = call.String()
+		}
+		lines = append(lines, "  DO "+strings.Join(calls, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Trace handles obj, returning the output with the trace of every handler, which holds the value of every
+// sub-expression evaluated. The async handlers are not run, the output is not recorded by the metrics,
+// and the stateful functions read their states without writing them.
+func (r *jsonRule) Trace(obj interface{}) *parser.TraceNode {
+	node := &parser.TraceNode{Expr: fmt.Sprintf("RULE %q", r.name)}
+	node.Value, node.Children = traceHandlers(r.handlers, obj)
+	return node
+}
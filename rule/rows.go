@@ -0,0 +1,158 @@
+package rule
+
+import (
+	"context"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/handler"
+	"github.com/sdghchj/sql-rules-engine/parser"
+	"github.com/sdghchj/sql-rules-engine/utils"
+	"reflect"
+)
+
+type keyOrderer interface {
+	KeyOrder() *utils.KeyOrder
+}
+
+// keyOrderOf returns the key order of the last handler which decides the output keys, such as a mapper
+func keyOrderOf(handlers []handler.Handler) *utils.KeyOrder {
+	for i := len(handlers) - 1; i >= 0; i-- {
+		if o, ok := handlers[i].(keyOrderer); ok {
+			if order := o.KeyOrder(); order != nil {
+				return order
+			}
+		}
+	}
+	return nil
+}
+
+// rowsHandler applies its handlers to every element of an array as rows, dropping the rows handled into nil.
+// Other values are handled as a single row.
+type rowsHandler struct {
+	handlers []handler.Handler
+}
+
+func (h *rowsHandler) handleRow(obj interface{}) interface{} {
+	for _, cvt := range h.handlers {
+		if obj == nil {
+			break
+		}
+		obj = cvt.Handle(obj)
+	}
+	return obj
+}
+
+func (h *rowsHandler) Handle(obj interface{}) interface{} {
+	if obj == nil {
+		return nil
+	}
+	val := reflect.ValueOf(obj)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return h.handleRow(obj)
+	}
+
+	length := val.Len()
+	rows := make([]interface{}, 0, length)
+	for i := 0; i < length; i++ {
+		if row := h.handleRow(val.Index(i).Interface()); row != nil {
+			rows = append(rows, row)
+		}
+	}
+	if _, ok := obj.(handler.Results); ok {
+		return handler.Results(rows)
+	}
+	return rows
+}
+
+func (h *rowsHandler) handleRowContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	for _, cvt := range h.handlers {
+		if obj == nil {
+			break
+		}
+		var err error
+		if obj, err = handleStage(ctx, cvt, obj); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// HandleContext is Handle which returns the error of ctx once ctx is done, which is checked for every row
+func (h *rowsHandler) HandleContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	if obj == nil {
+		return nil, ctx.Err()
+	}
+	val := reflect.ValueOf(obj)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return h.handleRowContext(ctx, obj)
+	}
+
+	length := val.Len()
+	rows := make([]interface{}, 0, length)
+	for i := 0; i < length; i++ {
+		row, err := h.handleRowContext(ctx, val.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if row != nil {
+			rows = append(rows, row)
+		}
+	}
+	if _, ok := obj.(handler.Results); ok {
+		return handler.Results(rows), nil
+	}
+	return rows, nil
+}
+
+func (h *rowsHandler) Explain() string {
+	return "FOR EACH ROW\n  " + indent(explainHandlers(h.handlers))
+}
+
+// Trace handles the rows, returning the output with the traces of the handlers of every row
+func (h *rowsHandler) Trace(obj interface{}) *parser.TraceNode {
+	node := &parser.TraceNode{Expr: "FOR EACH ROW"}
+	if obj == nil {
+		return node
+	}
+	val := reflect.ValueOf(obj)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		node.Value, node.Children = traceHandlers(h.handlers, obj)
+		return node
+	}
+
+	length := val.Len()
+	rows := make([]interface{}, 0, length)
+	for i := 0; i < length; i++ {
+		row := &parser.TraceNode{Expr: fmt.Sprintf("row %d", i)}
+		row.Value, row.Children = traceHandlers(h.handlers, val.Index(i).Interface())
+		node.Children = append(node.Children, row)
+		if row.Value != nil {
+			rows = append(rows, row.Value)
+		}
+	}
+	if _, ok := obj.(handler.Results); ok {
+		node.Value = handler.Results(rows)
+	} else {
+		node.Value = rows
+	}
+	return node
+}
+
+func (h *rowsHandler) KeyOrder() *utils.KeyOrder {
+	return keyOrderOf(h.handlers)
+}
+
+func (h *rowsHandler) HandleAsync(obj interface{}) {
+	val := reflect.ValueOf(obj)
+	if obj == nil || val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		for _, cvt := range h.handlers {
+			cvt.HandleAsync(obj)
+		}
+		return
+	}
+
+	for i := 0; i < val.Len(); i++ {
+		for _, cvt := range h.handlers {
+			cvt.HandleAsync(val.Index(i).Interface())
+		}
+	}
+}
@@ -1,16 +1,28 @@
 package rule
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/sdghchj/sql-rules-engine/deadletter"
+	"github.com/sdghchj/sql-rules-engine/executor"
 	"github.com/sdghchj/sql-rules-engine/filter"
+	"github.com/sdghchj/sql-rules-engine/flatten"
 	"github.com/sdghchj/sql-rules-engine/function"
 	"github.com/sdghchj/sql-rules-engine/handler"
+	"github.com/sdghchj/sql-rules-engine/internal/sqltoken"
 	"github.com/sdghchj/sql-rules-engine/mapper"
-	"go/scanner"
+	"github.com/sdghchj/sql-rules-engine/metrics"
+	"github.com/sdghchj/sql-rules-engine/order"
+	"github.com/sdghchj/sql-rules-engine/parser"
+	"github.com/sdghchj/sql-rules-engine/utils"
 	"go/token"
+	"io"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Rule interface {
@@ -21,17 +33,52 @@ type Rule interface {
 	AddHandler(cvt handler.Handler) Rule
 	InsertHandler(index int, cvt handler.Handler) Rule
 	Handle(obj interface{}) interface{}
+	HandleAll(obj interface{}) []interface{}
 	HandleAsync(obj interface{})
 	ConvertJson(jsonText string) (string, error)
+	HandleContext(ctx context.Context, obj interface{}) (interface{}, error)
+	HandleAllContext(ctx context.Context, obj interface{}) ([]interface{}, error)
+	ConvertJsonContext(ctx context.Context, jsonText string) (string, error)
+	SetTimeBudget(budget time.Duration) Rule
+	SetErrorHandler(h ErrorHandler) Rule
+	SetMetrics(m *metrics.Rule) Rule
+	Explain() string
+	Trace(obj interface{}) *parser.TraceNode
+	ConvertJsonStream(reader io.Reader, writer io.Writer) error
+	SetNullPolicy(policy mapper.NullPolicy) Rule
+	Actions() []ActionCall
+	SetExecutor(exec executor.Executor) Rule
+	SetPartitionKey(expr string) error
 }
 
+// ActionCall is an action of the DO clause of a sql, such as republish('alerts/${topic(2)}', retries = 3)
+type ActionCall struct {
+	Name   string
+	Args   []interface{}          //the positional arguments
+	Params map[string]interface{} //the named arguments
+}
+
+// ErrorHandler receives an error of a rule at a stage with the payload failing, which is the json text at
+// deadletter.StageDecode and the input of the rule otherwise
+type ErrorHandler func(stage deadletter.Stage, payload interface{}, err error)
+
 type jsonRule struct {
-	name     string
-	pretty   bool
-	handlers []handler.Handler
+	name       string
+	pretty     bool
+	handlers   []handler.Handler
+	nullPolicy mapper.NullPolicy
+	actions    []ActionCall
+	exec       executor.Executor
+	partition  parser.Resolver
+	budget     time.Duration
+	onError    ErrorHandler
+	metrics    *metrics.Rule
 }
 
 var ErrorSqlError = errors.New("sql error")
+var ErrOrderNotSelected = errors.New("order by a key not selected")
+
+var flattenRegexp = regexp.MustCompile(`^(?i)(un)?flatten\(\*((?:,[^,()]+)*)\)$`)
 
 func NewJsonRule(pretty bool) Rule {
 	return &jsonRule{pretty: pretty}
@@ -59,7 +106,168 @@ func (r *jsonRule) InsertHandler(index int, cvt handler.Handler) Rule {
 	return r
 }
 
+// SetNullPolicy sets the policy of the fields evaluated to null in the select list, mapper.NullOmit by default.
+// The fields with DEFAULT keep their own policy.
+func (r *jsonRule) SetNullPolicy(policy mapper.NullPolicy) Rule {
+	r.nullPolicy = policy
+	setNullPolicy(r.handlers, policy)
+	return r
+}
+
+// SetExecutor runs the async event handlers of the rule by exec, the ones of the same partition key in order
+func (r *jsonRule) SetExecutor(exec executor.Executor) Rule {
+	r.exec = exec
+	setExecutor(r.handlers, exec, r.partitionKey)
+	return r
+}
+
+// SetPartitionKey sets the expression of the partition key of the objects handled asynchronously,
+// the async event handlers of the objects of the same key run in the order of the objects by an executor
+func (r *jsonRule) SetPartitionKey(expr string) error {
+	resolver, err := parser.DefaultGoParser.Parse(expr, nil)
+	if err != nil {
+		return err
+	}
+	r.partition = resolver
+	return nil
+}
+
+// partitionKey is unique for every rule, or empty when there is no partition key
+func (r *jsonRule) partitionKey(obj interface{}) string {
+	if r.partition == nil {
+		return ""
+	}
+	return fmt.Sprintf("%p/%v", r, r.partition.Evaluate(obj))
+}
+
+func setExecutor(handlers []handler.Handler, exec executor.Executor, key func(obj interface{}) string) {
+	for _, h := range handlers {
+		if f, ok := h.(filter.FieldFilter); ok {
+			f.SetExecutor(exec, key)
+		} else if rows, ok := h.(*rowsHandler); ok {
+			setExecutor(rows.handlers, exec, key)
+		}
+	}
+}
+
+// SetErrorHandler reports the json failing to decode, the panics of the expressions recovered into nil,
+// and the panics of the async event handlers and the ones the executor did not run to h
+func (r *jsonRule) SetErrorHandler(h ErrorHandler) Rule {
+	r.onError = h
+	setAsyncReporters(r.handlers, r.panicHandler(), r.dropHandler())
+	return r
+}
+
+// panicHandler reports the panics of the async event handlers, or nil when there is no error handler
+func (r *jsonRule) panicHandler() func(obj interface{}, v interface{}) {
+	h := r.onError
+	if h == nil {
+		return nil
+	}
+	return func(obj interface{}, v interface{}) {
+		h(deadletter.StageHandler, obj, fmt.Errorf("async handler panicked: %v", v))
+	}
+}
+
+// dropHandler reports the async event handlers the executor did not run, or nil when there is no error handler
+// nor metrics
+func (r *jsonRule) dropHandler() func(obj interface{}, err error) {
+	h, m := r.onError, r.metrics
+	if h == nil && m == nil {
+		return nil
+	}
+	return func(obj interface{}, err error) {
+		if h != nil {
+			h(deadletter.StageHandler, obj, fmt.Errorf("async handler not run: %v", err))
+		}
+		if m != nil {
+			m.ObserveDropped()
+		}
+	}
+}
+
+func setAsyncReporters(handlers []handler.Handler, onPanic func(obj interface{}, v interface{}), onDrop func(obj interface{}, err error)) {
+	for _, h := range handlers {
+		if f, ok := h.(filter.FieldFilter); ok {
+			f.SetPanicHandler(onPanic)
+			f.SetDropHandler(onDrop)
+		} else if rows, ok := h.(*rowsHandler); ok {
+			setAsyncReporters(rows.handlers, onPanic, onDrop)
+		}
+	}
+}
+
+// SetMetrics records the messages handled by the rule into m
+func (r *jsonRule) SetMetrics(m *metrics.Rule) Rule {
+	r.metrics = m
+	setAsyncReporters(r.handlers, r.panicHandler(), r.dropHandler())
+	return r
+}
+
+// contextual reports whether the rule is always evaluated with a context, for its time budget, errors or metrics
+func (r *jsonRule) contextual() bool {
+	return r.budget > 0 || r.onError != nil || r.metrics != nil
+}
+
+// decodeFailed reports the json payload failing to decode
+func (r *jsonRule) decodeFailed(payload interface{}, err error) {
+	if r.onError != nil {
+		r.onError(deadletter.StageDecode, payload, err)
+	}
+	if r.metrics != nil {
+		r.metrics.ObserveFailure()
+	}
+}
+
+// observe records a message handled since start into obj
+func (r *jsonRule) observe(start time.Time, obj interface{}, failed bool) {
+	if r.metrics != nil {
+		r.metrics.Observe(time.Since(start), len(outputs(obj)), failed)
+	}
+}
+
+type reporterKey struct{}
+
+// handleStage handles obj by h with ctx, whose evaluation errors are reported with the stage of h
+// when ctx has a reporter of the rule
+func handleStage(ctx context.Context, h handler.Handler, obj interface{}) (interface{}, error) {
+	if report, ok := ctx.Value(reporterKey{}).(func(deadletter.Stage, error)); ok {
+		if _, ok = h.(*rowsHandler); !ok { //the rows report by their own handlers
+			stage := deadletter.StageMap
+			if _, ok = h.(filter.FieldFilter); ok {
+				stage = deadletter.StageFilter
+			}
+			ctx = parser.WithErrorHandler(ctx, func(err *parser.EvaluationError) {
+				report(stage, err)
+			})
+		}
+	}
+	return handler.HandleContext(ctx, h, obj)
+}
+
+func setNullPolicy(handlers []handler.Handler, policy mapper.NullPolicy) {
+	for _, h := range handlers {
+		if mp, ok := h.(mapper.Mapper); ok {
+			mp.SetNullPolicy(policy)
+		} else if rows, ok := h.(*rowsHandler); ok {
+			setNullPolicy(rows.handlers, policy)
+		}
+	}
+}
+
+// SetTimeBudget limits the time of every evaluation of the rule, which stops with context.DeadlineExceeded
+// when it runs out, no limit when budget is not positive.
+// Handle and HandleAll return nil then, and ConvertJson returns the error.
+func (r *jsonRule) SetTimeBudget(budget time.Duration) Rule {
+	r.budget = budget
+	return r
+}
+
 func (r *jsonRule) Handle(obj interface{}) interface{} {
+	if r.contextual() {
+		ret, _ := r.HandleContext(context.Background(), obj)
+		return ret
+	}
 	for _, cvt := range r.handlers {
 		if obj == nil {
 			break
@@ -69,13 +277,80 @@ func (r *jsonRule) Handle(obj interface{}) interface{} {
 	return obj
 }
 
+// HandleContext is Handle which returns nil with the error of ctx once ctx is done or the time budget runs out,
+// which is checked between the rows, the fields and the sub-expressions of the rule
+func (r *jsonRule) HandleContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	if r.budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.budget)
+		defer cancel()
+	}
+	start := time.Now()
+	failed := false
+	if r.onError != nil {
+		input := obj
+		ctx = context.WithValue(ctx, reporterKey{}, func(stage deadletter.Stage, err error) {
+			failed = true
+			r.onError(stage, input, err)
+		})
+	} else if r.metrics != nil {
+		ctx = parser.WithErrorHandler(ctx, func(err *parser.EvaluationError) {
+			failed = true
+		})
+	}
+	for _, cvt := range r.handlers {
+		if obj == nil {
+			break
+		}
+		var err error
+		if obj, err = handleStage(ctx, cvt, obj); err != nil {
+			r.observe(start, nil, true)
+			return nil, err
+		}
+	}
+	r.observe(start, obj, failed)
+	return obj, nil
+}
+
+// outputs returns the outputs of the result of the handlers
+func outputs(obj interface{}) []interface{} {
+	if obj == nil {
+		return nil
+	}
+	if results, ok := obj.(handler.Results); ok {
+		return results
+	}
+	return []interface{}{obj}
+}
+
+// HandleAll returns every output of obj, which are more than one when the rule fans obj out by UNNEST
+func (r *jsonRule) HandleAll(obj interface{}) []interface{} {
+	return outputs(r.Handle(obj))
+}
+
+// HandleAllContext is HandleAll which returns the error of ctx once ctx is done or the time budget runs out
+func (r *jsonRule) HandleAllContext(ctx context.Context, obj interface{}) ([]interface{}, error) {
+	obj, err := r.HandleContext(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	return outputs(obj), nil
+}
+
 func (r *jsonRule) HandleAsync(obj interface{}) {
+	start := time.Now()
 	for _, cvt := range r.handlers {
 		cvt.HandleAsync(obj)
 	}
+	if r.metrics != nil {
+		r.metrics.ObserveAsync(time.Since(start))
+	}
 }
 
 func (r *jsonRule) ConvertJson(jsonText string) (string, error) {
+	if r.contextual() {
+		return r.ConvertJsonContext(context.Background(), jsonText)
+	}
 	decoder := json.NewDecoder(strings.NewReader(jsonText))
 	//decoder.UseNumber()
 	var obj interface{}
@@ -90,19 +365,75 @@ func (r *jsonRule) ConvertJson(jsonText string) (string, error) {
 		}
 		obj = cvt.Handle(obj)
 	}
-	var bin []byte
-	if r.pretty {
-		bin, err = json.MarshalIndent(obj, "", "    ")
-	} else {
-		bin, err = json.Marshal(obj)
+
+	bin, err := r.marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return string(bin), err
+}
+
+// ConvertJsonContext is ConvertJson which returns the error of ctx once ctx is done or the time budget runs out
+func (r *jsonRule) ConvertJsonContext(ctx context.Context, jsonText string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(jsonText))
+	var obj interface{}
+	err := decoder.Decode(&obj)
+	if err != nil {
+		r.decodeFailed(jsonText, err)
+		return "", err
+	}
+	if obj, err = r.HandleContext(ctx, obj); err != nil {
+		return "", err
 	}
 
+	bin, err := r.marshal(obj)
 	if err != nil {
 		return "", err
 	}
 	return string(bin), err
 }
 
+// marshal encodes obj with the keys in the order of the select list when the rule has a mapper
+func (r *jsonRule) marshal(obj interface{}) ([]byte, error) {
+	indent := ""
+	if r.pretty {
+		indent = "    "
+	}
+	if order := keyOrderOf(r.handlers); order != nil {
+		return utils.MarshalOrdered(obj, order, indent)
+	}
+	if r.pretty {
+		return json.MarshalIndent(obj, "", indent)
+	}
+	return json.Marshal(obj)
+}
+
+// ConvertJsonStream decodes json values from reader one by one, and writes every output of them into writer,
+// each followed by a newline
+func (r *jsonRule) ConvertJsonStream(reader io.Reader, writer io.Writer) error {
+	decoder := json.NewDecoder(reader)
+	for {
+		var obj interface{}
+		err := decoder.Decode(&obj)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			r.decodeFailed(nil, err)
+			return err
+		}
+
+		for _, ret := range r.HandleAll(obj) {
+			bin, err := r.marshal(ret)
+			if err != nil {
+				return err
+			}
+			if _, err = writer.Write(append(bin, '\n')); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 func (r *jsonRule) AddEventHandler(match string, handlers ...handler.EventHandler) error {
 	filter := filter.NewFieldFilter(nil)
 	err := filter.Parse(match, handlers...)
@@ -119,67 +450,390 @@ func (r *jsonRule) AddEventAsyncHandler(match string, asyncHandlers ...handler.A
 	if err != nil {
 		return err
 	}
+	if r.exec != nil {
+		filter.SetExecutor(r.exec, r.partitionKey)
+	}
+	filter.SetPanicHandler(r.panicHandler())
+	filter.SetDropHandler(r.dropHandler())
 	r.AddHandler(filter)
 	return nil
 }
 
 func (r *jsonRule) AddConvertHandlerBySql(sql string, funcs function.Functions) error {
 
-	type sqlToken struct {
-		pos token.Pos
-		tok token.Token
-		lit string
-	}
-
 	type sqlField struct {
-		name  string
-		alias string
+		name       string
+		alias      string
+		hasDefault bool
+		defValue   interface{}
 	}
 
-	var tokens []*sqlToken
-	var s scanner.Scanner
-	fset := token.NewFileSet()
-	file := fset.AddFile("", fset.Base(), len(sql))
-	s.Init(file, []byte(sql), nil, 0)
-	for {
-		pos, tok, lit := s.Scan()
-		if tok == token.EOF {
-			break
-		} else if tok != token.SEMICOLON { //SEMICOLON means \n
-			tokens = append(tokens, &sqlToken{pos, tok, lit})
-		}
+	type sqlOrder struct {
+		expr       string
+		desc       bool
+		nullsFirst bool
 	}
 
-	getError := func(t *sqlToken) error {
-		return errors.New(fmt.Sprintf("%s\t%s\t%q\n", fset.Position(t.pos), t.tok, t.lit))
+	tokens, fset := sqltoken.Scan(sql)
+
+	getError := func(t *sqltoken.Token) error {
+		return errors.New(fmt.Sprintf("%s\t%s\t%q\n", fset.Position(t.Pos), t.Tok, t.Lit))
 	}
 
 	//remove auto-added ;
 	length := len(tokens)
 
+	//a literal: a number, a string, true, false or null, returns the number of tokens read
+	readLiteral := func(i int) (interface{}, int) {
+		if i >= length {
+			return nil, 0
+		}
+		t := tokens[i]
+		switch t.Tok {
+		case token.INT, token.FLOAT:
+			return utils.LiteralNumber(t.Lit), 1
+		case token.STRING, token.CHAR:
+			return utils.LiteralString(t.Lit), 1
+		case token.SUB:
+			if i+1 >= length || tokens[i+1].Tok != token.INT && tokens[i+1].Tok != token.FLOAT {
+				return nil, 0
+			}
+			switch v := utils.LiteralNumber(tokens[i+1].Lit).(type) {
+			case int64:
+				return -v, 2
+			case float64:
+				return -v, 2
+			}
+		case token.IDENT:
+			if strings.EqualFold(t.Lit, "true") || strings.EqualFold(t.Lit, "false") {
+				return strings.EqualFold(t.Lit, "true"), 1
+			} else if strings.EqualFold(t.Lit, "null") {
+				return nil, 1
+			}
+		}
+		return nil, 0
+	}
+
+	//DEFAULT literal of a field, returns the number of tokens read
+	readDefault := func(i int, field *sqlField) int {
+		if i+1 >= length || tokens[i].Tok != token.IDENT || !strings.EqualFold(tokens[i].Lit, "default") {
+			return 0
+		}
+		value, n := readLiteral(i + 1)
+		if n == 0 {
+			return 0
+		}
+		field.defValue, field.hasDefault = value, true
+		return n + 1
+	}
+
+	//DO name(literal, ..., param = literal), ... from i after DO
+	readActions := func(i int) ([]ActionCall, error) {
+		var calls []ActionCall
+		for {
+			if i+1 >= length || tokens[i].Tok != token.IDENT || tokens[i+1].Tok != token.LPAREN {
+				return nil, getError(tokens[i-1])
+			}
+			call := ActionCall{Name: tokens[i].Lit}
+			for i += 2; i < length && tokens[i].Tok != token.RPAREN; {
+				if tokens[i].Tok == token.IDENT && i+1 < length && tokens[i+1].Tok == token.ASSIGN {
+					value, n := readLiteral(i + 2)
+					if n == 0 {
+						return nil, getError(tokens[i])
+					}
+					if call.Params == nil {
+						call.Params = map[string]interface{}{}
+					}
+					call.Params[tokens[i].Lit] = value
+					i += n + 2
+				} else {
+					value, n := readLiteral(i)
+					if n == 0 || call.Params != nil { //no positional argument after the named ones
+						return nil, getError(tokens[i])
+					}
+					call.Args = append(call.Args, value)
+					i += n
+				}
+				if i < length && tokens[i].Tok == token.COMMA && i+1 < length && tokens[i+1].Tok != token.RPAREN {
+					i++
+				} else if i < length && tokens[i].Tok != token.RPAREN {
+					return nil, getError(tokens[i])
+				}
+			}
+			if i >= length {
+				return nil, getError(tokens[i-1])
+			}
+			calls = append(calls, call)
+			if i++; i == length {
+				return calls, nil
+			}
+			if tokens[i].Tok != token.COMMA {
+				return nil, getError(tokens[i])
+			}
+			i++
+		}
+	}
+
+	//a field without alias, with or without DEFAULT
+	newField := func(start, end int) *sqlField {
+		field := &sqlField{}
+		for j := start + 1; j < end; j++ {
+			var def sqlField
+			if n := readDefault(j, &def); n > 0 && j+n == end {
+				field.hasDefault, field.defValue = true, def.defValue
+				end = j
+				break
+			}
+		}
+		for j := start; j < end; j++ {
+			field.name += tokens[j].Lit
+		}
+		return field
+	}
+
 	for i := 1; i < length; i++ {
-		switch tokens[i].tok {
+		switch tokens[i].Tok {
 		case token.IDENT, token.INT, token.FLOAT, token.STRING, token.CHAR:
 			break
+		case token.DEFAULT: //keyword of go, DEFAULT value of a field
+			tokens[i].Tok = token.IDENT
+			break
 		case token.LPAREN, token.LBRACK, token.RPAREN, token.RBRACK,
 			token.ADD, token.SUB, token.MUL, token.QUO, token.REM,
 			token.ASSIGN, token.EQL, token.NEQ, token.GTR, token.GEQ, token.LSS, token.LEQ,
 			token.AND, token.OR, token.NOT, token.XOR, token.LOR, token.LAND,
 			token.COMMA, token.PERIOD,
-			token.SHL, token.SHR: //tokens[i].tok.IsOperator()
-			tokens[i].lit = tokens[i].tok.String()
+			token.SHL, token.SHR: //tokens[i].Tok.IsOperator()
+			tokens[i].Lit = tokens[i].Tok.String()
 			break
 		default:
 			return getError(tokens[i])
 		}
 	}
 
-	if !strings.EqualFold(tokens[0].lit, "select") {
+	//CAST(x AS type) => cast(x,"type"),so that AS inside it is not taken as an alias
+	if _, bad := sqltoken.RewriteCast(tokens[1:]); bad >= 0 {
+		return getError(tokens[bad+1])
+	}
+
+	//* EXCEPT (path, ...) REPLACE (expr AS path, ...) in the select list, the modifiers are removed from tokens
+	var starExcepts []string
+	var starReplaces map[string]string
+	starModified := false
+	depth := 0
+	for i := 1; i < length; i++ {
+		if tokens[i].Tok == token.LPAREN || tokens[i].Tok == token.LBRACK {
+			depth++
+		} else if tokens[i].Tok == token.RPAREN || tokens[i].Tok == token.RBRACK {
+			depth--
+		} else if tokens[i].Tok == token.IDENT && depth == 0 && strings.EqualFold(tokens[i].Lit, "from") {
+			break
+		}
+		if depth != 0 || tokens[i].Tok != token.MUL {
+			continue
+		}
+
+		j := i + 1
+		for j+1 < length && tokens[j].Tok == token.IDENT && tokens[j+1].Tok == token.LPAREN &&
+			(strings.EqualFold(tokens[j].Lit, "except") || strings.EqualFold(tokens[j].Lit, "replace")) {
+			if starModified && j == i+1 { //only one * can be modified
+				return getError(tokens[i])
+			}
+			except := strings.EqualFold(tokens[j].Lit, "except")
+			j += 2
+			for {
+				start := j
+				level := 0
+				for ; j < length; j++ {
+					if tokens[j].Tok == token.LPAREN || tokens[j].Tok == token.LBRACK {
+						level++
+					} else if level > 0 && (tokens[j].Tok == token.RPAREN || tokens[j].Tok == token.RBRACK) {
+						level--
+					} else if level == 0 && (tokens[j].Tok == token.COMMA || tokens[j].Tok == token.RPAREN) {
+						break
+					}
+				}
+				if j >= length || j == start {
+					return getError(tokens[j-1])
+				}
+
+				if except {
+					var path string
+					for k := start; k < j; k++ {
+						path += tokens[k].Lit
+					}
+					starExcepts = append(starExcepts, path)
+				} else {
+					as := -1
+					for k := j - 1; k > start; k-- {
+						if tokens[k].Tok == token.IDENT && strings.EqualFold(tokens[k].Lit, "as") {
+							as = k
+							break
+						}
+					}
+					if as < 0 || as == start || as == j-1 {
+						return getError(tokens[start])
+					}
+					var expr, path string
+					for k := start; k < as; k++ {
+						expr += tokens[k].Lit
+					}
+					for k := as + 1; k < j; k++ {
+						path += tokens[k].Lit
+					}
+					if starReplaces == nil {
+						starReplaces = map[string]string{}
+					}
+					starReplaces[path] = expr
+				}
+
+				if tokens[j].Tok == token.RPAREN {
+					j++
+					break
+				}
+				j++
+			}
+			starModified = true
+		}
+
+		if j > i+1 {
+			tokens = append(tokens[:i+1], tokens[j:]...)
+			length = len(tokens)
+		}
+	}
+
+	//DO action(...), ... at the end, after FROM
+	var actions []ActionCall
+	depth = 0
+	afterFrom := false
+	for i := 1; i < length; i++ {
+		switch tokens[i].Tok {
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK:
+			depth--
+		case token.IDENT:
+			if depth != 0 {
+				break
+			}
+			if !afterFrom {
+				afterFrom = strings.EqualFold(tokens[i].Lit, "from")
+			} else if strings.EqualFold(tokens[i].Lit, "do") && i+2 < length &&
+				tokens[i+1].Tok == token.IDENT && tokens[i+2].Tok == token.LPAREN {
+				var err error
+				if actions, err = readActions(i + 1); err != nil {
+					return err
+				}
+				length = i
+			}
+		}
+	}
+
+	//ORDER BY expr [ASC|DESC] [NULLS FIRST|LAST], ... LIMIT n [OFFSET m] after FROM
+	var orders []*sqlOrder
+	limit, offset := -1, 0
+	end := length
+	depth = 0
+	from := -1
+	for i := 1; i < length && end == length; i++ {
+		switch tokens[i].Tok {
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK:
+			depth--
+		case token.IDENT:
+			if depth != 0 {
+				break
+			}
+			if from < 0 {
+				if strings.EqualFold(tokens[i].Lit, "from") {
+					from = i
+				}
+			} else if strings.EqualFold(tokens[i].Lit, "order") && i+1 < length && strings.EqualFold(tokens[i+1].Lit, "by") ||
+				strings.EqualFold(tokens[i].Lit, "limit") && i+1 < length && tokens[i+1].Tok == token.INT {
+				end = i
+			}
+		}
+	}
+
+	if end < length {
+		i := end
+		if strings.EqualFold(tokens[i].Lit, "order") {
+			i += 2
+			for {
+				start := i
+				depth = 0
+				for ; i < length; i++ {
+					if tokens[i].Tok == token.LPAREN || tokens[i].Tok == token.LBRACK {
+						depth++
+					} else if tokens[i].Tok == token.RPAREN || tokens[i].Tok == token.RBRACK {
+						depth--
+					} else if depth == 0 && (tokens[i].Tok == token.COMMA ||
+						tokens[i].Tok == token.IDENT && (strings.EqualFold(tokens[i].Lit, "asc") || strings.EqualFold(tokens[i].Lit, "desc") ||
+							strings.EqualFold(tokens[i].Lit, "nulls") || strings.EqualFold(tokens[i].Lit, "limit"))) {
+						break
+					}
+				}
+				if i == start {
+					if i < length {
+						return getError(tokens[i])
+					}
+					return getError(tokens[i-1])
+				}
+
+				order := &sqlOrder{}
+				for j := start; j < i; j++ {
+					order.expr += tokens[j].Lit
+				}
+				if i < length && (strings.EqualFold(tokens[i].Lit, "asc") || strings.EqualFold(tokens[i].Lit, "desc")) {
+					order.desc = strings.EqualFold(tokens[i].Lit, "desc")
+					i++
+				}
+				order.nullsFirst = order.desc
+				if i < length && strings.EqualFold(tokens[i].Lit, "nulls") {
+					if i+1 >= length || !strings.EqualFold(tokens[i+1].Lit, "first") && !strings.EqualFold(tokens[i+1].Lit, "last") {
+						return getError(tokens[i])
+					}
+					order.nullsFirst = strings.EqualFold(tokens[i+1].Lit, "first")
+					i += 2
+				}
+				orders = append(orders, order)
+
+				if i < length && tokens[i].Tok == token.COMMA {
+					i++
+					continue
+				}
+				break
+			}
+		}
+
+		if i < length && strings.EqualFold(tokens[i].Lit, "limit") {
+			if i+1 >= length || tokens[i+1].Tok != token.INT {
+				return getError(tokens[i])
+			}
+			limit, _ = strconv.Atoi(tokens[i+1].Lit)
+			i += 2
+			if i < length && strings.EqualFold(tokens[i].Lit, "offset") {
+				if i+1 >= length || tokens[i+1].Tok != token.INT {
+					return getError(tokens[i])
+				}
+				offset, _ = strconv.Atoi(tokens[i+1].Lit)
+				i += 2
+			}
+		}
+
+		if i < length {
+			return getError(tokens[i])
+		}
+		length = end
+	}
+
+	if !strings.EqualFold(tokens[0].Lit, "select") {
 		return getError(tokens[0])
 	}
 
 	var fields []*sqlField
-	var table, where string
+	var table, where, unnest, unnestAlias string
 
 	lparen := 0
 	lbrack := 0
@@ -187,72 +841,84 @@ func (r *jsonRule) AddConvertHandlerBySql(sql string, funcs function.Functions)
 	step := 1
 
 	for i := 1; i < length; i++ {
-		switch tokens[i].tok {
+		switch tokens[i].Tok {
 		case token.COMMA: // ,
 			if lparen == 0 && lbrack == 0 && step == 1 {
-				if pos == i || pos+1 == i && tokens[pos].tok == tokens[i].tok {
+				if pos == i || pos+1 == i && tokens[pos].Tok == tokens[i].Tok {
 					return getError(tokens[i])
 				}
-				var field string
-				for j := pos; j < i; j++ {
-					field += tokens[j].lit
-				}
-				fields = append(fields, &sqlField{name: field})
+				fields = append(fields, newField(pos, i))
 				pos = i + 1
 			}
 			break
 		case token.IDENT:
 			if lparen == 0 && lbrack == 0 {
 				if step == 1 {
-					if strings.EqualFold(tokens[i].lit, "as") {
-						if pos == i || pos+1 == i && tokens[pos].tok == tokens[i].tok {
+					if strings.EqualFold(tokens[i].Lit, "as") {
+						if pos == i { //no field before AS
 							return ErrorSqlError
 						}
 						var field string
 						for j := pos; j < i; j++ {
-							field += tokens[j].lit
+							field += tokens[j].Lit
 						}
 
 						i++
-						//A.B.C
+						//A.B[0].C[].D[*], with quoted keys A.`b-c`.D["e"]
 						pos = i
+						expectKey := true
 						for ; i < length; i++ {
-							if ((i-pos)&1) == 0 && tokens[i].tok == token.IDENT ||
-								((i-pos)&1) == 1 && tokens[i].tok == token.PERIOD {
-								continue
+							if expectKey {
+								if tokens[i].Tok != token.IDENT && (tokens[i].Tok != token.STRING || parser.IsTemplate(tokens[i].Lit)) {
+									break
+								}
+								expectKey = false
+							} else if tokens[i].Tok == token.PERIOD {
+								expectKey = true
+							} else if tokens[i].Tok == token.LBRACK {
+								j := i + 1
+								if j < length && (tokens[j].Tok == token.INT || tokens[j].Tok == token.MUL ||
+									tokens[j].Tok == token.STRING || tokens[j].Tok == token.CHAR) {
+									j++
+								}
+								if j >= length || tokens[j].Tok != token.RBRACK {
+									return getError(tokens[i])
+								}
+								i = j
 							} else {
 								break
 							}
 						}
-						if ((i - pos) & 1) == 0 {
+						if expectKey {
 							return getError(tokens[i-1])
 						}
 
 						var alias string
 						for j := pos; j < i; j++ {
-							alias += tokens[j].lit
+							alias += tokens[j].Lit
 						}
 
-						fields = append(fields, &sqlField{name: field, alias: alias})
+						sf := &sqlField{name: field, alias: alias}
+						i += readDefault(i, sf)
+						fields = append(fields, sf)
 
-						if tokens[i].tok == token.COMMA {
+						if i >= length {
+							return getError(tokens[i-1])
+						} else if tokens[i].Tok == token.COMMA {
 							pos = i + 1
-						} else if tokens[i].tok == token.IDENT && strings.EqualFold(tokens[i].lit, "from") {
+						} else if tokens[i].Tok == token.IDENT && strings.EqualFold(tokens[i].Lit, "from") {
+							pos = i //the alias is not a field
 							i--
 						} else {
 							return getError(tokens[i])
 						}
-					} else if strings.EqualFold(tokens[i].lit, "from") {
+					} else if strings.EqualFold(tokens[i].Lit, "from") {
 						step++
 
 						if i > pos {
-							var field string
-							for j := pos; j < i; j++ {
-								field += tokens[j].lit
-							}
-							fields = append(fields, &sqlField{name: field})
+							fields = append(fields, newField(pos, i))
 							pos = i + 1
-						} else if tokens[pos-1].tok == token.COMMA {
+						} else if tokens[pos-1].Tok == token.COMMA {
 							return getError(tokens[i])
 						}
 
@@ -261,17 +927,49 @@ func (r *jsonRule) AddConvertHandlerBySql(sql string, funcs function.Functions)
 							return getError(tokens[i-1])
 						}
 
-						if tokens[i].tok == token.IDENT {
-							table = tokens[i].lit
-						} else if tokens[i].tok == token.CHAR || tokens[i].tok == token.STRING {
-							table = tokens[i].lit[1 : len(tokens[i].lit)-1]
+						if tokens[i].Tok == token.IDENT {
+							table = tokens[i].Lit
+						} else if tokens[i].Tok == token.CHAR || tokens[i].Tok == token.STRING {
+							table = tokens[i].Lit[1 : len(tokens[i].Lit)-1]
 						} else {
 							return getError(tokens[i])
 						}
 
 						i++
+						//, UNNEST(expr) AS alias
+						if i < length && tokens[i].Tok == token.COMMA {
+							if i+2 >= length || tokens[i+1].Tok != token.IDENT || !strings.EqualFold(tokens[i+1].Lit, "unnest") || tokens[i+2].Tok != token.LPAREN {
+								return getError(tokens[i])
+							}
+							i += 3
+							start := i
+							level := 1
+							for ; i < length; i++ {
+								if tokens[i].Tok == token.LPAREN {
+									level++
+								} else if tokens[i].Tok == token.RPAREN {
+									level--
+									if level == 0 {
+										break
+									}
+								}
+							}
+							if i >= length || i == start {
+								return getError(tokens[i-1])
+							}
+							for j := start; j < i; j++ {
+								unnest += tokens[j].Lit
+							}
+							i++
+							if i+1 >= length || !strings.EqualFold(tokens[i].Lit, "as") || tokens[i+1].Tok != token.IDENT {
+								return getError(tokens[i-1])
+							}
+							unnestAlias = tokens[i+1].Lit
+							i += 2
+						}
+
 						if i < length {
-							if tokens[i].tok != token.IDENT || !strings.EqualFold(tokens[i].lit, "where") || i+1 >= length {
+							if tokens[i].Tok != token.IDENT || !strings.EqualFold(tokens[i].Lit, "where") || i+1 >= length {
 								return getError(tokens[i])
 							}
 
@@ -285,14 +983,14 @@ func (r *jsonRule) AddConvertHandlerBySql(sql string, funcs function.Functions)
 			}
 
 			if step == 3 {
-				if strings.EqualFold(tokens[i].lit, "and") {
-					tokens[i].lit = "&&"
-				} else if strings.EqualFold(tokens[i].lit, "or") {
-					tokens[i].lit = "||"
-				} else if strings.EqualFold(tokens[i].lit, "not") {
-					tokens[i].lit = "!"
-				} else if strings.EqualFold(tokens[i].lit, "null") {
-					tokens[i].lit = "nil"
+				if strings.EqualFold(tokens[i].Lit, "and") {
+					tokens[i].Lit = "&&"
+				} else if strings.EqualFold(tokens[i].Lit, "or") {
+					tokens[i].Lit = "||"
+				} else if strings.EqualFold(tokens[i].Lit, "not") {
+					tokens[i].Lit = "!"
+				} else if strings.EqualFold(tokens[i].Lit, "null") {
+					tokens[i].Lit = "nil"
 				}
 			}
 			break
@@ -315,7 +1013,7 @@ func (r *jsonRule) AddConvertHandlerBySql(sql string, funcs function.Functions)
 			lbrack--
 		case token.ASSIGN:
 			if step == 3 {
-				tokens[i].lit = "=="
+				tokens[i].Lit = "=="
 			} else {
 				return getError(tokens[i])
 			}
@@ -328,11 +1026,13 @@ func (r *jsonRule) AddConvertHandlerBySql(sql string, funcs function.Functions)
 	}
 
 	var err error
+	var handlers []handler.Handler
+	var selected *utils.KeyOrder //the keys of the output rows
 
 	if where != "" {
 		where = ""
 		for i := pos; i < length; i++ {
-			where += tokens[i].lit
+			where += tokens[i].Lit
 		}
 
 		filter := filter.NewFieldFilter(funcs)
@@ -341,21 +1041,168 @@ func (r *jsonRule) AddConvertHandlerBySql(sql string, funcs function.Functions)
 			return err
 		}
 
-		r.AddHandler(filter)
+		handlers = append(handlers, filter)
 	}
 
 	if len(fields) > 0 {
 		mp := mapper.NewMapper(funcs)
 		for _, field := range fields {
-			err = mp.AddField(field.name, field.alias)
+			if starModified && field.name == "*" && field.alias == "" {
+				err = mp.AddStarField(starExcepts, starReplaces)
+			} else if h, ok, e := newFlattenHandler(field.name); ok || e != nil {
+				err = e
+				if err == nil {
+					toPath := field.alias
+					if toPath == "" {
+						toPath = "*"
+					}
+					err = mp.AddHandlerField(h, toPath)
+				}
+			} else {
+				err = mp.AddField(field.name, field.alias)
+			}
 			if err != nil {
 				return err
 			}
+			if field.hasDefault {
+				toPath := field.alias
+				if toPath == "" {
+					toPath = field.name
+					if !utils.IsValidKeyPath(toPath) {
+						toPath = utils.AdjustKeyPath(toPath)
+					}
+				}
+				if field.defValue == nil {
+					err = mp.SetFieldNullPolicy(toPath, mapper.NullEmit)
+				} else {
+					err = mp.SetFieldDefault(toPath, field.defValue)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		mp.SetNullPolicy(r.nullPolicy)
+		handlers = append(handlers, mp)
+		selected = mp.KeyOrder()
+	}
+
+	if unnest != "" || len(orders) > 0 || limit >= 0 {
+		if unnest != "" {
+			resolver, err := parser.DefaultGoParser.Parse(unnest, funcs)
+			if err != nil {
+				return err
+			}
+			r.AddHandler(&unnestHandler{resolver: resolver, alias: unnestAlias})
+		}
+
+		//the elements of an array are filtered and mapped as rows before being sorted
+		r.AddHandler(&rowsHandler{handlers: handlers})
+
+		if len(orders) > 0 || limit >= 0 {
+			sorter := order.NewSorter(funcs)
+			for _, o := range orders {
+				//the orders are evaluated on the output rows, where the keys not selected are always null
+				if selected != nil {
+					resolver, err := parser.DefaultGoParser.Parse(o.expr, nil)
+					if err != nil {
+						return err
+					}
+					for _, key := range resolver.Keys() {
+						if !selected.Has(key) {
+							return fmt.Errorf("%v %q", ErrOrderNotSelected, key)
+						}
+					}
+				}
+				err = sorter.AddOrder(o.expr, o.desc, o.nullsFirst)
+				if err != nil {
+					return err
+				}
+			}
+			err = sorter.SetLimit(limit, offset)
+			if err != nil {
+				return err
+			}
+			r.AddHandler(sorter)
+		}
+	} else {
+		for _, h := range handlers {
+			r.AddHandler(h)
 		}
-		r.AddHandler(mp)
 	}
 
 	r.name = table
+	r.actions = actions
 
 	return nil
 }
+
+// Actions returns the actions of the DO clause of the sql
+func (r *jsonRule) Actions() []ActionCall {
+	return r.actions
+}
+
+// newFlattenHandler creates the handler of a field flatten(*[, separator[, maxDepth[, indexStyle]]]) or unflatten(...),
+// the index style is one of 'bracket', 'key' and 'none'. It returns false when field is not one of them.
+func newFlattenHandler(field string) (handler.Handler, bool, error) {
+	match := flattenRegexp.FindStringSubmatch(field)
+	if match == nil {
+		return nil, false, nil
+	}
+	var args []string
+	if match[2] != "" {
+		args = strings.Split(match[2][1:], ",")
+	}
+	if len(args) > 3 {
+		return nil, true, ErrorSqlError
+	}
+
+	sep, depth, style := flatten.DefaultSeparator, 0, flatten.IndexBracket
+	if len(args) > 0 {
+		if !utils.IsLiteralString(args[0]) {
+			return nil, true, ErrorSqlError
+		}
+		sep = utils.LiteralString(args[0])
+	}
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, true, ErrorSqlError
+		}
+		depth = n
+	}
+	if len(args) > 2 {
+		if !utils.IsLiteralString(args[2]) {
+			return nil, true, ErrorSqlError
+		}
+		switch strings.ToLower(utils.LiteralString(args[2])) {
+		case "bracket":
+			style = flatten.IndexBracket
+		case "key":
+			style = flatten.IndexKey
+		case "none":
+			style = flatten.IndexNone
+		default:
+			return nil, true, ErrorSqlError
+		}
+	}
+
+	if match[1] != "" {
+		u := flatten.NewUnflattener().SetIndexStyle(style)
+		if err := u.SetSeparator(sep); err != nil {
+			return nil, true, err
+		}
+		if err := u.SetMaxDepth(depth); err != nil {
+			return nil, true, err
+		}
+		return u, true, nil
+	}
+	f := flatten.NewFlattener().SetIndexStyle(style)
+	if err := f.SetSeparator(sep); err != nil {
+		return nil, true, err
+	}
+	if err := f.SetMaxDepth(depth); err != nil {
+		return nil, true, err
+	}
+	return f, true, nil
+}
@@ -0,0 +1,88 @@
+package rule
+
+import (
+	"context"
+	"github.com/sdghchj/sql-rules-engine/handler"
+	"github.com/sdghchj/sql-rules-engine/parser"
+	"github.com/sdghchj/sql-rules-engine/utils"
+	"reflect"
+)
+
+// unnestHandler fans an input out into one row per element of an array expression, as FROM ..., UNNEST(expr) AS alias.
+// Every row is a shallow copy of the input object with the element set as alias.
+type unnestHandler struct {
+	resolver parser.Resolver
+	alias    string
+}
+
+func (h *unnestHandler) Handle(obj interface{}) interface{} {
+	if obj == nil {
+		return nil
+	}
+	return h.fanOut(obj, h.resolver.Evaluate(obj))
+}
+
+// HandleContext is Handle which returns the error of ctx once ctx is done
+func (h *unnestHandler) HandleContext(ctx context.Context, obj interface{}) (interface{}, error) {
+	if obj == nil {
+		return nil, ctx.Err()
+	}
+	arr, err := h.resolver.EvaluateContext(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	return h.fanOut(obj, arr), nil
+}
+
+func (h *unnestHandler) header() string {
+	return "UNNEST(" + h.resolver.String() + ") AS " + h.alias
+}
+
+func (h *unnestHandler) Explain() string {
+	text := h.header()
+	if funcs := h.resolver.Functions(); len(funcs) > 0 {
+		text += "\n  functions: " + joinFunctions(funcs)
+	}
+	return text
+}
+
+func (h *unnestHandler) Trace(obj interface{}) *parser.TraceNode {
+	node := &parser.TraceNode{Expr: h.header()}
+	if obj == nil {
+		return node
+	}
+	eval := h.resolver.Trace(obj)
+	node.Value, node.Children = h.fanOut(obj, eval.Value), []*parser.TraceNode{eval}
+	return node
+}
+
+// fanOut returns a row of obj for every element of arr
+func (h *unnestHandler) fanOut(obj interface{}, arr interface{}) interface{} {
+	if arr == nil {
+		return handler.Results{}
+	}
+	val := reflect.ValueOf(arr)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return handler.Results{}
+	}
+
+	src, ok := obj.(map[string]interface{})
+	if !ok {
+		src, _ = utils.Plain(obj).(map[string]interface{})
+	}
+	length := val.Len()
+	rows := make(handler.Results, length)
+	for i := 0; i < length; i++ {
+		row := make(map[string]interface{}, len(src)+1)
+		for k, v := range src {
+			row[k] = v
+		}
+		row[h.alias] = val.Index(i).Interface()
+		rows[i] = row
+	}
+	return rows
+}
+
+func (h *unnestHandler) HandleAsync(obj interface{}) {
+
+}
@@ -0,0 +1,386 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sdghchj/sql-rules-engine/rule"
+	"github.com/sdghchj/sql-rules-engine/store"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrRuleDisabled = errors.New("rule disabled")
+var ErrRuleIdMismatch = errors.New("rule id mismatch")
+var ErrRuleInUse = errors.New("rule put with another id")
+var ErrRuleKeyConflict = errors.New("rule loaded from another key")
+
+// RuleInfo is a rule of an engine with its metadata, the id of a rule is the name it is put with,
+// which is the table after FROM for a rule parsed from sql
+type RuleInfo struct {
+	ID          string
+	Version     int //starts from 1, increased by every update
+	Sql         string
+	Description string
+	Tags        []string
+	Enabled     bool
+	OnError     ErrorPolicy
+	Actions     []ActionConfig
+	Created     time.Time
+	Updated     time.Time
+	Rule        rule.Rule
+}
+
+// ruleEntry is never modified once stored, an update stores a new one,
+// so that the messages being handled finish on the rule they started with
+type ruleEntry struct {
+	info RuleInfo
+	*actionSet
+}
+
+// actionSet is the actions started for a version of a rule, shared by the entries of its metadata changes.
+// Once the version is replaced or removed, the actions are stopped when the last message delivered by them returns.
+type actionSet struct {
+	lock     sync.Mutex
+	actions  []*ruleAction
+	inflight int  //the messages being delivered
+	retired  bool //replaced or removed
+	stopped  bool
+}
+
+func newActionSet(actions []*ruleAction) *actionSet {
+	return &actionSet{actions: actions}
+}
+
+// acquire holds the actions for a message until release is called, it returns false when they are stopped
+func (s *actionSet) acquire() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.inflight++
+	return true
+}
+
+// hold is acquire even when the actions are stopped
+func (s *actionSet) hold() {
+	s.lock.Lock()
+	s.inflight++
+	s.lock.Unlock()
+}
+
+func (s *actionSet) release() {
+	s.lock.Lock()
+	s.inflight--
+	stop := s.retired && s.inflight == 0 && !s.stopped
+	s.stopped = s.stopped || stop
+	s.lock.Unlock()
+	if stop {
+		stopActions(s.actions)
+	}
+}
+
+// retire stops the actions once no message is delivered by them, it is called after the entry is replaced or removed
+func (s *actionSet) retire() {
+	s.lock.Lock()
+	stop := s.inflight == 0 && !s.stopped
+	s.retired = true
+	s.stopped = s.stopped || stop
+	s.lock.Unlock()
+	if stop {
+		stopActions(s.actions)
+	}
+}
+
+func (e *jsonEngine) getEntry(id string) *ruleEntry {
+	if i, ok := e.rules.Load(id); ok {
+		if entry, ok := i.(*ruleEntry); ok {
+			return entry
+		}
+	}
+	return nil
+}
+
+// acquireEntry returns the current entry of the rule id with its actions held until release is called,
+// or nil when there is no rule id
+func (e *jsonEngine) acquireEntry(id string) *ruleEntry {
+	entry := e.getEntry(id)
+	for entry != nil && !entry.acquire() {
+		//an entry is replaced or removed before it is retired, so a stopped one is followed by the next one
+		next := e.getEntry(id)
+		if next == entry { //stopped by Close, the messages fail on the actions stopped
+			entry.hold()
+			break
+		}
+		entry = next
+	}
+	return entry
+}
+
+// putRule stores r as a new version of the rule id, keeping the metadata other than the sql of the old version.
+// The actions of the new version are started before it is stored, and the ones of the old version are stopped
+// after the messages being delivered by them return.
+func (e *jsonEngine) putRule(id string, r rule.Rule, sql string) error {
+	return e.putRuleWith(id, r, sql, nil)
+}
+
+// putRuleWith is putRule, with the metadata modified by modify when it is not nil
+func (e *jsonEngine) putRuleWith(id string, r rule.Rule, sql string, modify func(info *RuleInfo)) error {
+	e.rulesLock.Lock()
+	defer e.rulesLock.Unlock()
+	return e.putRuleLocked(id, r, sql, modify)
+}
+
+// putRuleLocked is putRuleWith, the caller must hold rulesLock
+func (e *jsonEngine) putRuleLocked(id string, r rule.Rule, sql string, modify func(info *RuleInfo)) error {
+	entry, err := e.newEntry(id, r, sql, modify)
+	if err != nil {
+		return err
+	}
+	e.storeEntry(entry)
+	return nil
+}
+
+// newEntry returns the entry of r as a new version of the rule id with its actions started, without storing it.
+// The caller must hold rulesLock until the entry is stored by storeEntry, or its actions are stopped.
+func (e *jsonEngine) newEntry(id string, r rule.Rule, sql string, modify func(info *RuleInfo)) (*ruleEntry, error) {
+	now := time.Now()
+	info := RuleInfo{ID: id, Version: 1, Sql: sql, Enabled: true, OnError: ErrorContinue, Created: now, Updated: now, Rule: r}
+	old := e.getEntry(id)
+	if old != nil {
+		info.Version = old.info.Version + 1
+		info.Description = old.info.Description
+		info.Tags = old.info.Tags
+		info.Enabled = old.info.Enabled
+		info.OnError = old.info.OnError
+		info.Actions = old.info.Actions
+		info.Created = old.info.Created
+	}
+	if modify != nil {
+		modify(&info)
+	}
+
+	if !e.isLive(id, r) && e.ruleInUse(r) {
+		return nil, ErrRuleInUse
+	}
+
+	actions, err := e.newRuleActions(info.Actions, r)
+	if err != nil {
+		return nil, err
+	}
+	if err = startActions(actions); err != nil {
+		return nil, err
+	}
+	return &ruleEntry{info: info, actionSet: newActionSet(actions)}, nil
+}
+
+// storeEntry stores an entry returned by newEntry, and retires the old version of its rule id
+func (e *jsonEngine) storeEntry(entry *ruleEntry) {
+	id, r := entry.info.ID, entry.info.Rule
+	old := e.getEntry(id)
+	if !e.isLive(id, r) {
+		r.SetErrorHandler(e.ruleErrorHandler(id))
+		r.SetMetrics(e.ruleMetrics(id))
+	}
+	e.rules.Store(id, entry)
+	if old != nil {
+		old.retire()
+	}
+}
+
+// isLive reports whether r is the rule id handling messages already, which is configured for id,
+// and must not be reconfigured while it runs
+func (e *jsonEngine) isLive(id string, r rule.Rule) bool {
+	old := e.getEntry(id)
+	return old != nil && old.info.Rule == r
+}
+
+// ruleInUse reports whether r is put with any id
+func (e *jsonEngine) ruleInUse(r rule.Rule) bool {
+	inUse := false
+	e.rules.Range(func(key, value interface{}) bool {
+		if entry, ok := value.(*ruleEntry); ok && entry.info.Rule == r {
+			inUse = true
+		}
+		return !inUse
+	})
+	return inUse
+}
+
+// removeRule removes the rule id and stops its actions
+func (e *jsonEngine) removeRule(id string) {
+	e.rulesLock.Lock()
+	defer e.rulesLock.Unlock()
+
+	if old := e.getEntry(id); old != nil {
+		e.rules.Delete(id)
+		e.metrics.Delete(id)
+		old.retire()
+	}
+}
+
+// modifyRule stores a copy of the rule id modified by modify
+func (e *jsonEngine) modifyRule(id string, modify func(info *RuleInfo)) error {
+	e.rulesLock.Lock()
+	defer e.rulesLock.Unlock()
+
+	old := e.getEntry(id)
+	if old == nil {
+		return ErrNoRuleFound
+	}
+	info := old.info
+	modify(&info)
+	info.Updated = time.Now()
+	e.rules.Store(id, &ruleEntry{info: info, actionSet: old.actionSet})
+	return nil
+}
+
+// ListRules returns all the rules ordered by id
+func (e *jsonEngine) ListRules() []RuleInfo {
+	var infos []RuleInfo
+	e.rules.Range(func(key, value interface{}) bool {
+		if entry, ok := value.(*ruleEntry); ok {
+			infos = append(infos, entry.info)
+		}
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+func (e *jsonEngine) GetRule(id string) (RuleInfo, error) {
+	if entry := e.getEntry(id); entry != nil {
+		return entry.info, nil
+	}
+	return RuleInfo{}, ErrNoRuleFound
+}
+
+// EnableRule resumes a disabled rule
+func (e *jsonEngine) EnableRule(id string) error {
+	return e.modifyRule(id, func(info *RuleInfo) {
+		info.Enabled = true
+	})
+}
+
+// DisableRule pauses a rule, messages to it are rejected with ErrRuleDisabled until it is enabled again
+func (e *jsonEngine) DisableRule(id string) error {
+	return e.modifyRule(id, func(info *RuleInfo) {
+		info.Enabled = false
+	})
+}
+
+// DescribeRule sets the description and the tags of a rule
+func (e *jsonEngine) DescribeRule(id string, description string, tags ...string) error {
+	return e.modifyRule(id, func(info *RuleInfo) {
+		info.Description = description
+		info.Tags = append([]string(nil), tags...)
+	})
+}
+
+// UpdateRule replaces the existing rule id by a new version parsed from sql, whose table must be id.
+// The old version keeps running if sql is invalid.
+func (e *jsonEngine) UpdateRule(id string, sql string) (rule.Rule, error) {
+	if e.getEntry(id) == nil {
+		return nil, ErrNoRuleFound
+	}
+	r, err := e.parseSql(sql)
+	if err != nil {
+		return nil, err
+	}
+	if r.Name() != id {
+		return nil, ErrRuleIdMismatch
+	}
+
+	//the rule may be removed while sql is parsed
+	e.rulesLock.Lock()
+	defer e.rulesLock.Unlock()
+	if e.getEntry(id) == nil {
+		return nil, ErrNoRuleFound
+	}
+	if err = e.putRuleLocked(id, r, sql, nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// applyChange puts or removes the rule of a change of a store, the rule id of every key is kept in storeKeys.
+// A rule failing to parse leaves the last good version of the key running. A rule id is owned by the first key
+// it is loaded from, the rules of the other keys with the same id are rejected with ErrRuleKeyConflict.
+func (e *jsonEngine) applyChange(change store.Change) error {
+	e.storeLock.Lock()
+	defer e.storeLock.Unlock()
+
+	if e.storeKeys == nil {
+		e.storeKeys = map[string]string{}
+		e.storeSqls = map[string]string{}
+	}
+	oldID, ok := e.storeKeys[change.Key]
+	if change.Deleted {
+		if ok {
+			e.removeRule(oldID)
+			delete(e.storeKeys, change.Key)
+		}
+		delete(e.storeSqls, change.Key)
+		return nil
+	}
+	e.storeSqls[change.Key] = change.Sql
+
+	r, err := e.parseSql(change.Sql)
+	if err != nil {
+		return err
+	}
+	for key, id := range e.storeKeys {
+		if id == r.Name() && key != change.Key {
+			return fmt.Errorf("%v: %q of %q", ErrRuleKeyConflict, id, key)
+		}
+	}
+	if err = e.putRule(r.Name(), r, change.Sql); err != nil {
+		return err
+	}
+	if ok && oldID != r.Name() {
+		e.removeRule(oldID)
+	}
+	e.storeKeys[change.Key] = r.Name()
+	return nil
+}
+
+// LoadRules parses all the rules of s, and returns the errors of the rules failing to parse by their keys
+func (e *jsonEngine) LoadRules(s store.RuleStore) (map[string]error, error) {
+	rules, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(rules))
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	errs := map[string]error{}
+	for _, key := range keys {
+		if err = e.applyChange(store.Change{Key: key, Sql: rules[key]}); err != nil {
+			errs[key] = err
+		}
+	}
+	return errs, nil
+}
+
+// WatchRules reloads the rules of w when they change from the ones loaded by LoadRules, until stop is called.
+// The errors of the rules failing to parse are reported to onError, while their last good versions keep running.
+func (e *jsonEngine) WatchRules(w store.Watcher, interval time.Duration, onError func(key string, err error)) (stop func()) {
+	e.storeLock.Lock()
+	loaded := make(map[string]string, len(e.storeSqls))
+	for key, sql := range e.storeSqls {
+		loaded[key] = sql
+	}
+	e.storeLock.Unlock()
+
+	return w.WatchFrom(loaded, interval, func(change store.Change) {
+		if err := e.applyChange(change); err != nil && onError != nil {
+			onError(change.Key, err)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval is the least interval between two writes of a file store
+const DefaultFlushInterval = 5 * time.Second
+
+type fileEntry struct {
+	Value   interface{} `json:"value"`
+	Touched int64       `json:"touched"` //unix nano
+}
+
+// fileStore is a memory store which is loaded from and written back to a local json file
+type fileStore struct {
+	*memoryStore
+	path          string
+	flushInterval time.Duration
+	lastFlush     time.Time
+	dirty         bool
+	version       uint64     //of the changes, so that a flush only clears dirty when nothing changed meanwhile
+	flushLock     sync.Mutex //serializes the flushes, so that an older snapshot never replaces a newer one
+}
+
+// NewFileStore creates a store persisted in the file of path, which is loaded if it exists.
+// Changes are written at most once per DefaultFlushInterval, and on Flush and Close.
+func NewFileStore(path string, ttl time.Duration) (Store, error) {
+	s := &fileStore{memoryStore: newMemoryStore(ttl), path: path, flushInterval: DefaultFlushInterval, lastFlush: time.Now()}
+	bin, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]*fileEntry{}
+	if len(bin) > 0 {
+		if err = json.Unmarshal(bin, &entries); err != nil {
+			return nil, err
+		}
+	}
+	now := s.now()
+	for key, e := range entries {
+		en := &entry{value: e.Value, touched: time.Unix(0, e.Touched)}
+		if !s.expired(en, now) {
+			s.entries[key] = en
+		}
+	}
+	return s, nil
+}
+
+func (s *fileStore) Put(key string, value interface{}) {
+	s.Swap(key, value)
+}
+
+func (s *fileStore) Swap(key string, value interface{}) (old interface{}, ok bool) {
+	old, ok = s.memoryStore.Swap(key, value)
+	s.changed()
+	return
+}
+
+func (s *fileStore) Delete(key string) {
+	s.memoryStore.Delete(key)
+	s.changed()
+}
+
+func (s *fileStore) changed() {
+	s.lock.Lock()
+	s.dirty = true
+	s.version++
+	due := s.now().Sub(s.lastFlush) >= s.flushInterval
+	s.lock.Unlock()
+	if due {
+		_ = s.Flush()
+	}
+}
+
+// Flush writes all the keys into the file through a temporary file, so that the file is never half written.
+// The store stays dirty when the write fails, so that the next flush writes it again.
+func (s *fileStore) Flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.lock.Lock()
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	now := s.now()
+	entries := make(map[string]*fileEntry, len(s.entries))
+	for key, e := range s.entries {
+		if !s.expired(e, now) {
+			entries[key] = &fileEntry{Value: e.value, Touched: e.touched.UnixNano()}
+		}
+	}
+	version := s.version
+	s.lastFlush = now
+	s.lock.Unlock()
+
+	if err := s.write(entries); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	if s.version == version {
+		s.dirty = false
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+// write writes entries into the file through a temporary file
+func (s *fileStore) write(entries map[string]*fileEntry) error {
+	bin, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = temp.Write(bin); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
+
+func (s *fileStore) Close() error {
+	return s.Flush()
+}
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultTTL is how long an idle key is kept by the stores created by the engine
+const DefaultTTL = time.Hour
+
+// Store keeps the states of stateful functions, keys idle longer than the ttl of the store are evicted
+type Store interface {
+	Get(key string) (interface{}, bool)
+	Put(key string, value interface{})
+	// Swap stores value and returns the previous value of key atomically
+	Swap(key string, value interface{}) (old interface{}, ok bool)
+	Delete(key string)
+	Len() int
+	Close() error
+}
+
+type entry struct {
+	value   interface{}
+	touched time.Time
+}
+
+type memoryStore struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*entry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryStore creates an in-memory store, ttl <= 0 means keys never expire
+func NewMemoryStore(ttl time.Duration) Store {
+	return newMemoryStore(ttl)
+}
+
+func newMemoryStore(ttl time.Duration) *memoryStore {
+	return &memoryStore{ttl: ttl, entries: map[string]*entry{}, lastSweep: time.Now(), now: time.Now}
+}
+
+func (s *memoryStore) expired(e *entry, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(e.touched) > s.ttl
+}
+
+// sweep removes expired keys at most twice per ttl, the caller must hold the lock
+func (s *memoryStore) sweep(now time.Time) {
+	if s.ttl <= 0 || now.Sub(s.lastSweep) < s.ttl/2 {
+		return
+	}
+	for key, e := range s.entries {
+		if s.expired(e, now) {
+			delete(s.entries, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+func (s *memoryStore) Get(key string) (interface{}, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.now()
+	e, ok := s.entries[key]
+	if !ok || s.expired(e, now) {
+		return nil, false
+	}
+	e.touched = now
+	return e.value, true
+}
+
+func (s *memoryStore) Put(key string, value interface{}) {
+	s.Swap(key, value)
+}
+
+func (s *memoryStore) Swap(key string, value interface{}) (old interface{}, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.now()
+	s.sweep(now)
+	if e, found := s.entries[key]; found && !s.expired(e, now) {
+		old, ok = e.value, true
+	}
+	s.entries[key] = &entry{value: value, touched: now}
+	return
+}
+
+func (s *memoryStore) Delete(key string) {
+	s.lock.Lock()
+	delete(s.entries, key)
+	s.lock.Unlock()
+}
+
+func (s *memoryStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sweep(s.now())
+	return len(s.entries)
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
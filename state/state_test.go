@@ -0,0 +1,100 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTTL(t *testing.T) {
+	s := newMemoryStore(time.Minute)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	if _, ok := s.Swap("a", 1); ok {
+		t.Fail()
+	}
+	s.Put("b", 2)
+	if old, ok := s.Swap("a", 3); !ok || old != 1 {
+		t.Error(old)
+	}
+
+	now = now.Add(50 * time.Second)
+	if v, ok := s.Get("a"); !ok || v != 3 {
+		t.Error(v)
+	}
+
+	now = now.Add(20 * time.Second)
+	if _, ok := s.Get("b"); ok {
+		t.Error("want b expired")
+	}
+	if s.Len() != 1 {
+		t.Error(s.Len())
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := NewFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a", "x")
+	s.Put("b", []interface{}{1.0, 2.0})
+	s.Delete("b")
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := s.Get("a"); !ok || v != "x" {
+		t.Error(v)
+	}
+	if s.Len() != 1 {
+		t.Error(s.Len())
+	}
+}
+
+func TestFileStoreFlushFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "state.json")
+
+	s, err := NewFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a", "x")
+	if err = s.(*fileStore).Flush(); err == nil {
+		t.Fatal("want error of the missing directory")
+	}
+
+	//the changes are written by the next flush
+	if err = os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := s.Get("a"); !ok || v != "x" {
+		t.Error(v)
+	}
+}
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ext is the extension of the rule files of a directory store
+const Ext = ".sql"
+
+// dirStore keeps every rule in a file named by its key and Ext in a directory, other files are ignored
+type dirStore struct {
+	dir string
+}
+
+// NewDirStore creates a store of the directory dir, which is created if it does not exist
+func NewDirStore(dir string) (Watcher, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+func validKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, `/\`)
+}
+
+func (s *dirStore) path(key string) string {
+	return filepath.Join(s.dir, key+Ext)
+}
+
+// files returns the rule files of the directory by key
+func (s *dirStore) files() (map[string]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]os.FileInfo, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, Ext) || strings.HasPrefix(name, ".") {
+			continue
+		}
+		files[strings.TrimSuffix(name, Ext)] = info
+	}
+	return files, nil
+}
+
+func (s *dirStore) List() (map[string]string, error) {
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	rules := make(map[string]string, len(files))
+	for key := range files {
+		bin, err := ioutil.ReadFile(s.path(key))
+		if os.IsNotExist(err) { //removed meanwhile
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		rules[key] = string(bin)
+	}
+	return rules, nil
+}
+
+func (s *dirStore) Get(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	bin, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return string(bin), nil
+}
+
+// Put writes the file of key through a hidden temporary file, so that a watcher never reads it half written
+func (s *dirStore) Put(key string, sql string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	temp, err := ioutil.TempFile(s.dir, "."+key+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = temp.WriteString(sql); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), s.path(key))
+}
+
+func (s *dirStore) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *dirStore) Close() error {
+	return nil
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+	sql     string
+}
+
+// Watch polls the modification times and sizes of the files, and reports the files whose content changed
+func (s *dirStore) Watch(interval time.Duration, onChange func(Change)) (stop func()) {
+	versions := map[string]*fileVersion{}
+	s.poll(versions, nil)
+	return s.watch(versions, interval, onChange)
+}
+
+// WatchFrom reports the files whose content differs from rules on the first poll, which reads every file of rules
+func (s *dirStore) WatchFrom(rules map[string]string, interval time.Duration, onChange func(Change)) (stop func()) {
+	versions := make(map[string]*fileVersion, len(rules))
+	for key, sql := range rules {
+		versions[key] = &fileVersion{size: -1, sql: sql}
+	}
+	return s.watch(versions, interval, onChange)
+}
+
+// watch polls the files against versions every interval until stop is called
+func (s *dirStore) watch(versions map[string]*fileVersion, interval time.Duration, onChange func(Change)) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.poll(versions, onChange)
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// poll updates versions by the files, and calls onChange with the changes in the order of keys when it is not nil
+func (s *dirStore) poll(versions map[string]*fileVersion, onChange func(Change)) {
+	files, err := s.files()
+	if err != nil {
+		return
+	}
+
+	var changes []Change
+	for key, info := range files {
+		old, ok := versions[key]
+		if ok && old.modTime.Equal(info.ModTime()) && old.size == info.Size() {
+			continue
+		}
+		bin, err := ioutil.ReadFile(s.path(key))
+		if err != nil {
+			continue
+		}
+		versions[key] = &fileVersion{modTime: info.ModTime(), size: info.Size(), sql: string(bin)}
+		if !ok || old.sql != string(bin) {
+			changes = append(changes, Change{Key: key, Sql: string(bin)})
+		}
+	}
+	for key := range versions {
+		if _, ok := files[key]; !ok {
+			delete(versions, key)
+			changes = append(changes, Change{Key: key, Deleted: true})
+		}
+	}
+
+	if onChange == nil {
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	for _, change := range changes {
+		onChange(change)
+	}
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrCorrupted = errors.New("corrupted store file")
+var ErrClosed = errors.New("store closed")
+
+// kvRecord is a line of the file of a key/value store
+type kvRecord struct {
+	Key     string `json:"key"`
+	Sql     string `json:"sql,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// logFile is the file of a key/value store opened for appending
+type logFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Close() error
+}
+
+// kvStore keeps all the rules in a single file, which is a log of json lines of puts and deletes.
+// Every change is appended and synced before it returns, and the log is compacted when it is opened
+// or when it holds more than twice as many records as the keys.
+type kvStore struct {
+	lock    sync.Mutex
+	path    string
+	file    logFile
+	rules   map[string]string
+	records int
+}
+
+// NewKVStore opens the store file of path, which is created if it does not exist.
+// A last record half written by a crash is dropped.
+func NewKVStore(path string) (RuleStore, error) {
+	s := &kvStore{path: path, rules: map[string]string{}}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *kvStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil //a line without \n is half written
+		} else if err != nil {
+			return err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var record kvRecord
+		if err = json.Unmarshal(line, &record); err != nil || record.Key == "" {
+			return ErrCorrupted
+		}
+		if record.Deleted {
+			delete(s.rules, record.Key)
+		} else {
+			s.rules[record.Key] = record.Sql
+		}
+	}
+}
+
+// compact rewrites the file with a record per key through a temporary file, and opens it for appending
+func (s *kvStore) compact() error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for key, sql := range s.rules {
+		if err := encoder.Encode(&kvRecord{Key: key, Sql: sql}); err != nil {
+			return err
+		}
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = temp.Write(buf.Bytes()); err == nil {
+		err = temp.Sync()
+	}
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	if err = os.Rename(temp.Name(), s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.records = len(s.rules)
+	return nil
+}
+
+// append writes record into the file and syncs it, the caller must hold the lock.
+// A record failing to be written is truncated from the file, so that the next records do not follow a broken line.
+func (s *kvStore) append(record *kvRecord) error {
+	if s.file == nil {
+		return ErrClosed
+	}
+	bin, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(append(bin, '\n')); err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		if s.file.Truncate(info.Size()) != nil {
+			//the broken line stays last, where it is dropped when the file is loaded
+			s.file.Close()
+			s.file = nil
+		}
+		return err
+	}
+	s.records++
+	return nil
+}
+
+// appendChange appends the record of a change already made to the rules, which is undone when it fails to be written
+func (s *kvStore) appendChange(record *kvRecord, undo func()) error {
+	if err := s.append(record); err != nil {
+		undo()
+		return err
+	}
+	if s.records > 2*len(s.rules)+16 {
+		return s.compact() //the change is already synced
+	}
+	return nil
+}
+
+func (s *kvStore) List() (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rules := make(map[string]string, len(s.rules))
+	for key, sql := range s.rules {
+		rules[key] = sql
+	}
+	return rules, nil
+}
+
+func (s *kvStore) Get(key string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sql, ok := s.rules[key]; ok {
+		return sql, nil
+	}
+	return "", ErrNotFound
+}
+
+func (s *kvStore) Put(key string, sql string) error {
+	if key == "" {
+		return ErrInvalidKey
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, ok := s.rules[key]
+	s.rules[key] = sql
+	return s.appendChange(&kvRecord{Key: key, Sql: sql}, func() {
+		if ok {
+			s.rules[key] = old
+		} else {
+			delete(s.rules, key)
+		}
+	})
+}
+
+func (s *kvStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, ok := s.rules[key]
+	if !ok {
+		return nil
+	}
+	delete(s.rules, key)
+	return s.appendChange(&kvRecord{Key: key, Deleted: true}, func() {
+		s.rules[key] = old
+	})
+}
+
+func (s *kvStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
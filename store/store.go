@@ -0,0 +1,39 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrInvalidKey = errors.New("invalid key")
+var ErrNotFound = errors.New("not found")
+
+// DefaultWatchInterval is how often a watcher polls its store
+const DefaultWatchInterval = 2 * time.Second
+
+// RuleStore keeps the sql of rules by key, the key of a rule is not necessarily its id
+type RuleStore interface {
+	List() (map[string]string, error)
+	Get(key string) (string, error)
+	Put(key string, sql string) error
+	Delete(key string) error
+	Close() error
+}
+
+// Change is a rule put into or deleted from a store
+type Change struct {
+	Key     string
+	Sql     string
+	Deleted bool
+}
+
+// Watcher is a store whose changes made by others, such as a directory edited by hand, can be watched
+type Watcher interface {
+	RuleStore
+	// Watch calls onChange with the changes found every interval until stop is called,
+	// the rules already in the store when it is called are not reported
+	Watch(interval time.Duration, onChange func(Change)) (stop func())
+	// WatchFrom is Watch which reports the changes from rules, the sql by key known to the caller,
+	// so that the changes made between a List and the watch are not missed
+	WatchFrom(rules map[string]string, interval time.Duration, onChange func(Change)) (stop func())
+}
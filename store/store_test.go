@@ -0,0 +1,211 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("a", `select a from "a"`); err != nil {
+		t.Error(err)
+	}
+	if err = s.Put("../b", "x"); err != ErrInvalidKey {
+		t.Error(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0644)
+
+	changes := make(chan Change, 10)
+	stop := s.Watch(10*time.Millisecond, func(change Change) {
+		changes <- change
+	})
+	defer stop()
+
+	s.Put("b", `select b from "b"`)
+	ioutil.WriteFile(filepath.Join(dir, "a.sql"), []byte(`select aa from "a"`), 0644)
+	got := map[string]Change{}
+	for len(got) < 2 {
+		select {
+		case change := <-changes:
+			got[change.Key] = change
+		case <-time.After(time.Second):
+			t.Fatal(got)
+		}
+	}
+	if got["a"].Sql != `select aa from "a"` || got["b"].Sql != `select b from "b"` {
+		t.Error(got)
+	}
+
+	s.Delete("a")
+	select {
+	case change := <-changes:
+		if change.Key != "a" || !change.Deleted {
+			t.Error(change)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no delete")
+	}
+
+	rules, err := s.List()
+	if err != nil || !reflect.DeepEqual(rules, map[string]string{"b": `select b from "b"`}) {
+		t.Error(rules, err)
+	}
+	if _, err = s.Get("a"); err != ErrNotFound {
+		t.Error(err)
+	}
+}
+
+func TestDirStoreWatchFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("same", `select a from "a"`)
+	s.Put("edited", `select b from "b"`)
+	s.Put("added", `select c from "c"`)
+
+	//the changes from the rules listed before, rather than from the files when the watch starts
+	changes := make(chan Change, 10)
+	stop := s.WatchFrom(map[string]string{"same": `select a from "a"`, "edited": `select x from "b"`, "deleted": `select d from "d"`},
+		10*time.Millisecond, func(change Change) {
+			changes <- change
+		})
+	defer stop()
+
+	got := map[string]Change{}
+	for len(got) < 3 {
+		select {
+		case change := <-changes:
+			got[change.Key] = change
+		case <-time.After(time.Second):
+			t.Fatal(got)
+		}
+	}
+	want := map[string]Change{
+		"added":   {Key: "added", Sql: `select c from "c"`},
+		"deleted": {Key: "deleted", Deleted: true},
+		"edited":  {Key: "edited", Sql: `select b from "b"`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error(got)
+	}
+	select {
+	case change := <-changes:
+		t.Error(change)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestKVStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.db")
+
+	s, err := NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		s.Put("a", `select a from "a"`)
+	}
+	s.Put("b", `select b from "b"`)
+	s.Put("c", `select c from "c"`)
+	s.Delete("c")
+	s.Close()
+	if err = s.Put("d", "x"); err != ErrClosed {
+		t.Error(err)
+	}
+
+	//a record half written by a crash
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"key":"e","sql":"sel`)
+	file.Close()
+
+	s, err = NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	rules, _ := s.List()
+	if !reflect.DeepEqual(rules, map[string]string{"a": `select a from "a"`, "b": `select b from "b"`}) {
+		t.Error(rules)
+	}
+	bin, _ := ioutil.ReadFile(path)
+	if len(bin) > 100 {
+		t.Error(string(bin))
+	}
+
+	ioutil.WriteFile(path, []byte("garbage\n"), 0644)
+	if _, err = NewKVStore(path); err != ErrCorrupted {
+		t.Error(err)
+	}
+}
+
+// shortFile writes half of what it is given and fails
+type shortFile struct {
+	*os.File
+}
+
+func (f shortFile) Write(b []byte) (int, error) {
+	n, _ := f.File.Write(b[:len(b)/2])
+	return n, errors.New("disk full")
+}
+
+func TestKVStoreFailedAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.db")
+
+	s, err := NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a", `select a from "a"`)
+	kv := s.(*kvStore)
+	file := kv.file.(*os.File)
+	kv.file = shortFile{file}
+	if err = s.Put("b", `select b from "b"`); err == nil {
+		t.Error("put with a short write")
+	}
+	kv.file = file
+	if err = s.Put("c", `select c from "c"`); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	rules, _ := s.List()
+	if !reflect.DeepEqual(rules, map[string]string{"a": `select a from "a"`, "c": `select c from "c"`}) {
+		t.Error(rules)
+	}
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// KeyOrder is the order of the keys of nested objects, as the order of the key paths added into it.
+// The elements of an array share the order of the array itself.
+type KeyOrder struct {
+	keys     []string
+	children map[string]*KeyOrder
+}
+
+func NewKeyOrder() *KeyOrder {
+	return &KeyOrder{}
+}
+
+func (o *KeyOrder) child(key string) *KeyOrder {
+	if c, ok := o.children[key]; ok {
+		return c
+	}
+	if o.children == nil {
+		o.children = map[string]*KeyOrder{}
+	}
+	c := &KeyOrder{}
+	o.children[key] = c
+	o.keys = append(o.keys, key)
+	return c
+}
+
+// Has reports whether key is added at the top level, any key is when * is added
+func (o *KeyOrder) Has(key string) bool {
+	if _, ok := o.children[key]; ok {
+		return true
+	}
+	_, ok := o.children["*"]
+	return ok
+}
+
+// Add appends the keys of keyPath which are not added yet, array indexes of a target path are ignored.
+// The key path * stands for the other keys of the object, which are ordered alphabetically.
+func (o *KeyOrder) Add(keyPath string) *KeyOrder {
+	if keyPath == "*" {
+		o.child(keyPath)
+		return o
+	}
+	steps, ok := parseTargetPath(keyPath)
+	if !ok {
+		return o
+	}
+	node := o
+	for _, step := range steps {
+		if !step.isIndex {
+			node = node.child(step.key)
+		}
+	}
+	return o
+}
+
+func (o *KeyOrder) orderedKeys(mp map[string]interface{}) []string {
+	keys := make([]string, 0, len(mp))
+	listed := make(map[string]bool, len(o.keys))
+	for _, key := range o.keys {
+		listed[key] = true
+	}
+
+	var others []string
+	for key := range mp {
+		if !listed[key] {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+
+	star := false
+	for _, key := range o.keys {
+		if key == "*" {
+			keys = append(keys, others...)
+			star = true
+		} else if _, ok := mp[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	if !star {
+		keys = append(keys, others...)
+	}
+	return keys
+}
+
+func (o *KeyOrder) encode(buf *bytes.Buffer, value interface{}) error {
+	if o == nil || len(o.keys) == 0 || value == nil {
+		bin, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(bin)
+		return nil
+	}
+
+	if mp, ok := value.(map[string]interface{}); ok {
+		buf.WriteByte('{')
+		for i, key := range o.orderedKeys(mp) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			bin, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			buf.Write(bin)
+			buf.WriteByte(':')
+			var child *KeyOrder
+			if key != "*" {
+				child = o.children[key]
+			}
+			if err = child.encode(buf, mp[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	}
+
+	val := reflect.ValueOf(value)
+	if (val.Kind() == reflect.Slice || val.Kind() == reflect.Array) && val.Type().Elem().Kind() == reflect.Interface {
+		if val.Kind() == reflect.Slice && val.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		buf.WriteByte('[')
+		for i := 0; i < val.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := o.encode(buf, val.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+
+	bin, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	buf.Write(bin)
+	return nil
+}
+
+// MarshalOrdered encodes value into json like json.Marshal, but with the keys of objects in order,
+// the keys not in order are sorted alphabetically. Indent is used as json.MarshalIndent when not empty.
+func MarshalOrdered(value interface{}, order *KeyOrder, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := order.encode(&buf, value); err != nil {
+		return nil, err
+	}
+	if indent == "" {
+		return buf.Bytes(), nil
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", indent); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
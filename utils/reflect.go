@@ -0,0 +1,342 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structFields is the json names of the fields of a struct type, as encoding/json names them
+type structFields struct {
+	exact     map[string][]int
+	fold      map[string][]int //lower case names
+	omitEmpty map[string]bool
+}
+
+var structFieldsCache sync.Map //map[reflect.Type]*structFields
+
+func typeFields(t reflect.Type) *structFields {
+	if f, ok := structFieldsCache.Load(t); ok {
+		return f.(*structFields)
+	}
+	fields := &structFields{exact: map[string][]int{}, fold: map[string][]int{}, omitEmpty: map[string]bool{}}
+	collectFields(t, nil, fields, map[reflect.Type]bool{})
+	f, _ := structFieldsCache.LoadOrStore(t, fields)
+	return f.(*structFields)
+}
+
+// collectFields adds the exported fields of t, and the fields of its embedded structs which are not shadowed
+func collectFields(t reflect.Type, index []int, fields *structFields, visited map[reflect.Type]bool) {
+	if visited[t] {
+		return
+	}
+	visited[t] = true
+
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := tag
+		if n := strings.IndexByte(tag, ','); n >= 0 {
+			name = tag[:n]
+		}
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, sf)
+				continue
+			}
+		}
+		if sf.PkgPath != "" { //unexported
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if _, ok := fields.exact[name]; ok {
+			continue
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+		fields.exact[name] = fieldIndex
+		fields.omitEmpty[name] = strings.Contains(tag, ",omitempty")
+		if _, ok := fields.fold[strings.ToLower(name)]; !ok {
+			fields.fold[strings.ToLower(name)] = fieldIndex
+		}
+	}
+
+	//the fields of embedded structs are shallower than theirs
+	for _, sf := range embedded {
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		collectFields(ft, append(append([]int{}, index...), sf.Index...), fields, visited)
+	}
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex, but returns false on a nil embedded pointer
+func fieldByIndex(val reflect.Value, index []int) (reflect.Value, bool) {
+	for i, n := range index {
+		if i > 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				return reflect.Value{}, false
+			}
+			val = val.Elem()
+		}
+		val = val.Field(n)
+	}
+	return val, true
+}
+
+// plainValue returns the value of val as an interface{}, nil for nil pointers, maps, slices and interfaces,
+// with pointers dereferenced and named basic types converted into the predeclared ones, e.g. type Status string into string
+func plainValue(val reflect.Value) interface{} {
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+	switch val.Kind() {
+	case reflect.Map, reflect.Slice:
+		if val.IsNil() {
+			return nil
+		}
+	case reflect.Bool:
+		return val.Bool()
+	case reflect.String:
+		return val.String()
+	case reflect.Int:
+		return int(val.Int())
+	case reflect.Int8:
+		return int8(val.Int())
+	case reflect.Int16:
+		return int16(val.Int())
+	case reflect.Int32:
+		return int32(val.Int())
+	case reflect.Int64:
+		return val.Int()
+	case reflect.Uint:
+		return uint(val.Uint())
+	case reflect.Uint8:
+		return uint8(val.Uint())
+	case reflect.Uint16:
+		return uint16(val.Uint())
+	case reflect.Uint32:
+		return uint32(val.Uint())
+	case reflect.Uint64:
+		return val.Uint()
+	case reflect.Float32:
+		return float32(val.Float())
+	case reflect.Float64:
+		return val.Float()
+	}
+	if !val.CanInterface() {
+		return nil
+	}
+	return val.Interface()
+}
+
+// Fielder is an object looking up its own members, such as a wrapper of another object
+type Fielder interface {
+	Field(key string) (interface{}, bool)
+}
+
+// GetField returns the member key of obj, which may be a map with string keys, a Fielder, or a struct (or a pointer to it)
+// whose fields are named by their json tags. For an array or a slice of any type, it returns the members key
+// of its objects in an array, skipping the elements which are not objects.
+func GetField(obj interface{}, key string) (interface{}, bool) {
+	switch v := obj.(type) {
+	case nil:
+		return nil, false
+	case map[string]interface{}:
+		val, ok := v[key]
+		return val, ok
+	case Fielder:
+		return v.Field(key)
+	case []interface{}:
+		ret := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			if isObject(elem) {
+				val, _ := GetField(elem, key)
+				ret = append(ret, val)
+			}
+		}
+		return ret, true
+	}
+
+	val := reflect.ValueOf(obj)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil, false
+		}
+		val = val.Elem()
+	}
+	switch val.Kind() {
+	case reflect.Map:
+		if val.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		member := val.MapIndex(reflect.ValueOf(key).Convert(val.Type().Key()))
+		if !member.IsValid() {
+			return nil, false
+		}
+		return plainValue(member), true
+	case reflect.Struct:
+		fields := typeFields(val.Type())
+		index, ok := fields.exact[key]
+		if !ok {
+			if index, ok = fields.fold[strings.ToLower(key)]; !ok {
+				return nil, false
+			}
+		}
+		member, ok := fieldByIndex(val, index)
+		if !ok {
+			return nil, false
+		}
+		return plainValue(member), true
+	case reflect.Slice, reflect.Array:
+		ret := make([]interface{}, 0, val.Len())
+		for i := 0; i < val.Len(); i++ {
+			elem := plainValue(val.Index(i))
+			if isObject(elem) {
+				member, _ := GetField(elem, key)
+				ret = append(ret, member)
+			}
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+// GetIndex returns the element at index of an array or a slice of any type
+func GetIndex(obj interface{}, index int) (interface{}, bool) {
+	if arr, ok := obj.([]interface{}); ok {
+		if index < 0 || index >= len(arr) {
+			return nil, false
+		}
+		return arr[index], true
+	}
+	if obj == nil {
+		return nil, false
+	}
+	val := reflect.ValueOf(obj)
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return nil, false
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array || index < 0 || index >= val.Len() {
+		return nil, false
+	}
+	return plainValue(val.Index(index)), true
+}
+
+// isEmptyValue reports whether val is omitted by encoding/json with omitempty
+func isEmptyValue(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return val.Len() == 0
+	case reflect.Bool:
+		return !val.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return val.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return val.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return val.IsNil()
+	}
+	return false
+}
+
+func isObject(value interface{}) bool {
+	if _, ok := value.(map[string]interface{}); ok {
+		return true
+	}
+	if value == nil {
+		return false
+	}
+	t := reflect.TypeOf(value)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct || t.Kind() == reflect.Map && t.Key().Kind() == reflect.String
+}
+
+// Plain converts structs, maps with string keys, arrays and slices of any type into the values decoded from json:
+// map[string]interface{} and []interface{}, recursively. Other values are returned as plainValue does.
+func Plain(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			ret[key] = Plain(val)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, val := range v {
+			ret[i] = Plain(val)
+		}
+		return ret
+	}
+
+	val := reflect.ValueOf(value)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+	switch val.Kind() {
+	case reflect.Map:
+		if val.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if val.IsNil() {
+			return nil
+		}
+		ret := make(map[string]interface{}, val.Len())
+		iter := val.MapRange()
+		for iter.Next() {
+			ret[iter.Key().String()] = Plain(plainValue(iter.Value()))
+		}
+		return ret
+	case reflect.Struct:
+		if val.Type().PkgPath() == "time" { //time.Time is a value rather than an object
+			break
+		}
+		fields := typeFields(val.Type())
+		ret := make(map[string]interface{}, len(fields.exact))
+		for name, index := range fields.exact {
+			if member, ok := fieldByIndex(val, index); ok && !(fields.omitEmpty[name] && isEmptyValue(member)) {
+				ret[name] = Plain(plainValue(member))
+			}
+		}
+		return ret
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8 {
+			break //[]byte is encoded as a base64 string by encoding/json
+		}
+		if val.Kind() == reflect.Slice && val.IsNil() {
+			return nil
+		}
+		ret := make([]interface{}, val.Len())
+		for i := range ret {
+			ret[i] = Plain(plainValue(val.Index(i)))
+		}
+		return ret
+	}
+	return plainValue(val)
+}
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	appendIndex   = -1 // a[] appends an element
+	wildcardIndex = -2 // a[*] sets the elements of an array value one by one
+
+	maxTargetIndex = 1<<16 - 1
+)
+
+type pathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseTargetPath splits a target path like a.b[0].c[].d[*] into steps, a key which is not an identifier
+// is quoted like a.`content-type` or a."content-type", or put in brackets like a['@timestamp'] or a["@timestamp"]
+func parseTargetPath(keyPath string) ([]pathStep, bool) {
+	if keyPath == "" {
+		return nil, false
+	}
+	var steps []pathStep
+	for i := 0; i < len(keyPath); {
+		if len(steps) > 0 {
+			if keyPath[i] == '[' {
+				step, n, ok := parseIndex(keyPath[i:])
+				if !ok {
+					return nil, false
+				}
+				steps = append(steps, step)
+				i += n
+				continue
+			} else if keyPath[i] != '.' {
+				return nil, false
+			}
+			i++
+		}
+
+		key, n, ok := parseKey(keyPath[i:])
+		if !ok {
+			return nil, false
+		}
+		steps = append(steps, pathStep{key: key})
+		i += n
+	}
+	return steps, true
+}
+
+// parseKey reads an identifier or a quoted key at the beginning of text, and returns the number of bytes read
+func parseKey(text string) (string, int, bool) {
+	if text == "" {
+		return "", 0, false
+	}
+	if text[0] == '`' || text[0] == '"' {
+		end := strings.IndexByte(text[1:], text[0])
+		if end <= 0 {
+			return "", 0, false
+		}
+		return text[1 : end+1], end + 2, true
+	}
+	n := 0
+	for i, r := range text {
+		if r == '_' || unicode.IsLetter(r) || i > 0 && unicode.IsDigit(r) {
+			n = i + utf8.RuneLen(r)
+			continue
+		}
+		break
+	}
+	return text[:n], n, n > 0
+}
+
+// parseIndex reads [n], [], [*], ['key'], ["key"] or [`key`] at the beginning of text, and returns the number of bytes read
+func parseIndex(text string) (pathStep, int, bool) {
+	end := strings.IndexByte(text, ']')
+	if len(text) > 1 && (text[1] == '\'' || text[1] == '"' || text[1] == '`') {
+		quote := strings.IndexByte(text[2:], text[1])
+		if quote <= 0 || len(text) <= quote+3 || text[quote+3] != ']' {
+			return pathStep{}, 0, false
+		}
+		return pathStep{key: text[2 : quote+2]}, quote + 4, true
+	}
+	if end < 0 {
+		return pathStep{}, 0, false
+	}
+	step := pathStep{isIndex: true}
+	switch index := text[1:end]; index {
+	case "":
+		step.index = appendIndex
+	case "*":
+		step.index = wildcardIndex
+	default:
+		for _, c := range index {
+			if c < '0' || c > '9' {
+				return pathStep{}, 0, false
+			}
+		}
+		n, err := strconv.Atoi(index)
+		if err != nil || n > maxTargetIndex {
+			return pathStep{}, 0, false
+		}
+		step.index = n
+	}
+	return step, end + 1, true
+}
+
+// IsKeyPath reports whether keyPath is a target path of keys only, quoted or not
+func IsKeyPath(keyPath string) bool {
+	steps, ok := parseTargetPath(keyPath)
+	if !ok {
+		return false
+	}
+	for _, step := range steps {
+		if step.isIndex {
+			return false
+		}
+	}
+	return true
+}
+
+// isPlainPath reports whether keyPath can be split by . into keys
+func isPlainPath(keyPath string) bool {
+	return !strings.ContainsAny(keyPath, "[`\"'")
+}
+
+// IsValidTargetPath reports whether keyPath can be written by SetByPath:
+// a key path whose keys may be quoted, and followed by array indexes [n], appending [] or wildcard [*]
+func IsValidTargetPath(keyPath string) bool {
+	if keyPath == "*" {
+		return true
+	}
+	_, ok := parseTargetPath(keyPath)
+	return ok
+}
+
+func toArray(value interface{}) []interface{} {
+	if arr, ok := value.([]interface{}); ok {
+		return arr
+	}
+	if value != nil {
+		val := reflect.ValueOf(value)
+		if val.Kind() == reflect.Slice || val.Kind() == reflect.Array {
+			arr := make([]interface{}, val.Len())
+			for i := range arr {
+				arr[i] = val.Index(i).Interface()
+			}
+			return arr
+		}
+	}
+	return []interface{}{value}
+}
+
+// setStep writes value into container at steps, creating the missing maps and arrays, and returns the container
+func setStep(container interface{}, steps []pathStep, value interface{}) interface{} {
+	if len(steps) == 0 {
+		return value
+	}
+
+	step := steps[0]
+	if !step.isIndex {
+		mp, ok := container.(map[string]interface{})
+		if !ok {
+			mp = map[string]interface{}{}
+		}
+		mp[step.key] = setStep(mp[step.key], steps[1:], value)
+		return mp
+	}
+
+	arr, _ := container.([]interface{})
+	switch step.index {
+	case appendIndex:
+		arr = append(arr, setStep(nil, steps[1:], value))
+	case wildcardIndex:
+		for i, elem := range toArray(value) {
+			for len(arr) <= i {
+				arr = append(arr, nil)
+			}
+			arr[i] = setStep(arr[i], steps[1:], elem)
+		}
+	default:
+		for len(arr) <= step.index {
+			arr = append(arr, nil)
+		}
+		arr[step.index] = setStep(arr[step.index], steps[1:], value)
+	}
+	return arr
+}
+
+// getStep reads the value at steps of container, appending and wildcard indexes read nothing
+func getStep(container interface{}, steps []pathStep) interface{} {
+	for _, step := range steps {
+		var ok bool
+		if !step.isIndex {
+			container, ok = GetField(container, step.key)
+		} else {
+			container, ok = GetIndex(container, step.index)
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return container
+}
@@ -28,6 +28,10 @@ func GetInt64(val interface{}) (int64, error) {
 		return int64(n), nil
 	case uint16:
 		return int64(n), nil
+	case uint:
+		return int64(n), nil
+	case uint64:
+		return int64(n), nil
 	case json.Number:
 		v, err := n.Int64()
 		if err != nil {
@@ -68,6 +72,10 @@ func GetFloat64(val interface{}) (float64, error) {
 		return float64(n), nil
 	case uint16:
 		return float64(n), nil
+	case uint:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
 	case json.Number:
 		v, err := n.Float64()
 		if err != nil {
@@ -162,24 +170,36 @@ func AdjustKeyPath(keyPath string) string {
 	return string(key)
 }
 
+// GetByPath reads the value at keyPath of obj, whose keys may be followed by array indexes like a.b[0].c,
+// over maps, structs, arrays and slices, see GetField
 func GetByPath(obj interface{}, keyPath string) interface{} {
-	keys := strings.Split(keyPath, ".")
-	var val interface{}
-	for _, k := range keys {
-		if obj != nil {
-			if mp, ok := obj.(map[string]interface{}); ok {
-				if val, ok = mp[k]; ok {
-					obj, _ = val.(map[string]interface{})
-					continue
-				}
-			}
+	if !isPlainPath(keyPath) {
+		steps, ok := parseTargetPath(keyPath)
+		if !ok {
+			return nil
 		}
-		return nil
+		return getStep(obj, steps)
 	}
-	return val
+
+	for _, key := range strings.Split(keyPath, ".") {
+		var ok bool
+		if obj, ok = GetField(obj, key); !ok {
+			return nil
+		}
+	}
+	return obj
 }
 
+// SetByPath writes value into obj at keyPath, creating the missing maps,
+// and the missing arrays for the array indexes of a target path, see IsValidTargetPath
 func SetByPath(obj map[string]interface{}, keyPath string, value interface{}) {
+	if !isPlainPath(keyPath) {
+		if steps, ok := parseTargetPath(keyPath); ok {
+			setStep(obj, steps, value)
+		}
+		return
+	}
+
 	keys := strings.Split(keyPath, ".")
 	depth := len(keys)
 	var val interface{}
@@ -198,3 +218,78 @@ func SetByPath(obj map[string]interface{}, keyPath string, value interface{}) {
 	}
 	obj[keys[depth-1]] = value
 }
+
+// DeepCopy copies the maps and arrays decoded from json recursively, other values are shared
+func DeepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			ret[key] = DeepCopy(val)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, val := range v {
+			ret[i] = DeepCopy(val)
+		}
+		return ret
+	}
+	return value
+}
+
+// DeleteByPath removes the key at keyPath from obj, missing keys are ignored
+func DeleteByPath(obj map[string]interface{}, keyPath string) {
+	if !isPlainPath(keyPath) {
+		steps, ok := parseTargetPath(keyPath)
+		if !ok || steps[len(steps)-1].isIndex {
+			return
+		}
+		parent, _ := getStep(obj, steps[:len(steps)-1]).(map[string]interface{})
+		if parent != nil {
+			delete(parent, steps[len(steps)-1].key)
+		}
+		return
+	}
+
+	keys := strings.Split(keyPath, ".")
+	depth := len(keys)
+	for i := 0; i < depth-1; i++ {
+		var ok bool
+		if obj, ok = obj[keys[i]].(map[string]interface{}); !ok {
+			return
+		}
+	}
+	delete(obj, keys[depth-1])
+}
+
+// MergeValue merges src into dst when both are objects, keys of src win at the leaves.
+// Otherwise src replaces dst. Neither dst nor src is modified.
+func MergeValue(dst, src interface{}) interface{} {
+	srcMap, ok := src.(map[string]interface{})
+	if !ok {
+		return src
+	}
+	dstMap, ok := dst.(map[string]interface{})
+	if !ok {
+		return src
+	}
+	ret := make(map[string]interface{}, len(dstMap)+len(srcMap))
+	for key, val := range dstMap {
+		ret[key] = val
+	}
+	for key, val := range srcMap {
+		ret[key] = MergeValue(ret[key], val)
+	}
+	return ret
+}
+
+// MergeByPath is SetByPath, but merges value into the object already at keyPath, see MergeValue
+func MergeByPath(obj map[string]interface{}, keyPath string, value interface{}) {
+	if _, ok := value.(map[string]interface{}); ok && (isPlainPath(keyPath) || IsKeyPath(keyPath)) {
+		if old := GetByPath(obj, keyPath); old != nil {
+			value = MergeValue(old, value)
+		}
+	}
+	SetByPath(obj, keyPath, value)
+}
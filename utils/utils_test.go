@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSetByTargetPath(t *testing.T) {
+	obj := map[string]interface{}{}
+	SetByPath(obj, "out.items[1].v", 1)
+	SetByPath(obj, "out.items[0].v", 0)
+	SetByPath(obj, "out.tags[]", "a")
+	SetByPath(obj, "out.tags[]", "b")
+	SetByPath(obj, "out.rows[*].id", []interface{}{"x", "y"})
+	SetByPath(obj, "out.rows[*].v", []interface{}{1, 2})
+	SetByPath(obj, "out.matrix[0][1]", true)
+
+	bin, _ := json.Marshal(obj)
+	want := `{"out":{"items":[{"v":0},{"v":1}],"matrix":[[null,true]],"rows":[{"id":"x","v":1},{"id":"y","v":2}],"tags":["a","b"]}}`
+	if string(bin) != want {
+		t.Error(string(bin))
+	}
+}
+
+func TestIsValidTargetPath(t *testing.T) {
+	for _, path := range []string{"a", "a.b", "a[0]", "a[].b", "a[*].b[*]", "a[1][2].c", "*"} {
+		if !IsValidTargetPath(path) {
+			t.Error(path)
+		}
+	}
+	for _, path := range []string{"", "a.", "1a", "a[-1]", "a[x]", "a[0", "a.[0]", "a[99999999]"} {
+		if IsValidTargetPath(path) {
+			t.Error(path)
+		}
+	}
+}
+
+func TestMarshalOrdered(t *testing.T) {
+	order := NewKeyOrder().Add("z").Add("*").Add("a.y").Add("a.x").Add("rows[*].b").Add("rows[*].a")
+	obj := map[string]interface{}{
+		"a":    map[string]interface{}{"x": 1, "y": 2},
+		"c":    3,
+		"b":    4,
+		"z":    5,
+		"rows": []interface{}{map[string]interface{}{"a": 1, "b": 2}},
+	}
+	bin, err := MarshalOrdered(obj, order, "")
+	want := `{"z":5,"b":4,"c":3,"a":{"y":2,"x":1},"rows":[{"b":2,"a":1}]}`
+	if err != nil || string(bin) != want {
+		t.Error(string(bin), err)
+	}
+}
+
+type testStatus string
+
+type testBase struct {
+	ID   int    `json:"id"`
+	Kind string `json:"kind,omitempty"`
+}
+
+type testDevice struct {
+	testBase
+	Name    string            `json:"name"`
+	Status  testStatus        `json:"status"`
+	Secret  string            `json:"-"`
+	Temp    *float64          `json:"temp"`
+	Tags    []string          `json:"tags"`
+	Labels  map[string]string `json:"labels"`
+	Parts   []*testBase       `json:"parts"`
+	Untaged bool
+	hidden  int
+}
+
+func TestGetByPathReflection(t *testing.T) {
+	temp := 21.5
+	dev := &testDevice{testBase: testBase{ID: 7}, Name: "d", Status: "on", Secret: "s", Temp: &temp,
+		Tags: []string{"a", "b"}, Labels: map[string]string{"site": "x"}, Parts: []*testBase{{ID: 1}, nil, {ID: 2}}, hidden: 1}
+
+	for path, want := range map[string]interface{}{
+		"id":          7,
+		"name":        "d",
+		"status":      "on",
+		"temp":        21.5,
+		"tags[1]":     "b",
+		"labels.site": "x",
+		"parts[2].id": 2,
+		"Untaged":     false,
+		"NAME":        "d",
+	} {
+		if got := GetByPath(dev, path); !reflect.DeepEqual(got, want) {
+			t.Error(path, got)
+		}
+	}
+	for _, path := range []string{"Secret", "hidden", "parts[1].id", "tags[5]", "missing"} {
+		if got := GetByPath(dev, path); got != nil {
+			t.Error(path, got)
+		}
+	}
+	if got := GetByPath(dev, "parts.id"); !reflect.DeepEqual(got, []interface{}{1, 2}) {
+		t.Error(got)
+	}
+	if got := GetByPath(map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": 1}, 2}}, "a.b"); !reflect.DeepEqual(got, []interface{}{1}) {
+		t.Error(got)
+	}
+
+	bin, _ := json.Marshal(Plain(dev))
+	want := `{"Untaged":false,"id":7,"labels":{"site":"x"},"name":"d","parts":[{"id":1},null,{"id":2}],"status":"on","tags":["a","b"],"temp":21.5}`
+	if string(bin) != want {
+		t.Error(string(bin))
+	}
+}
+
+func TestQuotedKeyPaths(t *testing.T) {
+	obj := map[string]interface{}{}
+	SetByPath(obj, "a.`content-type`", 1)
+	SetByPath(obj, `a["@timestamp"][0]`, 2)
+	SetByPath(obj, `"1st".b['x.y']`, 3)
+	SetByPath(obj, "température", 4)
+
+	bin, _ := json.Marshal(obj)
+	want := `{"1st":{"b":{"x.y":3}},"a":{"@timestamp":[2],"content-type":1},"température":4}`
+	if string(bin) != want {
+		t.Error(string(bin))
+	}
+	if GetByPath(obj, "`1st`.b[`x.y`]") != 3 || GetByPath(obj, "a['@timestamp'][0]") != 2 {
+		t.Error("get")
+	}
+	DeleteByPath(obj, "a.`content-type`")
+	if GetByPath(obj, "a.`content-type`") != nil {
+		t.Error("delete")
+	}
+
+	for _, path := range []string{"``", "a.`b", `a["b]`, "a['b'", "a.'b'", "a`b`"} {
+		if IsValidTargetPath(path) {
+			t.Error(path)
+		}
+	}
+}